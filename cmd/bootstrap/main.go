@@ -33,7 +33,10 @@ func main() {
 	ctx := context.Background()
 
 	node := node.NewNode(ctx, conf)
-	node.BootStrap()
+	err = node.BootStrap()
+	if err != nil {
+		panic(err)
+	}
 
 	select {}
 }
@@ -11,12 +11,59 @@ import (
 	"github.com/xgreenx/desktop-sharing/src/sharingnode"
 	"os"
 	"strings"
+	"time"
 )
 
+// sessionCommand handles commands of the running viewer session, it returns false for other commands
+func sessionCommand(node *sharingnode.SharingNode, line string) bool {
+	arg := strings.Split(line, " ")
+
+	var err error
+	switch arg[0] {
+	case "keys":
+		if len(arg) < 2 {
+			fmt.Println("Usage: keys <chord> [chord...]")
+			return true
+		}
+		err = node.Macros.Send(strings.Join(arg[1:], " "))
+	case "type":
+		if len(arg) < 2 {
+			fmt.Println("Usage: type <text>")
+			return true
+		}
+		err = node.Macros.Send("text:" + strings.TrimPrefix(line, "type "))
+	case "macro":
+		if len(arg) < 2 {
+			fmt.Println("Macros: ", strings.Join(node.Macros.Names(), ", "))
+			return true
+		}
+		err = node.Macros.SendNamed(arg[1])
+	default:
+		return false
+	}
+
+	if err != nil {
+		fmt.Println("Got error during sending ", err)
+	}
+	return true
+}
+
 func ScanInputCommands(node *sharingnode.SharingNode) {
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		arg := strings.Split(scanner.Text(), " ")
+	// The screen command blocks the loop, so commands of its session are handled while reading
+	lines := make(chan string, 16)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if sessionCommand(node, scanner.Text()) {
+				continue
+			}
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	for line := range lines {
+		arg := strings.Split(line, " ")
 
 		switch arg[0] {
 		case "list":
@@ -33,11 +80,108 @@ func ScanInputCommands(node *sharingnode.SharingNode) {
 				continue
 			}
 
-			err = node.ShareScreen(id)
+			share := sharingnode.ShareOptions{}
+			for _, option := range arg[2:] {
+				switch option {
+				case "record":
+					share.Record = true
+				case "viewonly":
+					share.ViewOnly = true
+				case "audio":
+					share.Audio = true
+				default:
+					fmt.Println("Unknown screen option ", option)
+				}
+			}
+
+			err = node.ShareScreen(id, share)
 			if err != nil {
 				fmt.Println("Got error during sharing ", err)
 				continue
 			}
+		case "capture":
+			if len(arg) < 4 {
+				fmt.Println("Usage: capture <node id> png <dir> [interval] | raw <file> | screenshot <file>")
+				continue
+			}
+
+			id, err := peer.IDB58Decode(arg[1])
+			if err != nil || id == "" {
+				fmt.Println("Wrong id of node ", err)
+				continue
+			}
+
+			headless := &sharingnode.HeadlessOptions{
+				Mode:     sharingnode.HeadlessMode(arg[2]),
+				Path:     arg[3],
+				Interval: time.Second,
+			}
+			if len(arg) > 4 {
+				headless.Interval, err = time.ParseDuration(arg[4])
+				if err != nil {
+					fmt.Println("Wrong interval ", err)
+					continue
+				}
+			}
+
+			err = node.CaptureScreen(id, headless)
+			if err != nil {
+				fmt.Println("Got error during capture ", err)
+				continue
+			}
+		case "control":
+			holder, requests := node.Control.Holder()
+			if holder == "" {
+				fmt.Println("Nobody controls the screen")
+			} else {
+				fmt.Println("Controlled by ", holder)
+			}
+			for _, id := range requests {
+				fmt.Println("Requested by ", id)
+			}
+		case "grant":
+			if len(arg) < 2 {
+				fmt.Println("Usage: grant <node id>")
+				continue
+			}
+
+			id, err := peer.IDB58Decode(arg[1])
+			if err != nil || id == "" {
+				fmt.Println("Wrong id of node ", err)
+				continue
+			}
+
+			err = node.Control.Grant(id)
+			if err != nil {
+				fmt.Println("Got error during grant ", err)
+				continue
+			}
+		case "revoke":
+			node.Control.Revoke()
+		case "block":
+			if len(arg) < 2 {
+				fmt.Println("Usage: block <node id> [chord,...]")
+				continue
+			}
+
+			id, err := peer.IDB58Decode(arg[1])
+			if err != nil || id == "" {
+				fmt.Println("Wrong id of node ", err)
+				continue
+			}
+
+			chords := arg[2:]
+			_, err = sharingnode.ParseKeyChords(chords)
+			if err != nil {
+				fmt.Println("Wrong key chords ", err)
+				continue
+			}
+
+			err = node.AccessStore.SetBlockedChords(id, chords)
+			if err != nil {
+				fmt.Println("Got error during blocking ", err)
+				continue
+			}
 		default:
 			fmt.Println("Unknown command ", arg[0])
 		}
@@ -69,7 +213,10 @@ func main() {
 
 	ctx := context.Background()
 	node := sharingnode.NewSharingNode(ctx, conf)
-	node.BootStrap()
+	err = node.BootStrap()
+	if err != nil {
+		panic(err)
+	}
 	//
 	//peerId, _ := peer.Decode("12D3KooWEj6GxaVrmKWEciRjQkBfEPvTqMyNxtBmmzvnNkavCo18")
 	//node.ShareScreen(peerId)
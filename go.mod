@@ -1,6 +1,6 @@
 module github.com/xgreenx/desktop-sharing
 
-go 1.13
+go 1.18
 
 replace (
 	fyne.io/fyne => github.com/xgreenx/fyne v1.1.3-0.20200126220221-61be546849e8
@@ -9,7 +9,7 @@ replace (
 
 require (
 	fyne.io/fyne v1.1.2
-	github.com/BurntSushi/xgb v0.0.0-20160522181843-27f122750802 // indirect
+	github.com/BurntSushi/xgb v0.0.0-20160522181843-27f122750802
 	github.com/gen2brain/shm v0.0.0-20191025110947-b09d223a76f1 // indirect
 	github.com/go-gl/glfw v0.0.0-20181213070059-819e8ce5125f
 	github.com/go-vgo/robotgo v0.0.0-20191201151851-6417b546fec7
@@ -9,6 +9,7 @@ import (
 	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/protocol"
 	maddr "github.com/multiformats/go-multiaddr"
+	"github.com/pkg/errors"
 	"github.com/spf13/pflag"
 	"github.com/whyrusleeping/go-logging"
 	"os"
@@ -37,11 +38,11 @@ func randomHex(n int) string {
 	return hex.EncodeToString(bytes)
 }
 
-func stringsToAddrs(addrStrings []string) (maddrs []maddr.Multiaddr) {
+func stringsToAddrs(addrStrings []string) (maddrs []maddr.Multiaddr, err error) {
 	for _, addrString := range addrStrings {
 		addr, err := maddr.NewMultiaddr(addrString)
 		if err != nil {
-			panic(err)
+			return nil, errors.Wrapf(err, "Wrong address %s", addrString)
 		}
 		maddrs = append(maddrs, addr)
 	}
@@ -67,12 +68,12 @@ func NewBootstrapConfig() *BootstrapConfig {
 		Protocols: []protocol.ID{
 			CommandID,
 		},
-		ListenAddresses: stringsToAddrs([]string{
-			"/ip4/0.0.0.0/tcp/1488",
-		}),
-		BootstrapPeers: stringsToAddrs([]string{
-			"/ip4/194.9.70.102/tcp/1488/p2p/12D3KooWGA2HXdU4Lx81ak8XcToTKpRTGp4ghxiQsjdvAH2jarUe",
-		}),
+		ListenAddresses: addrList{
+			maddr.StringCast("/ip4/0.0.0.0/tcp/1488"),
+		},
+		BootstrapPeers: addrList{
+			maddr.StringCast("/ip4/194.9.70.102/tcp/1488/p2p/12D3KooWGA2HXdU4Lx81ak8XcToTKpRTGp4ghxiQsjdvAH2jarUe"),
+		},
 	}
 	config.UpdateDefaults()
 
@@ -108,8 +109,14 @@ func (b *BootstrapConfig) LoadConfig() error {
 
 	b.Hop = b.Viper.GetBool("hop")
 	b.LoggingLevel, _ = logging.LogLevel(b.Viper.GetString("logging"))
-	b.BootstrapPeers = stringsToAddrs(b.Viper.GetStringSlice("bootstrap"))
-	b.ListenAddresses = stringsToAddrs(b.Viper.GetStringSlice("listen"))
+	b.BootstrapPeers, err = stringsToAddrs(b.Viper.GetStringSlice("bootstrap"))
+	if err != nil {
+		return err
+	}
+	b.ListenAddresses, err = stringsToAddrs(b.Viper.GetStringSlice("listen"))
+	if err != nil {
+		return err
+	}
 	b.Protocols = protocol.ConvertFromStrings(b.Viper.GetStringSlice("protocols"))
 
 	return nil
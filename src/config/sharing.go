@@ -1,13 +1,31 @@
 package config
 
-import "github.com/libp2p/go-libp2p-core/protocol"
+import (
+	"fmt"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
 
 const StreamID = protocol.ID("/stream/1.0.0")
 const EventID = protocol.ID("/event/1.0.0")
+const AudioID = protocol.ID("/audio/1.0.0")
 
 type SharingOptions struct {
 	StreamOptions         map[string]string
 	ScreenGrabbingOptions map[string]string
+	AudioOptions          map[string]string
+	RecordingOptions      map[string]string
+	// CaptureOptions contains the backend requested from the host and the host's own capture settings
+	CaptureOptions map[string]string
+	// DecoderOptions configure threading of the video decoder in the viewer
+	DecoderOptions map[string]string
+	// LimitsOptions bound the memory which peers can make this node allocate
+	LimitsOptions map[string]string
+	// InputOptions configure injection of the viewer's input into this node
+	InputOptions map[string]string
+	// Macros are key sequences and texts which the viewer sends by name
+	Macros map[string]string
+	// Codecs is the list of video codecs in order of preference
+	Codecs []string
 }
 
 type SharingConfig struct {
@@ -31,28 +49,103 @@ func NewSharingConfig(bootstrap *BootstrapConfig) *SharingConfig {
 		SharingOptions:  &SharingOptions{},
 	}
 
-	for _, p := range []protocol.ID{StreamID, EventID} {
+	for _, p := range []protocol.ID{StreamID, EventID, AudioID} {
 		if !contains(config.Protocols, p) {
 			config.Protocols = append(config.Protocols, p)
 		}
 	}
 
 	config.SharingOptions.StreamOptions = map[string]string{
-		"preset":    "ultrafast",
-		"crf":       "37",
-		"ar":        "44100",
-		"r":         "10",
-		"ac":        "2",
-		"tune":      "zerolatency",
-		"probesize": "32",
-		"maxrate":   "750k",
-		"bufsize":   "3000k",
+		"preset":       "ultrafast",
+		"rate_control": "vbv",
+		"crf":          "37",
+		"ar":           "44100",
+		"r":            "10",
+		"ac":           "2",
+		"tune":         "zerolatency",
+		"probesize":    "32",
+		"maxrate":      "750k",
+		"bufsize":      "3000k",
+		"crc":          "false",
+		"threads":      "0",
 	}
 
 	config.SharingOptions.ScreenGrabbingOptions = map[string]string{
-		"preset":     "ultrafast",
-		"draw_mouse": "0",
-		"r":          "10",
+		"preset":           "ultrafast",
+		"draw_mouse":       "0",
+		"r":                "10",
+		"change_detection": "auto",
+		"keepalive":        "1s",
+	}
+
+	config.SharingOptions.AudioOptions = map[string]string{
+		"format":        "pulse",
+		"device":        "default",
+		"bitrate":       "64000",
+		"output":        "pulse",
+		"output_device": "default",
+		"latency":       "100ms",
+	}
+
+	config.SharingOptions.RecordingOptions = map[string]string{
+		"host":   "false",
+		"path":   fmt.Sprintf("%s/recordings", ConfigPath),
+		"format": "matroska",
+	}
+
+	config.SharingOptions.CaptureOptions = map[string]string{
+		"backend":   "x11grab",
+		"display":   ":0.0",
+		"file":      "",
+		"cursor":    "true",
+		"width":     "",
+		"height":    "",
+		"scale":     "",
+		"algorithm": "bicubic",
+	}
+
+	config.SharingOptions.DecoderOptions = map[string]string{
+		"threads":     "0",
+		"thread_type": "slice",
+		"frames":      "4",
+	}
+
+	config.SharingOptions.LimitsOptions = map[string]string{
+		"max_packet":      "16777216",
+		"max_batch":       "1024",
+		"max_buffered":    "67108864",
+		"max_event_line":  "65536",
+		"max_event_batch": "256",
+	}
+
+	config.SharingOptions.InputOptions = map[string]string{
+		"backend":      "robotgo",
+		"hold_timeout": "10s",
+		"scroll_scale": "1",
+		// Chords are blocked for all viewers in addition to their own chords
+		"blocked_chords": "ctrl+alt+backspace,super+l",
+		// Remote input is paused for this time after the host user moves the mouse, 0 disables it
+		"local_grace": "2s",
+		// Pointer range of the uinput backend like 1920x1080, it is taken from the displays when empty
+		"uinput_size": "",
+	}
+
+	// Chords are separated by spaces, the text: step types the rest of the macro. Macros with
+	// chords of blocked_chords are dropped by hosts with the default input options
+	config.SharingOptions.Macros = map[string]string{
+		"ctrl-alt-del": "ctrl+alt+delete",
+		"alt-tab":      "alt+tab",
+		"super":        "super",
+		"select-all":   "ctrl+a",
+	}
+
+	config.SharingOptions.Codecs = []string{
+		"h264",
+		"vp9",
+		"vp8",
+		"av1",
+		"h264-lossless",
+		"ffv1",
 	}
 
 	config.UpdateDefaults()
@@ -66,6 +159,14 @@ func (b *SharingConfig) UpdateDefaults() {
 	v := b.Viper
 	v.SetDefault("sharing.stream", b.SharingOptions.StreamOptions)
 	v.SetDefault("sharing.screengrabbing", b.SharingOptions.ScreenGrabbingOptions)
+	v.SetDefault("sharing.audio", b.SharingOptions.AudioOptions)
+	v.SetDefault("sharing.recording", b.SharingOptions.RecordingOptions)
+	v.SetDefault("sharing.capture", b.SharingOptions.CaptureOptions)
+	v.SetDefault("sharing.decoder", b.SharingOptions.DecoderOptions)
+	v.SetDefault("sharing.limits", b.SharingOptions.LimitsOptions)
+	v.SetDefault("sharing.input", b.SharingOptions.InputOptions)
+	v.SetDefault("sharing.macros", b.SharingOptions.Macros)
+	v.SetDefault("sharing.codecs", b.SharingOptions.Codecs)
 }
 
 func (b *SharingConfig) LoadConfig() error {
@@ -84,5 +185,42 @@ func (b *SharingConfig) LoadConfig() error {
 		return err
 	}
 
+	err = b.Viper.UnmarshalKey("sharing.audio", &b.SharingOptions.AudioOptions)
+	if err != nil {
+		return err
+	}
+
+	err = b.Viper.UnmarshalKey("sharing.recording", &b.SharingOptions.RecordingOptions)
+	if err != nil {
+		return err
+	}
+
+	err = b.Viper.UnmarshalKey("sharing.capture", &b.SharingOptions.CaptureOptions)
+	if err != nil {
+		return err
+	}
+
+	err = b.Viper.UnmarshalKey("sharing.decoder", &b.SharingOptions.DecoderOptions)
+	if err != nil {
+		return err
+	}
+
+	err = b.Viper.UnmarshalKey("sharing.limits", &b.SharingOptions.LimitsOptions)
+	if err != nil {
+		return err
+	}
+
+	err = b.Viper.UnmarshalKey("sharing.input", &b.SharingOptions.InputOptions)
+	if err != nil {
+		return err
+	}
+
+	err = b.Viper.UnmarshalKey("sharing.macros", &b.SharingOptions.Macros)
+	if err != nil {
+		return err
+	}
+
+	b.SharingOptions.Codecs = b.Viper.GetStringSlice("sharing.codecs")
+
 	return nil
 }
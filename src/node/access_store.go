@@ -13,6 +13,16 @@ import (
 
 const accessTimeout = time.Minute * 10
 
+// Capabilities narrow the event protocol, the peer with the event right and without
+// capabilities saved has all of them
+const (
+	CapabilityPointer  = "pointer"
+	CapabilityKeyboard = "keyboard"
+	CapabilityScroll   = "scroll"
+)
+
+var EventCapabilities = []string{CapabilityPointer, CapabilityKeyboard, CapabilityScroll}
+
 func getProtocolName(id protocol.ID) string {
 	return strings.Split(string(id), "/")[1]
 }
@@ -22,14 +32,45 @@ type AccessRights interface {
 	SetName(string)
 	Id() peer.ID
 	IsAllowed(protocol.ID) bool
+	// IsDenied tells that the protocol was denied explicitly
+	IsDenied(protocol.ID) bool
 	Allow(protocol.ID)
 	Deny(protocol.ID)
+	HasCapability(string) bool
+	SetCapability(string, bool)
 }
 
 type Rights struct {
 	PeerName string
 	PeerId   string
 	Rights   map[string]bool
+	// Capabilities are parts of the event protocol allowed to the peer
+	Capabilities map[string]bool
+	// BlockedChords are key chords of the peer which are never injected, like ctrl+alt+backspace
+	BlockedChords []string
+}
+
+func newRights(id peer.ID) Rights {
+	return Rights{
+		PeerId:       id.String(),
+		Rights:       make(map[string]bool),
+		Capabilities: make(map[string]bool),
+	}
+}
+
+// copy returns rights which don't share maps with r
+func (r *Rights) copy() Rights {
+	result := *r
+	result.Rights = make(map[string]bool, len(r.Rights))
+	for key, value := range r.Rights {
+		result.Rights[key] = value
+	}
+	result.Capabilities = make(map[string]bool, len(r.Capabilities))
+	for key, value := range r.Capabilities {
+		result.Capabilities[key] = value
+	}
+	result.BlockedChords = append([]string(nil), r.BlockedChords...)
+	return result
 }
 
 func (r *Rights) Name() string {
@@ -52,6 +93,11 @@ func (r *Rights) IsAllowed(id protocol.ID) bool {
 	return r.Rights[getProtocolName(id)]
 }
 
+func (r *Rights) IsDenied(id protocol.ID) bool {
+	allowed, ok := r.Rights[getProtocolName(id)]
+	return ok && !allowed
+}
+
 func (r *Rights) Allow(id protocol.ID) {
 	r.Rights[getProtocolName(id)] = true
 }
@@ -60,6 +106,15 @@ func (r *Rights) Deny(id protocol.ID) {
 	r.Rights[getProtocolName(id)] = false
 }
 
+func (r *Rights) HasCapability(capability string) bool {
+	allowed, ok := r.Capabilities[capability]
+	return !ok || allowed
+}
+
+func (r *Rights) SetCapability(capability string, allowed bool) {
+	r.Capabilities[capability] = allowed
+}
+
 type TemporaryRights struct {
 	sync.Mutex
 	Rights
@@ -110,10 +165,11 @@ Begin:
 		rights, ok := a.rights[idS]
 
 		if !ok {
-			rights = Rights{
-				PeerId: id.String(),
-				Rights: make(map[string]bool),
-			}
+			rights = newRights(id)
+		}
+		// Rights are copied by value, so the map must exist before the allower changes it
+		if rights.Capabilities == nil {
+			rights.Capabilities = make(map[string]bool)
 		}
 
 		tRights = TemporaryRights{
@@ -164,3 +220,38 @@ func (a *AccessStore) ReturnAccess(access AccessRights, remember bool) error {
 
 	return nil
 }
+
+// PeerRights returns a copy of the rights which are in effect for the peer. The blocklist is
+// always taken from the saved rights, because it is changed by the host
+func (a *AccessStore) PeerRights(id peer.ID) Rights {
+	idS := strings.ToLower(id.String())
+	a.RLock()
+	defer a.RUnlock()
+
+	saved, ok := a.rights[idS]
+	if !ok {
+		saved = newRights(id)
+	}
+	result := saved.copy()
+	if t, ok := a.temporaryRights[idS]; ok && time.Now().Before(t.tokenDeadline) {
+		result = t.Rights.copy()
+		result.BlockedChords = append([]string(nil), saved.BlockedChords...)
+	}
+
+	return result
+}
+
+// SetBlockedChords saves the key chords which are never injected from the peer
+func (a *AccessStore) SetBlockedChords(id peer.ID, chords []string) error {
+	idS := strings.ToLower(id.String())
+	a.Lock()
+	rights, ok := a.rights[idS]
+	if !ok {
+		rights = newRights(id)
+	}
+	rights.BlockedChords = chords
+	a.rights[idS] = rights
+	a.Unlock()
+
+	return a.DumpRights()
+}
@@ -18,12 +18,15 @@ type ConnectionInfo struct {
 type AllowResult struct {
 	Protocols map[protocol.ID]bool
 	Remember  bool
+	// Capabilities narrow the event protocol, missing ones aren't changed
+	Capabilities map[string]bool
 }
 
 func NewAllowResult() AllowResult {
 	return AllowResult{
-		Remember:  false,
-		Protocols: make(map[protocol.ID]bool),
+		Remember:     false,
+		Protocols:    make(map[protocol.ID]bool),
+		Capabilities: make(map[string]bool),
 	}
 }
 
@@ -37,6 +40,9 @@ type AccessVerifier struct {
 	Host    host.Host
 	Context context.Context
 	Data    *dht.IpfsDHT
+	// QuietDenial are protocols which aren't asked again once the user denied them, other denied
+	// protocols are asked on every connection
+	QuietDenial map[protocol.ID]bool
 }
 
 func NewAccessVerifier(
@@ -81,7 +87,11 @@ func (a *AccessVerifier) Verify(stream network.Stream) (bool, error) {
 		}
 	}()
 
-	if !rights.IsAllowed(stream.Protocol()) {
+	quiet := a.QuietDenial[stream.Protocol()] && rights.IsDenied(stream.Protocol())
+	if quiet {
+		logger.Info("Protocol ", stream.Protocol(), " of ", id, " was denied, the user isn't asked again")
+	}
+	if !rights.IsAllowed(stream.Protocol()) && !quiet {
 		rights.SetName(string(name))
 		connectionInfo := &ConnectionInfo{
 			rights,
@@ -101,6 +111,10 @@ func (a *AccessVerifier) Verify(stream network.Stream) (bool, error) {
 			}
 		}
 
+		for c, allow := range result.Capabilities {
+			rights.SetCapability(c, allow)
+		}
+
 		if result.Remember {
 			remember = true
 		}
@@ -18,5 +18,6 @@ func (a ConsoleAllower) Allow(c *ConnectionInfo) (AllowResult, error) {
 			protocol.ID(config.CommandID): true,
 		},
 		true,
+		nil,
 	}, nil
 }
@@ -0,0 +1,19 @@
+package node
+
+import (
+	"fmt"
+)
+
+// BootstrapError tells which step of the node start failed
+type BootstrapError struct {
+	Step string
+	Err  error
+}
+
+func (e *BootstrapError) Error() string {
+	return fmt.Sprintf("Bootstrap failed to %s: %v", e.Step, e.Err)
+}
+
+func (e *BootstrapError) Cause() error {
+	return e.Err
+}
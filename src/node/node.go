@@ -55,7 +55,7 @@ func nameKey(ID peer.ID) string {
 	return fmt.Sprintf("/%s/name", ID.String())
 }
 
-func (n *Node) BootStrap() {
+func (n *Node) BootStrap() error {
 	var err error
 	relayOpt := make([]relay.RelayOpt, 0)
 
@@ -76,27 +76,30 @@ func (n *Node) BootStrap() {
 		}),
 	)
 	if err != nil {
-		panic(err)
+		return &BootstrapError{"create host", err}
 	}
 	fmt.Println("Host created. We are:", n.Host.ID())
 	logger.Info(n.Host.Addrs())
 
 	if n.Config.Hop {
 		_, err = autonat.NewAutoNATService(n.Context, n.Host)
+		if err != nil {
+			return &BootstrapError{"start AutoNAT service", err}
+		}
 	}
 
 	n.PingService = ping.NewPingService(n.Host)
 	n.DataDht, err = dht.New(n.Context, n.Host, dhtopts.Validator(NullValidator{}))
 	if err != nil {
-		panic(err)
+		return &BootstrapError{"create data DHT", err}
 	}
 
 	logger.Debug("Bootstrapping the DHT")
 	if err = n.RoutingDht.Bootstrap(n.Context); err != nil {
-		panic(err)
+		return &BootstrapError{"bootstrap routing DHT", err}
 	}
 	if err = n.DataDht.Bootstrap(n.Context); err != nil {
-		panic(err)
+		return &BootstrapError{"bootstrap data DHT", err}
 	}
 
 	n.connectBootstrap()
@@ -112,7 +115,7 @@ func (n *Node) BootStrap() {
 	discovery.Advertise(n.Context, routingDiscovery, NODES_TAG)
 	name, err := os.Hostname()
 	if err != nil {
-		panic(err)
+		return &BootstrapError{"get host name", err}
 	}
 	err = n.DataDht.PutValue(n.Context, nameKey(n.Host.ID()), []byte(name), dht.Quorum(1))
 	if err != nil {
@@ -133,6 +136,8 @@ func (n *Node) BootStrap() {
 		logger.Error(err)
 	}
 	n.AccessVerifier = NewAccessVerifier(n.AccessStore, &ConsoleAllower{}, n.Host, n.Context, n.DataDht)
+
+	return nil
 }
 
 func (n *Node) handleCommandStream(stream network.Stream) {
@@ -150,7 +155,8 @@ func (n *Node) connectBootstrap() {
 		peerinfo, err := peer.AddrInfoFromP2pAddr(peerAddr)
 
 		if err != nil {
-			panic(err)
+			logger.Warning("Wrong bootstrap address ", peerAddr, ": ", err)
+			continue
 		}
 
 		wg.Add(1)
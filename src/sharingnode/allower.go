@@ -31,6 +31,8 @@ func getConnectionLabel(id protocol.ID, name string, peerID peer.ID) string {
 		label = fmt.Sprintf("The remote node %s (%s) wants get stream from your screen. Do you allow it?", name, peerID)
 	case config.EventID:
 		label = fmt.Sprintf("The remote node %s (%s) wants send you mouse and key events. Do you allow it?", name, peerID)
+	case config.AudioID:
+		label = fmt.Sprintf("The remote node %s (%s) wants get audio from your computer. Do you allow it?", name, peerID)
 	case config.CommandID:
 		label = fmt.Sprintf("The remote node %s (%s) wants send you terminal commands. Do you allow it?", name, peerID)
 	}
@@ -45,6 +47,8 @@ func getAccessLabel(id protocol.ID) string {
 		label = fmt.Sprintf("Screen streaming")
 	case config.EventID:
 		label = fmt.Sprintf("Receiving events")
+	case config.AudioID:
+		label = fmt.Sprintf("Audio streaming")
 	case config.CommandID:
 		label = fmt.Sprintf("Terminal commands")
 	}
@@ -52,7 +56,21 @@ func getAccessLabel(id protocol.ID) string {
 	return label
 }
 
-func (a GUIAllower) Allow(c *node.ConnectionInfo) (node.AllowResult, error) {
+func getCapabilityLabel(capability string) string {
+	label := ""
+	switch capability {
+	case node.CapabilityPointer:
+		label = "Mouse"
+	case node.CapabilityKeyboard:
+		label = "Keyboard"
+	case node.CapabilityScroll:
+		label = "Scrolling"
+	}
+
+	return label
+}
+
+func (a *GUIAllower) Allow(c *node.ConnectionInfo) (node.AllowResult, error) {
 	a.Lock()
 	defer a.Unlock()
 
@@ -68,6 +86,10 @@ func (a GUIAllower) Allow(c *node.ConnectionInfo) (node.AllowResult, error) {
 			result.Protocols[temp] = b
 		})
 		check.Checked = c.Rights.IsAllowed(temp)
+		// Other unchecked protocols are denied, so the host can allow streaming without control
+		if temp != c.Protocol {
+			result.Protocols[temp] = check.Checked
+		}
 		pCBs[i] = check
 	}
 
@@ -75,6 +97,21 @@ func (a GUIAllower) Allow(c *node.ConnectionInfo) (node.AllowResult, error) {
 		widget.NewLabel("Current access setup:"),
 	}, pCBs...)
 
+	cCBs := make([]fyne.CanvasObject, len(node.EventCapabilities))
+	for i, capability := range node.EventCapabilities {
+		temp := capability
+		check := widget.NewCheck(getCapabilityLabel(capability), func(b bool) {
+			result.Capabilities[temp] = b
+		})
+		check.Checked = c.Rights.HasCapability(temp)
+		result.Capabilities[temp] = check.Checked
+		cCBs[i] = check
+	}
+
+	cObjs := append([]fyne.CanvasObject{
+		widget.NewLabel("Allowed events:"),
+	}, cCBs...)
+
 	okButton := widget.NewButton("Ok", func() {
 		myapp.Quit()
 	})
@@ -83,6 +120,7 @@ func (a GUIAllower) Allow(c *node.ConnectionInfo) (node.AllowResult, error) {
 	objects := append([]fyne.CanvasObject{
 		widget.NewLabel(getConnectionLabel(c.Protocol, c.Rights.Name(), c.Rights.Id())),
 		widget.NewHBox(hObjs...),
+		widget.NewHBox(cObjs...),
 		widget.NewCheck("Remember this result for future connections?", func(b bool) {
 			result.Remember = b
 		}),
@@ -98,3 +136,21 @@ func (a GUIAllower) Allow(c *node.ConnectionInfo) (node.AllowResult, error) {
 
 	return result, nil
 }
+
+// Notify shows the message to the host user until it is closed
+func (a *GUIAllower) Notify(title, message string) {
+	a.Lock()
+	defer a.Unlock()
+
+	myapp := app.New()
+	w := myapp.NewWindow(title)
+	w.SetContent(widget.NewVBox(
+		widget.NewLabel(message),
+		widget.NewButton("Ok", func() {
+			myapp.Quit()
+		}),
+	))
+	w.CenterOnScreen()
+
+	w.ShowAndRun()
+}
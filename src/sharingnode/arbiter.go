@@ -0,0 +1,266 @@
+package sharingnode
+
+import (
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/pkg/errors"
+	"sync"
+)
+
+// ControlState tells the viewer who holds the input token
+type ControlState struct {
+	// Holder is the peer which controls the screen, it is empty when nobody does
+	Holder string `json:"holder"`
+	// You tells that the viewer holds the token
+	You bool `json:"you"`
+	// Requested tells that the viewer waits for the host to grant the token
+	Requested bool `json:"requested"`
+	// Paused tells that the host user is active, so input of the holder isn't injected
+	Paused bool `json:"paused,omitempty"`
+	// Dropped is the chord of the viewer which the host blocked
+	Dropped string `json:"dropped,omitempty"`
+}
+
+// ControlArbiter lets only one of the connected viewers inject input. The first viewer gets
+// the token, others request it and the host grants it. The token belongs to the peer,
+// so all sessions of the peer share it
+type ControlArbiter struct {
+	sync.Mutex
+	holder    peer.ID
+	viewers   map[uint64]*controlViewer
+	requests  map[peer.ID]bool
+	paused    bool
+	session   uint64
+	seq       uint64
+	OnRequest func(id peer.ID)
+	OnChange  func(holder peer.ID)
+}
+
+func NewControlArbiter() *ControlArbiter {
+	return &ControlArbiter{
+		viewers:  make(map[uint64]*controlViewer),
+		requests: make(map[peer.ID]bool),
+	}
+}
+
+// controlViewer is a session of the viewer. States are numbered under the lock of the arbiter,
+// so a state which is late to be sent doesn't replace a newer one
+type controlViewer struct {
+	sync.Mutex
+	id     peer.ID
+	notify func(*ControlState)
+	sent   uint64
+}
+
+func (v *controlViewer) send(seq uint64, state *ControlState) {
+	v.Lock()
+	defer v.Unlock()
+
+	if seq <= v.sent {
+		return
+	}
+	v.sent = seq
+	v.notify(state)
+}
+
+type controlNotice struct {
+	viewer *controlViewer
+	seq    uint64
+	state  *ControlState
+}
+
+// state returns the state of the viewer, the arbiter must be locked
+func (a *ControlArbiter) state(id peer.ID) *ControlState {
+	holder := ""
+	if a.holder != "" {
+		holder = a.holder.String()
+	}
+	return &ControlState{
+		Holder:    holder,
+		You:       id == a.holder,
+		Requested: a.requests[id],
+		Paused:    a.paused,
+	}
+}
+
+// connected tells whether the peer has a session, the arbiter must be locked
+func (a *ControlArbiter) connected(id peer.ID) bool {
+	for _, viewer := range a.viewers {
+		if viewer.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// notices collects states of all viewers, the arbiter must be locked
+func (a *ControlArbiter) notices() []controlNotice {
+	a.seq++
+	notices := make([]controlNotice, 0, len(a.viewers))
+	for _, viewer := range a.viewers {
+		notices = append(notices, controlNotice{viewer, a.seq, a.state(viewer.id)})
+	}
+	return notices
+}
+
+// changed notifies viewers outside of the lock, because notifications write to streams
+func (a *ControlArbiter) changed(notices []controlNotice, holderChanged bool, holder peer.ID) {
+	for _, n := range notices {
+		n.viewer.send(n.seq, n.state)
+	}
+	if holderChanged && a.OnChange != nil {
+		a.OnChange(holder)
+	}
+}
+
+// Join adds the session of the viewer, it receives the token when nobody holds it.
+// The returned session leaves the arbiter
+func (a *ControlArbiter) Join(id peer.ID, notify func(*ControlState)) uint64 {
+	a.Lock()
+	a.session++
+	session := a.session
+	a.viewers[session] = &controlViewer{id: id, notify: notify}
+	granted := a.holder == ""
+	if granted {
+		a.holder = id
+	}
+	notices := a.notices()
+	a.Unlock()
+
+	a.changed(notices, granted, id)
+	return session
+}
+
+// Leave removes the session, the token is released when the last session of the viewer leaves
+func (a *ControlArbiter) Leave(session uint64) {
+	a.Lock()
+	viewer, ok := a.viewers[session]
+	if !ok {
+		a.Unlock()
+		return
+	}
+	delete(a.viewers, session)
+	released := false
+	if !a.connected(viewer.id) {
+		delete(a.requests, viewer.id)
+		released = a.holder == viewer.id
+		if released {
+			a.holder = ""
+		}
+	}
+	notices := a.notices()
+	a.Unlock()
+
+	a.changed(notices, released, "")
+}
+
+// Request asks for the token, it is granted at once when nobody holds it
+func (a *ControlArbiter) Request(id peer.ID) {
+	a.Lock()
+	if !a.connected(id) || a.holder == id {
+		a.Unlock()
+		return
+	}
+	granted := a.holder == ""
+	if granted {
+		a.holder = id
+	} else {
+		a.requests[id] = true
+	}
+	notices := a.notices()
+	a.Unlock()
+
+	a.changed(notices, granted, id)
+	if !granted && a.OnRequest != nil {
+		a.OnRequest(id)
+	}
+}
+
+// Release gives the token back, when the viewer holds it
+func (a *ControlArbiter) Release(id peer.ID) {
+	a.Lock()
+	delete(a.requests, id)
+	released := a.holder == id
+	if released {
+		a.holder = ""
+	}
+	notices := a.notices()
+	a.Unlock()
+
+	a.changed(notices, released, "")
+}
+
+// Grant passes the token to the connected viewer
+func (a *ControlArbiter) Grant(id peer.ID) error {
+	a.Lock()
+	if !a.connected(id) {
+		a.Unlock()
+		return errors.Errorf("Viewer %s is not connected", id)
+	}
+	delete(a.requests, id)
+	a.holder = id
+	notices := a.notices()
+	a.Unlock()
+
+	a.changed(notices, true, id)
+	return nil
+}
+
+// Revoke takes the token from its holder, nobody controls the screen until the next grant
+func (a *ControlArbiter) Revoke() {
+	a.Lock()
+	a.holder = ""
+	notices := a.notices()
+	a.Unlock()
+
+	a.changed(notices, true, "")
+}
+
+// SetPaused notifies viewers that remote input is paused or resumed
+func (a *ControlArbiter) SetPaused(paused bool) {
+	a.Lock()
+	if a.paused == paused {
+		a.Unlock()
+		return
+	}
+	a.paused = paused
+	notices := a.notices()
+	a.Unlock()
+
+	a.changed(notices, false, "")
+}
+
+// Dropped tells the session about its chord which the host blocked, in order with other states
+func (a *ControlArbiter) Dropped(session uint64, chord string) {
+	a.Lock()
+	viewer, ok := a.viewers[session]
+	if !ok {
+		a.Unlock()
+		return
+	}
+	a.seq++
+	seq := a.seq
+	state := a.state(viewer.id)
+	state.Dropped = chord
+	a.Unlock()
+
+	viewer.send(seq, state)
+}
+
+// Allowed tells whether input of the viewer can be injected
+func (a *ControlArbiter) Allowed(id peer.ID) bool {
+	a.Lock()
+	defer a.Unlock()
+	return a.holder == id
+}
+
+// Holder returns the peer which holds the token and the peers which request it
+func (a *ControlArbiter) Holder() (peer.ID, []peer.ID) {
+	a.Lock()
+	defer a.Unlock()
+
+	requests := make([]peer.ID, 0, len(a.requests))
+	for id := range a.requests {
+		requests = append(requests, id)
+	}
+	return a.holder, requests
+}
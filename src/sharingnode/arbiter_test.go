@@ -0,0 +1,124 @@
+package sharingnode
+
+import (
+	"github.com/libp2p/go-libp2p-core/peer"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// stateRecorder keeps the last state sent to the session
+type stateRecorder struct {
+	sync.Mutex
+	last *ControlState
+}
+
+func (r *stateRecorder) notify(state *ControlState) {
+	// Other changes run while the state is written
+	runtime.Gosched()
+	r.Lock()
+	defer r.Unlock()
+	r.last = state
+}
+
+func (r *stateRecorder) state() ControlState {
+	r.Lock()
+	defer r.Unlock()
+	if r.last == nil {
+		return ControlState{}
+	}
+	return *r.last
+}
+
+func TestArbiterOrder(t *testing.T) {
+	viewers := []peer.ID{"first", "second"}
+	arbiter := NewControlArbiter()
+	recorders := make([]*stateRecorder, len(viewers))
+	for i, id := range viewers {
+		recorders[i] = &stateRecorder{}
+		arbiter.Join(id, recorders[i].notify)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			switch i % 4 {
+			case 0:
+				arbiter.Revoke()
+			case 1:
+				arbiter.SetPaused(i%8 == 1)
+			default:
+				err := arbiter.Grant(viewers[i%2])
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Late states are dropped, so every viewer shows the final state
+	for i, id := range viewers {
+		arbiter.Lock()
+		want := *arbiter.state(id)
+		arbiter.Unlock()
+		if got := recorders[i].state(); got != want {
+			t.Errorf("%s shows %+v, want %+v", id, got, want)
+		}
+	}
+}
+
+func TestArbiterSessions(t *testing.T) {
+	const viewer = peer.ID("viewer")
+
+	arbiter := NewControlArbiter()
+	first, second := &stateRecorder{}, &stateRecorder{}
+	firstSession := arbiter.Join(viewer, first.notify)
+	secondSession := arbiter.Join(viewer, second.notify)
+	if firstSession == secondSession {
+		t.Fatal("sessions of the same viewer are equal")
+	}
+
+	arbiter.Revoke()
+	for name, recorder := range map[string]*stateRecorder{"first": first, "second": second} {
+		if recorder.state().You {
+			t.Errorf("the %s session holds the revoked token", name)
+		}
+	}
+
+	err := arbiter.Grant(viewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arbiter.Leave(secondSession)
+	if !arbiter.Allowed(viewer) {
+		t.Error("the token is released while a session is connected")
+	}
+	if !first.state().You {
+		t.Error("the first session doesn't hold the token")
+	}
+
+	arbiter.Leave(firstSession)
+	if holder, _ := arbiter.Holder(); holder != "" {
+		t.Errorf("%s holds the token after all sessions left", holder)
+	}
+	err = arbiter.Grant(viewer)
+	if err == nil {
+		t.Error("the token is granted to the disconnected viewer")
+	}
+}
+
+func TestArbiterDropped(t *testing.T) {
+	arbiter := NewControlArbiter()
+	recorder := &stateRecorder{}
+	session := arbiter.Join("viewer", recorder.notify)
+
+	arbiter.Dropped(session, "super+l")
+	if got := recorder.state(); got.Dropped != "super+l" || !got.You {
+		t.Errorf("got %+v", got)
+	}
+	arbiter.Leave(session)
+	arbiter.Dropped(session, "super+l")
+}
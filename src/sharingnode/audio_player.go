@@ -0,0 +1,339 @@
+package sharingnode
+
+// #include <stdlib.h>
+import "C"
+import (
+	"context"
+	"github.com/imkira/go-libav/avcodec"
+	"github.com/imkira/go-libav/avformat"
+	"github.com/imkira/go-libav/avutil"
+	"github.com/pkg/errors"
+	"github.com/xgreenx/desktop-sharing/src/config"
+	"io"
+	"sync"
+	"time"
+)
+
+const defaultAudioLatency = 100 * time.Millisecond
+
+// AudioOutput plays interleaved signed 16-bit samples through libav output formats: pulse, alsa or any muxer
+type AudioOutput struct {
+	sync.Mutex
+	AudioInfo
+	formatContext *avformat.Context
+	ioContext     *avformat.IOContext
+	stream        *avformat.Stream
+	packet        *avcodec.Packet
+	pts           int64
+}
+
+func NewAudioOutput(format, device string, info *AudioInfo) (*AudioOutput, error) {
+	output := &AudioOutput{
+		AudioInfo: *info,
+	}
+
+	var err error
+	var layout avutil.ChannelLayout
+	var codecContext *avcodec.Context
+	pcm := avcodec.FindDecoderByName("pcm_s16le")
+	outputFormat := avformat.GuessOutputFromShortName(format)
+	if outputFormat == nil {
+		err = errors.Errorf("Audio output format %s not found", format)
+		goto Error
+	}
+
+	output.formatContext, err = avformat.NewContextForOutput(outputFormat)
+	if err != nil {
+		goto Error
+	}
+	output.formatContext.SetFileName(device)
+
+	if outputFormat.Flags()&avformat.FlagNoFile == 0 {
+		output.ioContext, err = avformat.OpenIOContext(device, avformat.IOFlagWrite, nil, nil)
+		if err != nil {
+			goto Error
+		}
+		output.formatContext.SetIOContext(output.ioContext)
+	}
+
+	output.stream, err = output.formatContext.NewStream()
+	if err != nil {
+		goto Error
+	}
+
+	layout, _ = avutil.FindDefaultChannelLayout(info.Channels)
+	codecContext = output.stream.CodecContext()
+	codecContext.SetCodecType(avutil.MediaTypeAudio)
+	codecContext.SetCodecID(pcm.ID())
+	codecContext.SetSampleRate(info.SampleRate)
+	codecContext.SetChannels(info.Channels)
+	codecContext.SetChannelLayout(layout)
+	codecContext.SetSampleFormat(avutil.SampleFormatS16)
+	output.stream.SetTimeBase(avutil.NewRational(1, info.SampleRate))
+
+	err = output.formatContext.WriteHeader(nil)
+	if err != nil {
+		goto Error
+	}
+
+	output.packet, err = avcodec.NewPacket()
+	if err != nil {
+		goto Error
+	}
+
+	return output, nil
+
+Error:
+	output.Close()
+	return nil, err
+}
+
+func (o *AudioOutput) Write(pcm []byte) error {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.formatContext == nil {
+		return errors.New("Audio output already closed")
+	}
+
+	o.packet.SetData(pcm)
+	defer C.free(o.packet.Data())
+	o.packet.SetSize(len(pcm))
+	o.packet.SetStreamIndex(o.stream.Index())
+	o.packet.SetPTS(o.pts)
+	o.packet.SetDTS(o.pts)
+	o.packet.RescaleTime(avutil.NewRational(1, o.SampleRate), o.stream.TimeBase())
+	o.pts += int64(len(pcm) / (2 * o.Channels))
+
+	return o.formatContext.InterleavedWriteFrame(o.packet)
+}
+
+func (o *AudioOutput) Close() {
+	o.Lock()
+	defer o.Unlock()
+	if o.formatContext != nil {
+		if o.packet != nil {
+			err := o.formatContext.WriteTrailer()
+			if err != nil {
+				logger.Warning(err)
+			}
+		}
+		o.formatContext.Free()
+		o.formatContext = nil
+	}
+	if o.ioContext != nil {
+		err := o.ioContext.Close()
+		if err != nil {
+			logger.Warning(err)
+		}
+		o.ioContext = nil
+	}
+	if o.packet != nil {
+		o.packet.Free()
+		o.packet = nil
+	}
+}
+
+type AudioPlayer struct {
+	sync.Mutex
+	AudioInfo
+	muted        bool
+	clock        *MediaClock
+	codecContext *avcodec.Context
+	packet       *avcodec.Packet
+	frame        *avutil.Frame
+	output       *AudioOutput
+}
+
+// AudioLatency parses the latency of the audio options, it buffers audio against the jitter of the network
+func AudioLatency(options map[string]string) time.Duration {
+	if latency, err := time.ParseDuration(options["latency"]); err == nil {
+		return latency
+	}
+	return defaultAudioLatency
+}
+
+// NewAudioPlayer plays audio with the clock, video which shares the clock plays in sync with it.
+// The player has its own clock when the clock is nil
+func NewAudioPlayer(info *AudioInfo, options map[string]string, clock *MediaClock) (*AudioPlayer, error) {
+	if clock == nil {
+		clock = NewMediaClock(AudioLatency(options))
+	}
+	player := &AudioPlayer{
+		AudioInfo: *info,
+		clock:     clock,
+	}
+
+	var err error
+	var layout avutil.ChannelLayout
+	codec := findCodec([]string{"libopus", "opus"}, avcodec.FindDecoderByName)
+	if codec == nil {
+		err = errors.New("Opus decoder not found")
+		goto Error
+	}
+
+	player.codecContext, err = avcodec.NewContextWithCodec(codec)
+	if err != nil {
+		goto Error
+	}
+
+	layout, _ = avutil.FindDefaultChannelLayout(info.Channels)
+	player.codecContext.SetSampleRate(info.SampleRate)
+	player.codecContext.SetChannels(info.Channels)
+	player.codecContext.SetChannelLayout(layout)
+	player.codecContext.SetRequestSampleFormat(avutil.SampleFormatS16)
+
+	err = player.codecContext.OpenWithCodec(codec, nil)
+	if err != nil {
+		goto Error
+	}
+
+	player.packet, err = avcodec.NewPacket()
+	if err != nil {
+		goto Error
+	}
+
+	player.frame, err = avutil.NewFrame()
+	if err != nil {
+		goto Error
+	}
+
+	player.output, err = NewAudioOutput(options["output"], options["output_device"], info)
+	if err != nil {
+		goto Error
+	}
+
+	return player, nil
+
+Error:
+	player.Close()
+	return nil, err
+}
+
+func (p *AudioPlayer) SetMuted(muted bool) {
+	p.Lock()
+	defer p.Unlock()
+	p.muted = muted
+}
+
+func (p *AudioPlayer) Muted() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.muted
+}
+
+func (p *AudioPlayer) decode(data []byte) ([]byte, error) {
+	p.packet.SetData(data)
+	defer C.free(p.packet.Data())
+	p.packet.SetSize(len(data))
+
+	_, err := p.codecContext.SendPacket(p.packet)
+	if err != nil {
+		return nil, err
+	}
+
+	var pcm []byte
+	for {
+		code, err := p.codecContext.ReceiveFrame(p.frame)
+		if code == avutil.AVERROR_EAGAIN || code == avutil.AVERROR_EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		samples, err := samplesToS16(p.frame)
+		p.frame.Unref()
+		if err != nil {
+			return nil, err
+		}
+		pcm = append(pcm, samples...)
+	}
+
+	return pcm, nil
+}
+
+// Play decodes audio packets from the reader and plays them in sync with their timestamps
+func (p *AudioPlayer) Play(ctx context.Context, reader *DataReader) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		packet, err := reader.GetPacket()
+		if err != nil {
+			return err
+		}
+
+		pts, data := packet.PTS, packet.Data
+		// The legacy format puts the pts before the data
+		if packet.Type != PacketAudio {
+			pts, data, err = unpackAudio(packet.Data)
+			if err != nil {
+				return err
+			}
+		}
+
+		p.clock.Wait(pts)
+		if p.Muted() {
+			continue
+		}
+
+		pcm, err := p.decode(data)
+		if err != nil {
+			logger.Warning(err)
+			continue
+		}
+
+		err = p.output.Write(pcm)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (p *AudioPlayer) Close() {
+	p.Lock()
+	defer p.Unlock()
+	if p.output != nil {
+		p.output.Close()
+		p.output = nil
+	}
+	if p.codecContext != nil {
+		p.codecContext.Free()
+		p.codecContext = nil
+	}
+	if p.packet != nil {
+		p.packet.Free()
+		p.packet = nil
+	}
+	if p.frame != nil {
+		p.frame.Free()
+		p.frame = nil
+	}
+}
+
+// NewRemoteAudio requests audio from the host and prepares a player for it. Packets of the stream
+// are read in the format of AudioInfo
+func NewRemoteAudio(stream io.ReadWriter, options config.SharingOptions, clock *MediaClock) (*AudioPlayer, error) {
+	err := write(stream, &AudioOptions{
+		Options: options.StreamOptions,
+		Format:  DataFormat{Version: FramedFormat},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	info := &AudioInfo{}
+	err = read(stream, info)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Codec != AudioCodec {
+		return nil, errors.Errorf("Unsupported audio codec %s", info.Codec)
+	}
+
+	return NewAudioPlayer(info, options.AudioOptions, clock)
+}
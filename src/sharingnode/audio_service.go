@@ -0,0 +1,588 @@
+package sharingnode
+
+// #cgo pkg-config: libavutil
+// #include <stdlib.h>
+// #include <string.h>
+// #include <libavutil/frame.h>
+// #include <libavutil/channel_layout.h>
+//
+// static void set_audio_frame(AVFrame *frame, int format, int rate, int channels, int samples) {
+//     frame->format = format;
+//     frame->sample_rate = rate;
+//     frame->channels = channels;
+//     frame->channel_layout = av_get_default_channel_layout(channels);
+//     frame->nb_samples = samples;
+// }
+import "C"
+import (
+	"encoding/binary"
+	"github.com/imkira/go-libav/avcodec"
+	"github.com/imkira/go-libav/avformat"
+	"github.com/imkira/go-libav/avutil"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+const AudioCodec = "opus"
+
+const audioPtsSize = 8
+
+var opusSampleRates = []int{48000, 24000, 16000, 12000, 8000}
+
+type AudioOptions struct {
+	Options map[string]string `json:"options"`
+	// Format is the data format requested by the viewer, old viewers read only the legacy one
+	Format DataFormat `json:"format"`
+}
+
+type AudioInfo struct {
+	Codec      string `json:"codec"`
+	SampleRate int    `json:"sample_rate"`
+	Channels   int    `json:"channels"`
+	// Format is the data format of the audio stream, old hosts send only the legacy one
+	Format DataFormat `json:"format"`
+}
+
+// NewAudioInfo chooses audio parameters closest to the requested ones which can be encoded with Opus
+func NewAudioInfo(options map[string]string) *AudioInfo {
+	info := &AudioInfo{
+		Codec:      AudioCodec,
+		SampleRate: opusSampleRates[0],
+		Channels:   2,
+	}
+
+	if ar, err := strconv.Atoi(options["ar"]); err == nil {
+		best := info.SampleRate
+		for _, rate := range opusSampleRates {
+			if math.Abs(float64(rate-ar)) < math.Abs(float64(best-ar)) {
+				best = rate
+			}
+		}
+		if best != ar {
+			logger.Warningf("Sample rate %d is not supported by Opus, using %d", ar, best)
+		}
+		info.SampleRate = best
+	}
+
+	if ac, err := strconv.Atoi(options["ac"]); err == nil && ac >= 1 && ac <= 2 {
+		info.Channels = ac
+	}
+
+	return info
+}
+
+func packAudio(pts int64, data []byte) []byte {
+	b := make([]byte, audioPtsSize+len(data))
+	binary.LittleEndian.PutUint64(b[:audioPtsSize], uint64(pts))
+	copy(b[audioPtsSize:], data)
+	return b
+}
+
+func unpackAudio(b []byte) (int64, []byte, error) {
+	if len(b) < audioPtsSize {
+		return 0, nil, errors.New("Audio packet is too short")
+	}
+
+	return int64(binary.LittleEndian.Uint64(b[:audioPtsSize])), b[audioPtsSize:], nil
+}
+
+// samplesToS16 converts decoded audio frame into interleaved signed 16-bit samples
+func samplesToS16(frame *avutil.Frame) ([]byte, error) {
+	cFrame := (*C.AVFrame)(unsafe.Pointer(frame.CAVFrame))
+	samples := int(cFrame.nb_samples)
+	channels := int(cFrame.channels)
+	format := avutil.SampleFormat(cFrame.format)
+	out := make([]byte, samples*channels*2)
+
+	switch format {
+	case avutil.SampleFormatS16:
+		copy(out, C.GoBytes(frame.Data(0), C.int(len(out))))
+	case avutil.SampleFormatS16P:
+		for c := 0; c < channels; c++ {
+			plane := C.GoBytes(frame.Data(c), C.int(samples*2))
+			for i := 0; i < samples; i++ {
+				copy(out[(i*channels+c)*2:], plane[i*2:i*2+2])
+			}
+		}
+	case avutil.SampleFormatFLT, avutil.SampleFormatFLTP:
+		planar := format == avutil.SampleFormatFLTP
+		var planes [][]byte
+		if planar {
+			for c := 0; c < channels; c++ {
+				planes = append(planes, C.GoBytes(frame.Data(c), C.int(samples*4)))
+			}
+		} else {
+			planes = append(planes, C.GoBytes(frame.Data(0), C.int(samples*channels*4)))
+		}
+
+		for i := 0; i < samples; i++ {
+			for c := 0; c < channels; c++ {
+				var bits uint32
+				if planar {
+					bits = binary.LittleEndian.Uint32(planes[c][i*4:])
+				} else {
+					bits = binary.LittleEndian.Uint32(planes[0][(i*channels+c)*4:])
+				}
+				v := math.Float32frombits(bits)
+				v = float32(math.Max(-1, math.Min(1, float64(v))))
+				binary.LittleEndian.PutUint16(out[(i*channels+c)*2:], uint16(int16(v*math.MaxInt16)))
+			}
+		}
+	default:
+		return nil, errors.Errorf("Unsupported sample format %s", format.Name())
+	}
+
+	return out, nil
+}
+
+type AudioSource interface {
+	// Read returns interleaved signed 16-bit samples
+	Read() ([]byte, error)
+	Close()
+}
+
+func NewAudioSource(options map[string]string, info *AudioInfo) (AudioSource, error) {
+	switch options["format"] {
+	case "null":
+		return NewNullAudioSource(info), nil
+	case "":
+		return nil, errors.New("Audio source format is not specified")
+	default:
+		return NewLibavAudioSource(options["format"], options["device"], info)
+	}
+}
+
+// NullAudioSource produces silence in real time
+type NullAudioSource struct {
+	size   int
+	period time.Duration
+	next   time.Time
+}
+
+func NewNullAudioSource(info *AudioInfo) *NullAudioSource {
+	period := 20 * time.Millisecond
+	samples := info.SampleRate * int(period/time.Millisecond) / 1000
+	return &NullAudioSource{
+		size:   samples * info.Channels * 2,
+		period: period,
+		next:   time.Now(),
+	}
+}
+
+func (s *NullAudioSource) Read() ([]byte, error) {
+	s.next = s.next.Add(s.period)
+	time.Sleep(time.Until(s.next))
+	return make([]byte, s.size), nil
+}
+
+func (s *NullAudioSource) Close() {
+}
+
+// LibavAudioSource captures audio through libav input formats: pulse, alsa or a file when format is "file"
+type LibavAudioSource struct {
+	sync.Mutex
+	AudioInfo
+	realtime        bool
+	started         time.Time
+	samples         int64
+	streamIndex     int
+	avFormatContext *avformat.Context
+	avCodecContext  *avcodec.Context
+	packet          *avcodec.Packet
+	frame           *avutil.Frame
+	options         *avutil.Dictionary
+}
+
+func NewLibavAudioSource(format, device string, info *AudioInfo) (*LibavAudioSource, error) {
+	source := &LibavAudioSource{
+		AudioInfo:   *info,
+		streamIndex: -1,
+		options:     avutil.NewDictionary(),
+	}
+
+	var err error
+	var input *avformat.Input
+	source.avFormatContext, err = avformat.NewContextForInput()
+	if err != nil {
+		goto Error
+	}
+
+	if format != "file" {
+		input = avformat.FindInputByShortName(format)
+		if input == nil {
+			err = errors.Errorf("Audio input format %s not found", format)
+			goto Error
+		}
+		source.realtime = true
+
+		err = source.options.Set("sample_rate", strconv.Itoa(info.SampleRate))
+		if err != nil {
+			goto Error
+		}
+		err = source.options.Set("channels", strconv.Itoa(info.Channels))
+		if err != nil {
+			goto Error
+		}
+	}
+
+	err = source.avFormatContext.OpenInput(device, input, source.options)
+	if err != nil {
+		goto Error
+	}
+
+	err = source.avFormatContext.FindStreamInfo(nil)
+	if err != nil {
+		goto Error
+	}
+
+	for _, s := range source.avFormatContext.Streams() {
+		if s.CodecContext().CodecType() == avutil.MediaTypeAudio {
+			source.streamIndex = s.Index()
+			source.avCodecContext = s.CodecContext()
+			break
+		}
+	}
+
+	if source.avCodecContext == nil {
+		err = errors.New("Audio stream not found")
+		goto Error
+	}
+
+	if source.avCodecContext.SampleRate() != info.SampleRate || source.avCodecContext.Channels() != info.Channels {
+		err = errors.Errorf("Audio source provides %d Hz with %d channels, expected %d Hz with %d channels",
+			source.avCodecContext.SampleRate(), source.avCodecContext.Channels(), info.SampleRate, info.Channels)
+		goto Error
+	}
+
+	err = source.avCodecContext.OpenWithCodec(avcodec.FindDecoderByID(source.avCodecContext.CodecID()), nil)
+	if err != nil {
+		goto Error
+	}
+
+	source.packet, err = avcodec.NewPacket()
+	if err != nil {
+		goto Error
+	}
+
+	source.frame, err = avutil.NewFrame()
+	if err != nil {
+		goto Error
+	}
+
+	source.started = time.Now()
+
+	return source, nil
+
+Error:
+	source.Close()
+	return nil, err
+}
+
+func (s *LibavAudioSource) Read() ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.avFormatContext == nil {
+		return nil, errors.New("Audio source already closed")
+	}
+
+	for {
+		done, err := s.avFormatContext.ReadFrame(s.packet)
+		if err != nil {
+			return nil, err
+		}
+		if !done {
+			return nil, io.EOF
+		}
+
+		if s.packet.StreamIndex() != s.streamIndex {
+			s.packet.Unref()
+			continue
+		}
+
+		_, err = s.avCodecContext.SendPacket(s.packet)
+		s.packet.Unref()
+		if err != nil {
+			return nil, err
+		}
+
+		var pcm []byte
+		for {
+			code, err := s.avCodecContext.ReceiveFrame(s.frame)
+			if code == avutil.AVERROR_EAGAIN || code == avutil.AVERROR_EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+
+			data, err := samplesToS16(s.frame)
+			s.frame.Unref()
+			if err != nil {
+				return nil, err
+			}
+			pcm = append(pcm, data...)
+		}
+
+		if len(pcm) == 0 {
+			continue
+		}
+
+		// Files are read faster than real time, so hold them back to the capture pace
+		if !s.realtime {
+			s.samples += int64(len(pcm) / (2 * s.Channels))
+			due := s.started.Add(time.Duration(s.samples) * time.Second / time.Duration(s.SampleRate))
+			time.Sleep(time.Until(due))
+		}
+
+		return pcm, nil
+	}
+}
+
+func (s *LibavAudioSource) Close() {
+	s.Lock()
+	defer s.Unlock()
+	if s.options != nil {
+		s.options.Free()
+		s.options = nil
+	}
+	if s.avCodecContext != nil {
+		s.avCodecContext.Close()
+		s.avCodecContext = nil
+	}
+	if s.avFormatContext != nil {
+		s.avFormatContext.CloseInput()
+		s.avFormatContext.Free()
+		s.avFormatContext = nil
+	}
+	if s.packet != nil {
+		s.packet.Free()
+		s.packet = nil
+	}
+	if s.frame != nil {
+		s.frame.Free()
+		s.frame = nil
+	}
+}
+
+type AudioEncoder struct {
+	sync.Mutex
+	AudioInfo
+	codecContext *avcodec.Context
+	codecOption  *avutil.Dictionary
+	packet       *avcodec.Packet
+	frame        *avutil.Frame
+	frameSize    int
+	buffer       []byte
+	pts          int64
+}
+
+func NewAudioEncoder(info *AudioInfo, options map[string]string) (*AudioEncoder, error) {
+	encoder := &AudioEncoder{
+		AudioInfo:   *info,
+		codecOption: avutil.NewDictionary(),
+	}
+
+	var err error
+	var layout avutil.ChannelLayout
+	codec := avcodec.FindEncoderByName("libopus")
+	if codec == nil {
+		err = errors.New("Opus encoder not found")
+		goto Error
+	}
+
+	encoder.codecContext, err = avcodec.NewContextWithCodec(codec)
+	if err != nil {
+		goto Error
+	}
+
+	layout, _ = avutil.FindDefaultChannelLayout(info.Channels)
+	encoder.codecContext.SetSampleRate(info.SampleRate)
+	encoder.codecContext.SetChannels(info.Channels)
+	encoder.codecContext.SetChannelLayout(layout)
+	encoder.codecContext.SetSampleFormat(avutil.SampleFormatS16)
+	encoder.codecContext.SetTimeBase(avutil.NewRational(1, info.SampleRate))
+
+	if bitrate, err := strconv.Atoi(options["bitrate"]); err == nil {
+		encoder.codecContext.SetBitRate(int64(bitrate))
+	}
+
+	err = encoder.codecOption.Set("application", "lowdelay")
+	if err != nil {
+		goto Error
+	}
+
+	err = encoder.codecContext.OpenWithCodec(codec, encoder.codecOption)
+	if err != nil {
+		goto Error
+	}
+
+	encoder.frameSize = encoder.codecContext.FrameSize()
+	if encoder.frameSize == 0 {
+		encoder.frameSize = info.SampleRate / 50
+	}
+
+	encoder.packet, err = avcodec.NewPacket()
+	if err != nil {
+		goto Error
+	}
+
+	encoder.frame, err = avutil.NewFrame()
+	if err != nil {
+		goto Error
+	}
+
+	C.set_audio_frame((*C.AVFrame)(unsafe.Pointer(encoder.frame.CAVFrame)), C.int(avutil.SampleFormatS16),
+		C.int(info.SampleRate), C.int(info.Channels), C.int(encoder.frameSize))
+	err = encoder.frame.GetBuffer()
+	if err != nil {
+		goto Error
+	}
+
+	return encoder, nil
+
+Error:
+	encoder.Close()
+	return nil, err
+}
+
+// Encode buffers samples and calls onPacket with pts in microseconds for every encoded packet
+func (e *AudioEncoder) Encode(pcm []byte, onPacket func(int64, []byte) error) error {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.codecContext == nil {
+		return errors.New("Audio encoder already closed")
+	}
+
+	e.buffer = append(e.buffer, pcm...)
+	frameBytes := e.frameSize * e.Channels * 2
+	for len(e.buffer) >= frameBytes {
+		err := e.frame.MakeWritable()
+		if err != nil {
+			return err
+		}
+
+		C.memcpy(e.frame.Data(0), unsafe.Pointer(&e.buffer[0]), C.size_t(frameBytes))
+		e.buffer = e.buffer[frameBytes:]
+		e.frame.SetPTS(e.pts)
+		e.pts += int64(e.frameSize)
+
+		_, err = e.codecContext.SendFrame(e.frame)
+		if err != nil {
+			return err
+		}
+
+		for {
+			code, err := e.codecContext.ReceivePacket(e.packet)
+			if code == avutil.AVERROR_EAGAIN || code == avutil.AVERROR_EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+
+			data := C.GoBytes(e.packet.Data(), C.int(e.packet.Size()))
+			pts := avutil.Rescale(e.packet.PTS(), int64(time.Second/time.Microsecond), int64(e.SampleRate))
+			e.packet.Unref()
+
+			err = onPacket(pts, data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (e *AudioEncoder) Close() {
+	e.Lock()
+	defer e.Unlock()
+	if e.codecOption != nil {
+		e.codecOption.Free()
+		e.codecOption = nil
+	}
+	if e.codecContext != nil {
+		e.codecContext.Free()
+		e.codecContext = nil
+	}
+	if e.packet != nil {
+		e.packet.Free()
+		e.packet = nil
+	}
+	if e.frame != nil {
+		e.frame.Free()
+		e.frame = nil
+	}
+}
+
+// ServeAudio captures host audio and streams it to the viewer until the stream fails. Packets
+// carry the host time, so the viewer plays them in sync with video of the same host
+func ServeAudio(stream io.ReadWriter, options map[string]string) error {
+	request := &AudioOptions{}
+	err := read(stream, request)
+	if err != nil {
+		return err
+	}
+
+	info := NewAudioInfo(request.Options)
+	if formatSupported(request.Format.Version) {
+		info.Format = request.Format
+	}
+	source, err := NewAudioSource(options, info)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	encoder, err := NewAudioEncoder(info, options)
+	if err != nil {
+		return err
+	}
+	defer encoder.Close()
+
+	err = write(stream, info)
+	if err != nil {
+		return err
+	}
+
+	writer := NewDataWriterFormat(stream, info.Format)
+	var started int64
+	for {
+		select {
+		case err := <-writer.Error:
+			return err
+		default:
+		}
+
+		pcm, err := source.Read()
+		if err != nil {
+			return err
+		}
+		// The first samples were captured before they were read
+		if started == 0 {
+			duration := time.Duration(len(pcm)/(2*info.Channels)) * time.Second / time.Duration(info.SampleRate)
+			started = hostTime(time.Now().Add(-duration))
+		}
+
+		err = encoder.Encode(pcm, func(pts int64, data []byte) error {
+			if info.Format.Version == LegacyFormat {
+				writer.AddData(packAudio(started+pts, data))
+				return nil
+			}
+			writer.AddPacket(&Packet{
+				Type: PacketAudio,
+				PTS:  started + pts,
+				Data: data,
+			})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package sharingnode
+
+import (
+	"github.com/imkira/go-libav/avcodec"
+	"github.com/xgreenx/desktop-sharing/src/config"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestServeAudio streams silence of the null source and plays it into the null output
+func TestServeAudio(t *testing.T) {
+	if avcodec.FindEncoderByName("libopus") == nil {
+		t.Skip("libopus is not available")
+	}
+
+	host, viewer := net.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeAudio(host, map[string]string{"format": "null"})
+	}()
+	defer func() {
+		viewer.Close()
+		host.Close()
+		<-served
+	}()
+
+	options := config.SharingOptions{
+		AudioOptions: map[string]string{"output": "null", "output_device": "-"},
+	}
+	started := hostTime(time.Now())
+	player, err := NewRemoteAudio(viewer, options, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer player.Close()
+
+	if player.Format.Version != FramedFormat {
+		t.Fatalf("got format %d, want %d", player.Format.Version, FramedFormat)
+	}
+
+	reader := NewDataReaderFormat(viewer, player.Format, &DefaultReaderLimits)
+	var last int64
+	for i := 0; i < 5; i++ {
+		packet, err := reader.GetPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packet.Type != PacketAudio {
+			t.Fatalf("packet %d has type %d", i, packet.Type)
+		}
+		// Audio carries the host time which video of the host shares
+		if packet.PTS < started-int64(time.Second/time.Microsecond) || packet.PTS > hostTime(time.Now()) {
+			t.Errorf("packet %d has pts %d out of the host time", i, packet.PTS)
+		}
+		if packet.PTS <= last {
+			t.Errorf("packet %d has pts %d after %d", i, packet.PTS, last)
+		}
+		last = packet.PTS
+
+		pcm, err := player.decode(packet.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range pcm {
+			if b != 0 {
+				t.Fatalf("packet %d isn't silent", i)
+			}
+		}
+		err = player.output.Write(pcm)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestServeAudioLegacy serves viewers which don't request a format with the pts in the data
+func TestServeAudioLegacy(t *testing.T) {
+	if avcodec.FindEncoderByName("libopus") == nil {
+		t.Skip("libopus is not available")
+	}
+
+	host, viewer := net.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeAudio(host, map[string]string{"format": "null"})
+	}()
+	defer func() {
+		viewer.Close()
+		host.Close()
+		<-served
+	}()
+
+	err := write(viewer, &AudioOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &AudioInfo{}
+	err = read(viewer, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Format.Version != LegacyFormat {
+		t.Fatalf("got format %d for an old viewer", info.Format.Version)
+	}
+
+	data, err := NewDataReader(viewer).GetData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pts, payload, err := unpackAudio(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pts <= 0 || len(payload) == 0 {
+		t.Errorf("got pts %d and %d bytes", pts, len(payload))
+	}
+}
@@ -0,0 +1,557 @@
+package sharingnode
+
+// #include <stdint.h>
+// #include <string.h>
+//
+// static void copy_plane(uint8_t *dst, int dst_linesize, const uint8_t *src, int src_linesize, int width, int height) {
+//     for (int y = 0; y < height; y++) {
+//         memcpy(dst + y * dst_linesize, src + y * src_linesize, width);
+//     }
+// }
+import "C"
+import (
+	"github.com/imkira/go-libav/avcodec"
+	"github.com/imkira/go-libav/avformat"
+	"github.com/imkira/go-libav/avutil"
+	"github.com/imkira/go-libav/swscale"
+	"github.com/kbinani/screenshot"
+	"github.com/pkg/errors"
+	"image"
+	"strconv"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+const defaultFrameRate = 10
+
+const (
+	BackendX11Grab     = "x11grab"
+	BackendXShm        = "xshm"
+	BackendTestPattern = "testsrc"
+	BackendFile        = "file"
+)
+
+// ImageProvider is a capture backend which yields YUV420P frames at the target frame rate
+type ImageProvider interface {
+	// Size returns the size of produced frames
+	Size() DisplayInfo
+	// Image waits for the next frame and passes it to onImage. The frame is valid only inside of the callback
+	Image(onImage func(*avutil.Frame) error) error
+	Close()
+}
+
+// NewImageProvider creates the backend requested by the viewer. The capture options are the host's own settings.
+// Frames of the provider have the output size requested by the viewer
+func NewImageProvider(options *ScreenOptions, capture map[string]string, rect image.Rectangle) (ImageProvider, error) {
+	output := OutputSize(options, DisplayInfo{rect.Dx(), rect.Dy()})
+	switch options.Backend {
+	case "", BackendX11Grab:
+		return NewX11GrabProvider(options, captureDisplay(capture), rect, output)
+	case BackendXShm:
+		return NewXShmProvider(options, rect, output)
+	case BackendTestPattern:
+		return NewTestPatternProvider(options, output.Width, output.Height)
+	case BackendFile:
+		if capture["file"] == "" {
+			return nil, errors.New("Host doesn't provide a video file")
+		}
+		return NewFileProvider(options, capture["file"], output.Width, output.Height)
+	}
+
+	return nil, errors.Errorf("Unknown capture backend %s", options.Backend)
+}
+
+// virtualDisplay is the size of sources without a display, viewers downscale it to their size
+var virtualDisplay = DisplayInfo{1280, 720}
+
+// displayBackend tells that the backend captures a display of the host
+func displayBackend(backend string) bool {
+	return backend == "" || backend == BackendX11Grab || backend == BackendXShm
+}
+
+// captureRect returns the native area of the capture, the test pattern and files don't need a display
+func captureRect(options *ScreenOptions) image.Rectangle {
+	if !displayBackend(options.Backend) {
+		return image.Rect(0, 0, virtualDisplay.Width, virtualDisplay.Height)
+	}
+	return screenshot.GetDisplayBounds(options.TargetDisplay)
+}
+
+// hostDisplays returns sizes of displays of the host. Hosts without displays offer the virtual one,
+// so viewers can request the test pattern or the file
+func hostDisplays() []DisplayInfo {
+	num := screenshot.NumActiveDisplays()
+	if num == 0 {
+		return []DisplayInfo{virtualDisplay}
+	}
+
+	displays := make([]DisplayInfo, num)
+	for i := 0; i < num; i++ {
+		bounds := screenshot.GetDisplayBounds(i)
+		displays[i] = DisplayInfo{
+			Width:  bounds.Dx(),
+			Height: bounds.Dy(),
+		}
+	}
+	return displays
+}
+
+// captureDisplay returns the X display of the host
+func captureDisplay(capture map[string]string) string {
+	if capture["display"] == "" {
+		return ":0.0"
+	}
+	return capture["display"]
+}
+
+func frameRate(options *ScreenOptions) int {
+	rate, err := strconv.Atoi(options.GrabbingOptions["r"])
+	if err != nil || rate <= 0 {
+		return defaultFrameRate
+	}
+	return rate
+}
+
+// frameClock paces capturing to the frame rate. Late frames don't accumulate
+type frameClock struct {
+	interval time.Duration
+	next     time.Time
+}
+
+func newFrameClock(rate int) *frameClock {
+	return &frameClock{
+		interval: time.Second / time.Duration(rate),
+	}
+}
+
+func (c *frameClock) Wait() {
+	now := time.Now()
+	if c.next.Before(now) {
+		c.next = now
+	}
+	time.Sleep(c.next.Sub(now))
+	c.next = c.next.Add(c.interval)
+}
+
+// copyPlane copies rows of the image plane into the frame plane with its own line size
+func copyPlane(frame *avutil.Frame, plane int, data []byte, stride, width, height int) {
+	C.copy_plane((*C.uint8_t)(frame.Data(plane)), C.int(frame.LineSize(plane)),
+		(*C.uint8_t)(unsafe.Pointer(&data[0])), C.int(stride), C.int(width), C.int(height))
+}
+
+// copyFromPlane copies rows of the frame plane into the image plane with its own stride
+func copyFromPlane(data []byte, stride int, frame *avutil.Frame, plane, width, height int) {
+	C.copy_plane((*C.uint8_t)(unsafe.Pointer(&data[0])), C.int(stride),
+		(*C.uint8_t)(frame.Data(plane)), C.int(frame.LineSize(plane)), C.int(width), C.int(height))
+}
+
+func newVideoFrame(width, height int, format avutil.PixelFormat) (*avutil.Frame, error) {
+	frame, err := avutil.NewFrame()
+	if err != nil {
+		return nil, err
+	}
+
+	frame.SetWidth(width)
+	frame.SetHeight(height)
+	frame.SetPixelFormat(format)
+	err = frame.GetBuffer()
+	if err != nil {
+		frame.Free()
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+// XShmProvider captures the display through shared memory of the X server
+type XShmProvider struct {
+	sync.Mutex
+	DisplayInfo
+	rect       image.Rectangle
+	clock      *frameClock
+	swsContext *swscale.Context
+	rgbaFrame  *avutil.Frame
+	encFrame   *avutil.Frame
+}
+
+func NewXShmProvider(options *ScreenOptions, rect image.Rectangle, output DisplayInfo) (*XShmProvider, error) {
+	provider := &XShmProvider{
+		DisplayInfo: output,
+		rect:        rect,
+		clock:       newFrameClock(frameRate(options)),
+	}
+
+	var err error
+	provider.swsContext, err = newScaleContext(
+		&swscale.DataDescription{rect.Dx(), rect.Dy(), avutil.PIX_FMT_RGBA},
+		&swscale.DataDescription{provider.Width, provider.Height, avutil.PIX_FMT_YUV420P},
+		options.Algorithm,
+	)
+	if err != nil {
+		goto Error
+	}
+
+	provider.rgbaFrame, err = newVideoFrame(rect.Dx(), rect.Dy(), avutil.PIX_FMT_RGBA)
+	if err != nil {
+		goto Error
+	}
+
+	provider.encFrame, err = newVideoFrame(provider.Width, provider.Height, avutil.PIX_FMT_YUV420P)
+	if err != nil {
+		goto Error
+	}
+
+	return provider, nil
+
+Error:
+	provider.Close()
+	return nil, err
+}
+
+func (p *XShmProvider) Size() DisplayInfo {
+	return p.DisplayInfo
+}
+
+func (p *XShmProvider) Image(onImage func(*avutil.Frame) error) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.encFrame == nil {
+		return errors.New("Image provider already closed")
+	}
+	p.clock.Wait()
+
+	img, err := screenshot.CaptureRect(p.rect)
+	if err != nil {
+		return err
+	}
+
+	copyPlane(p.rgbaFrame, 0, img.Pix, img.Stride, p.rect.Dx()*4, p.rect.Dy())
+	err = p.encFrame.MakeWritable()
+	if err != nil {
+		return err
+	}
+	p.swsContext.Scale(p.rgbaFrame, 0, p.rect.Dy(), p.encFrame)
+
+	return onImage(p.encFrame)
+}
+
+func (p *XShmProvider) Close() {
+	p.Lock()
+	defer p.Unlock()
+	if p.swsContext != nil {
+		p.swsContext.Free()
+		p.swsContext = nil
+	}
+	if p.rgbaFrame != nil {
+		p.rgbaFrame.Free()
+		p.rgbaFrame = nil
+	}
+	if p.encFrame != nil {
+		p.encFrame.Free()
+		p.encFrame = nil
+	}
+}
+
+// TestPatternProvider generates moving color bars, it doesn't need any display
+type TestPatternProvider struct {
+	sync.Mutex
+	DisplayInfo
+	clock    *frameClock
+	encFrame *avutil.Frame
+	image    *image.YCbCr
+	index    int
+}
+
+var testPatternColors = [][3]byte{
+	{235, 128, 128}, // white
+	{210, 16, 146},  // yellow
+	{170, 166, 16},  // cyan
+	{145, 54, 34},   // green
+	{106, 202, 222}, // magenta
+	{81, 90, 240},   // red
+	{41, 240, 110},  // blue
+	{16, 128, 128},  // black
+}
+
+func NewTestPatternProvider(options *ScreenOptions, width, height int) (*TestPatternProvider, error) {
+	if width <= 0 || height <= 0 {
+		return nil, errors.Errorf("Wrong test pattern size %dx%d", width, height)
+	}
+
+	encFrame, err := newVideoFrame(width, height, avutil.PIX_FMT_YUV420P)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TestPatternProvider{
+		DisplayInfo: DisplayInfo{
+			Width:  width,
+			Height: height,
+		},
+		clock:    newFrameClock(frameRate(options)),
+		encFrame: encFrame,
+		image:    image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420),
+	}, nil
+}
+
+func (p *TestPatternProvider) draw() {
+	img := p.image
+	barWidth := (p.Width + len(testPatternColors) - 1) / len(testPatternColors)
+	shift := p.index * 4
+	for y := 0; y < p.Height; y++ {
+		for x := 0; x < p.Width; x++ {
+			color := testPatternColors[((x+shift)/barWidth)%len(testPatternColors)]
+			img.Y[img.YOffset(x, y)] = color[0]
+			if x%2 == 0 && y%2 == 0 {
+				offset := img.COffset(x, y)
+				img.Cb[offset] = color[1]
+				img.Cr[offset] = color[2]
+			}
+		}
+	}
+
+	// Bouncing square shows motion in both directions
+	size := p.Height / 8
+	if size > p.Width {
+		size = p.Width
+	}
+	left := pingPong(p.index*8, p.Width-size)
+	top := pingPong(p.index*6, p.Height-size)
+	for y := top; y < top+size; y++ {
+		for x := left; x < left+size; x++ {
+			img.Y[img.YOffset(x, y)] = 128
+		}
+	}
+}
+
+func pingPong(value, limit int) int {
+	if limit <= 0 {
+		return 0
+	}
+	value %= 2 * limit
+	if value > limit {
+		return 2*limit - value
+	}
+	return value
+}
+
+func (p *TestPatternProvider) Size() DisplayInfo {
+	return p.DisplayInfo
+}
+
+func (p *TestPatternProvider) Image(onImage func(*avutil.Frame) error) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.encFrame == nil {
+		return errors.New("Image provider already closed")
+	}
+	p.clock.Wait()
+
+	p.draw()
+	p.index++
+
+	err := p.encFrame.MakeWritable()
+	if err != nil {
+		return err
+	}
+	copyPlane(p.encFrame, 0, p.image.Y, p.image.YStride, p.Width, p.Height)
+	copyPlane(p.encFrame, 1, p.image.Cb, p.image.CStride, (p.Width+1)/2, (p.Height+1)/2)
+	copyPlane(p.encFrame, 2, p.image.Cr, p.image.CStride, (p.Width+1)/2, (p.Height+1)/2)
+
+	return onImage(p.encFrame)
+}
+
+func (p *TestPatternProvider) Close() {
+	p.Lock()
+	defer p.Unlock()
+	if p.encFrame != nil {
+		p.encFrame.Free()
+		p.encFrame = nil
+	}
+}
+
+// FileProvider plays the video file in a loop, scaled to the display size
+type FileProvider struct {
+	sync.Mutex
+	DisplayInfo
+	path          string
+	algorithm     string
+	clock         *frameClock
+	formatContext *avformat.Context
+	codecContext  *avcodec.Context
+	streamIndex   int
+	swsContext    *swscale.Context
+	decPacket     *avcodec.Packet
+	encFrame      *avutil.Frame
+}
+
+func NewFileProvider(options *ScreenOptions, path string, width, height int) (*FileProvider, error) {
+	provider := &FileProvider{
+		DisplayInfo: DisplayInfo{
+			Width:  width,
+			Height: height,
+		},
+		path:      path,
+		algorithm: options.Algorithm,
+		clock:     newFrameClock(frameRate(options)),
+	}
+
+	var err error
+	provider.decPacket, err = avcodec.NewPacket()
+	if err != nil {
+		goto Error
+	}
+
+	provider.encFrame, err = newVideoFrame(width, height, avutil.PIX_FMT_YUV420P)
+	if err != nil {
+		goto Error
+	}
+
+	err = provider.open()
+	if err != nil {
+		goto Error
+	}
+
+	return provider, nil
+
+Error:
+	provider.Close()
+	return nil, err
+}
+
+func (p *FileProvider) open() error {
+	var err error
+	p.formatContext, err = avformat.NewContextForInput()
+	if err != nil {
+		return err
+	}
+
+	err = p.formatContext.OpenInput(p.path, nil, nil)
+	if err != nil {
+		p.formatContext.Free()
+		p.formatContext = nil
+		return err
+	}
+
+	err = p.formatContext.FindStreamInfo(nil)
+	if err != nil {
+		return err
+	}
+
+	p.codecContext = nil
+	for _, s := range p.formatContext.Streams() {
+		if s.CodecContext().CodecType() == avutil.MediaTypeVideo {
+			p.codecContext = s.CodecContext()
+			p.streamIndex = s.Index()
+			break
+		}
+	}
+	if p.codecContext == nil {
+		return errors.Errorf("%s doesn't contain video", p.path)
+	}
+
+	codec := avcodec.FindDecoderByID(p.codecContext.CodecID())
+	if codec == nil {
+		return errors.Errorf("Decoder for %s not found", p.path)
+	}
+	err = p.codecContext.OpenWithCodec(codec, nil)
+	if err != nil {
+		return err
+	}
+
+	if p.swsContext == nil {
+		p.swsContext, err = newScaleContext(
+			&swscale.DataDescription{p.codecContext.Width(), p.codecContext.Height(), p.codecContext.PixelFormat()},
+			&swscale.DataDescription{p.Width, p.Height, avutil.PIX_FMT_YUV420P},
+			p.algorithm,
+		)
+	}
+
+	return err
+}
+
+func (p *FileProvider) closeInput() {
+	if p.formatContext != nil {
+		p.formatContext.CloseInput()
+		p.formatContext.Free()
+		p.formatContext = nil
+	}
+	p.codecContext = nil
+}
+
+func (p *FileProvider) Size() DisplayInfo {
+	return p.DisplayInfo
+}
+
+func (p *FileProvider) Image(onImage func(*avutil.Frame) error) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.encFrame == nil {
+		return errors.New("Image provider already closed")
+	}
+
+	produced := false
+	for !produced {
+		if p.formatContext == nil {
+			err := p.open()
+			if err != nil {
+				p.closeInput()
+				return err
+			}
+		}
+
+		frameDone, err := p.formatContext.ReadFrame(p.decPacket)
+		if err != nil {
+			return err
+		}
+		if !frameDone {
+			// Start from the beginning when the file ends
+			p.closeInput()
+			continue
+		}
+		if p.decPacket.StreamIndex() != p.streamIndex {
+			p.decPacket.Unref()
+			continue
+		}
+
+		_, err = p.codecContext.DecodeVideo(p.decPacket, func(decFrame *avutil.Frame) error {
+			err := p.encFrame.MakeWritable()
+			if err != nil {
+				return err
+			}
+
+			p.clock.Wait()
+			p.swsContext.Scale(decFrame, 0, decFrame.Height(), p.encFrame)
+			produced = true
+			return onImage(p.encFrame)
+		})
+		p.decPacket.Unref()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *FileProvider) Close() {
+	p.Lock()
+	defer p.Unlock()
+	p.closeInput()
+	if p.swsContext != nil {
+		p.swsContext.Free()
+		p.swsContext = nil
+	}
+	if p.decPacket != nil {
+		p.decPacket.Free()
+		p.decPacket = nil
+	}
+	if p.encFrame != nil {
+		p.encFrame.Free()
+		p.encFrame = nil
+	}
+}
@@ -0,0 +1,266 @@
+package sharingnode
+
+import (
+	"fmt"
+	"github.com/BurntSushi/xgb"
+	"github.com/BurntSushi/xgb/damage"
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/imkira/go-libav/avutil"
+	"image"
+	"sync"
+	"time"
+)
+
+const (
+	ChangeDetectionAuto   = "auto"
+	ChangeDetectionDamage = "damage"
+	ChangeDetectionHash   = "hash"
+	ChangeDetectionOff    = "off"
+)
+
+const defaultKeepalive = time.Second
+
+// ChangeDetector tells whether the captured frame differs from the previous one
+type ChangeDetector interface {
+	// BeforeCapture is called before the frame is grabbed, changes after it belong to the next frame
+	BeforeCapture()
+	Changed(frame *avutil.Frame) bool
+	Close()
+}
+
+// NewChangeDetector returns nil when every frame must be encoded
+func NewChangeDetector(options *ScreenOptions, capture map[string]string, rect image.Rectangle) ChangeDetector {
+	mode := options.GrabbingOptions["change_detection"]
+	if mode == "" {
+		mode = ChangeDetectionAuto
+	}
+
+	x11 := displayBackend(options.Backend)
+	switch mode {
+	case ChangeDetectionOff:
+		return nil
+	case ChangeDetectionAuto, ChangeDetectionDamage:
+		if !x11 {
+			break
+		}
+		detector, err := NewDamageDetector(captureDisplay(capture), rect)
+		if err == nil {
+			return detector
+		}
+		logger.Warning("XDamage is not available, tile hashes are used: ", err)
+	case ChangeDetectionHash:
+	default:
+		logger.Warning("Unknown change detection mode ", mode)
+		return nil
+	}
+
+	return NewTileHashDetector()
+}
+
+func keepalive(options *ScreenOptions) time.Duration {
+	interval, err := time.ParseDuration(options.GrabbingOptions["keepalive"])
+	if err != nil || interval <= 0 {
+		return defaultKeepalive
+	}
+	return interval
+}
+
+// DamageDetector listens to XDamage notifications of the root window inside of the captured area
+type DamageDetector struct {
+	sync.Mutex
+	conn   *xgb.Conn
+	damage damage.Damage
+	rect   image.Rectangle
+	dirty  bool
+	// captured is the damage of the frame which is grabbed now
+	captured bool
+}
+
+func NewDamageDetector(display string, rect image.Rectangle) (*DamageDetector, error) {
+	conn, err := xgb.NewConnDisplay(display)
+	if err != nil {
+		return nil, err
+	}
+
+	detector := &DamageDetector{
+		conn:  conn,
+		rect:  rect,
+		dirty: true,
+	}
+
+	var root xproto.Window
+	err = damage.Init(conn)
+	if err != nil {
+		goto Error
+	}
+
+	_, err = damage.QueryVersion(conn, 1, 1).Reply()
+	if err != nil {
+		goto Error
+	}
+
+	detector.damage, err = damage.NewDamageId(conn)
+	if err != nil {
+		goto Error
+	}
+
+	root = xproto.Setup(conn).DefaultScreen(conn).Root
+	err = damage.CreateChecked(conn, detector.damage, xproto.Drawable(root), damage.ReportLevelBoundingBox).Check()
+	if err != nil {
+		goto Error
+	}
+
+	go detector.listen()
+
+	return detector, nil
+
+Error:
+	conn.Close()
+	return nil, err
+}
+
+func (d *DamageDetector) listen() {
+	for {
+		ev, xerr := d.conn.WaitForEvent()
+		if ev == nil && xerr == nil {
+			return
+		}
+		if xerr != nil {
+			logger.Warning(xerr)
+			continue
+		}
+
+		notify, ok := ev.(damage.NotifyEvent)
+		if !ok {
+			continue
+		}
+
+		d.damaged(image.Rect(int(notify.Area.X), int(notify.Area.Y),
+			int(notify.Area.X)+int(notify.Area.Width), int(notify.Area.Y)+int(notify.Area.Height)))
+
+		// Repairing the whole damage enables the next notification
+		damage.Subtract(d.conn, d.damage, 0, 0)
+	}
+}
+
+func (d *DamageDetector) damaged(area image.Rectangle) {
+	if !area.Overlaps(d.rect) {
+		return
+	}
+	d.Lock()
+	d.dirty = true
+	d.Unlock()
+}
+
+// BeforeCapture takes the damage, so drawing during the grab marks the next frame and isn't lost
+func (d *DamageDetector) BeforeCapture() {
+	d.Lock()
+	defer d.Unlock()
+	d.captured = d.dirty
+	d.dirty = false
+}
+
+func (d *DamageDetector) Changed(frame *avutil.Frame) bool {
+	d.Lock()
+	defer d.Unlock()
+	changed := d.captured
+	d.captured = false
+	return changed
+}
+
+func (d *DamageDetector) Close() {
+	damage.Destroy(d.conn, d.damage)
+	d.conn.Close()
+}
+
+const hashTileSize = 64
+
+// TileHashDetector compares hashes of frame tiles, it works with any capture backend
+type TileHashDetector struct {
+	hashes []uint64
+	next   []uint64
+}
+
+func NewTileHashDetector() *TileHashDetector {
+	return &TileHashDetector{}
+}
+
+// hashPlane mixes rows of the plane into FNV-1a hashes of the tiles
+func hashPlane(frame *avutil.Frame, plane, width, height, tile int, hashes []uint64, tilesX int) {
+	lineSize := frame.LineSize(plane)
+	data := (*[1 << 30]byte)(frame.Data(plane))[: lineSize*height : lineSize*height]
+	for y := 0; y < height; y++ {
+		row := data[y*lineSize : y*lineSize+width]
+		tileRow := (y / tile) * tilesX
+		for x, b := range row {
+			h := &hashes[tileRow+x/tile]
+			*h ^= uint64(b)
+			*h *= 1099511628211
+		}
+	}
+}
+
+func (d *TileHashDetector) BeforeCapture() {
+}
+
+func (d *TileHashDetector) Changed(frame *avutil.Frame) bool {
+	width, height := frame.Width(), frame.Height()
+	tilesX := (width + hashTileSize - 1) / hashTileSize
+	tilesY := (height + hashTileSize - 1) / hashTileSize
+	if len(d.next) != tilesX*tilesY {
+		d.next = make([]uint64, tilesX*tilesY)
+		d.hashes = nil
+	}
+	for i := range d.next {
+		d.next[i] = 14695981039346656037
+	}
+
+	hashPlane(frame, 0, width, height, hashTileSize, d.next, tilesX)
+	hashPlane(frame, 1, (width+1)/2, (height+1)/2, hashTileSize/2, d.next, tilesX)
+	hashPlane(frame, 2, (width+1)/2, (height+1)/2, hashTileSize/2, d.next, tilesX)
+
+	changed := d.hashes == nil
+	for i := 0; !changed && i < len(d.next); i++ {
+		changed = d.hashes[i] != d.next[i]
+	}
+	d.hashes, d.next = d.next, d.hashes
+	if d.next == nil {
+		d.next = make([]uint64, len(d.hashes))
+	}
+
+	return changed
+}
+
+func (d *TileHashDetector) Close() {
+}
+
+// FrameStats counts frames which were skipped by the change detection
+type FrameStats struct {
+	sync.Mutex
+	Captured  uint64
+	Encoded   uint64
+	Keepalive uint64
+}
+
+func (s *FrameStats) add(encoded, keepalive bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.Captured++
+	if encoded {
+		s.Encoded++
+	}
+	if keepalive {
+		s.Keepalive++
+	}
+}
+
+func (s *FrameStats) String() string {
+	s.Lock()
+	defer s.Unlock()
+	if s.Captured == 0 {
+		return "no frames captured"
+	}
+	skipped := s.Captured - s.Encoded
+	return fmt.Sprintf("%d of %d frames skipped (%.1f%%), %d keepalive frames",
+		skipped, s.Captured, float64(skipped)*100/float64(s.Captured), s.Keepalive)
+}
@@ -0,0 +1,80 @@
+package sharingnode
+
+import (
+	"github.com/imkira/go-libav/avutil"
+	"image"
+	"testing"
+)
+
+func TestDamageDetector(t *testing.T) {
+	detector := &DamageDetector{
+		rect:  image.Rect(0, 0, 100, 100),
+		dirty: true,
+	}
+
+	// The first frame is always encoded
+	detector.BeforeCapture()
+	if !detector.Changed(nil) {
+		t.Error("the first frame isn't changed")
+	}
+
+	detector.BeforeCapture()
+	if detector.Changed(nil) {
+		t.Error("the frame without damage is changed")
+	}
+
+	// Drawing during the grab may miss the frame, so the next frame is encoded
+	detector.BeforeCapture()
+	detector.damaged(image.Rect(10, 10, 20, 20))
+	if detector.Changed(nil) {
+		t.Error("the damage after the capture started changed the frame")
+	}
+	detector.BeforeCapture()
+	if !detector.Changed(nil) {
+		t.Error("the damage during the grab is lost")
+	}
+
+	detector.damaged(image.Rect(200, 200, 210, 210))
+	detector.BeforeCapture()
+	if detector.Changed(nil) {
+		t.Error("the damage outside of the captured area changed the frame")
+	}
+}
+
+// patternFrame returns the frame of the test pattern with the index
+func patternFrame(tb testing.TB, width, height, index int) *avutil.Frame {
+	frame, err := newVideoFrame(width, height, avutil.PIX_FMT_YUV420P)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	img := testPatternImage(width, height, index)
+	copyPlane(frame, 0, img.Y, img.YStride, width, height)
+	copyPlane(frame, 1, img.Cb, img.CStride, (width+1)/2, (height+1)/2)
+	copyPlane(frame, 2, img.Cr, img.CStride, (width+1)/2, (height+1)/2)
+	return frame
+}
+
+func TestTileHashDetector(t *testing.T) {
+	const width, height = 200, 100
+
+	detector := NewTileHashDetector()
+	first := patternFrame(t, width, height, 0)
+	defer first.Free()
+	next := patternFrame(t, width, height, 1)
+	defer next.Free()
+
+	for i, test := range []struct {
+		frame *avutil.Frame
+		want  bool
+	}{
+		{first, true},
+		{first, false},
+		{next, true},
+		{next, false},
+	} {
+		detector.BeforeCapture()
+		if changed := detector.Changed(test.frame); changed != test.want {
+			t.Errorf("frame %d: changed %v, want %v", i, changed, test.want)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package sharingnode
+
+import (
+	"github.com/imkira/go-libav/avcodec"
+	"github.com/pkg/errors"
+)
+
+const DefaultCodec = "h264"
+
+type VideoCodec struct {
+	Name     string
+	Encoders []string
+	Decoders []string
+	// Options overrides the user defined stream options for this codec
+	Options map[string]string
+	// Drop removes the user defined stream options which conflict with this codec
+	Drop []string
+	// Parse tells that the stream header must be passed through the parser
+	Parse bool
+	// Lossless codecs ignore the rate control options
+	Lossless bool
+}
+
+var VideoCodecs = []*VideoCodec{
+	{
+		Name:     "h264",
+		Encoders: []string{"libx264"},
+		Decoders: []string{"h264"},
+		Parse:    true,
+	},
+	{
+		Name:     "vp8",
+		Encoders: []string{"libvpx"},
+		Decoders: []string{"libvpx", "vp8"},
+		Options: map[string]string{
+			"deadline": "realtime",
+			"cpu-used": "8",
+		},
+		Drop: []string{"preset", "tune"},
+	},
+	{
+		Name:     "vp9",
+		Encoders: []string{"libvpx-vp9"},
+		Decoders: []string{"libvpx-vp9", "vp9"},
+		Options: map[string]string{
+			"deadline": "realtime",
+			"cpu-used": "8",
+			"row-mt":   "1",
+		},
+		Drop: []string{"preset", "tune"},
+	},
+	{
+		Name:     "av1",
+		Encoders: []string{"libsvtav1", "libaom-av1"},
+		Decoders: []string{"libdav1d", "libaom-av1", "av1"},
+		Options: map[string]string{
+			"usage":    "realtime",
+			"cpu-used": "8",
+		},
+		Drop: []string{"preset", "tune"},
+	},
+	{
+		Name:     "h264-lossless",
+		Encoders: []string{"libx264"},
+		Decoders: []string{"h264"},
+		Options: map[string]string{
+			"qp": "0",
+		},
+		Drop:     []string{"crf", "maxrate", "bufsize"},
+		Parse:    true,
+		Lossless: true,
+	},
+	{
+		Name:     "ffv1",
+		Encoders: []string{"ffv1"},
+		Decoders: []string{"ffv1"},
+		Options: map[string]string{
+			"slicecrc": "0",
+		},
+		Drop:     []string{"preset", "tune", "crf", "maxrate", "bufsize"},
+		Lossless: true,
+	},
+}
+
+func FindVideoCodec(name string) (*VideoCodec, error) {
+	if name == "" {
+		name = DefaultCodec
+	}
+
+	for _, c := range VideoCodecs {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+
+	return nil, errors.Errorf("Unknown video codec %s", name)
+}
+
+func findCodec(names []string, find func(string) *avcodec.Codec) *avcodec.Codec {
+	for _, name := range names {
+		codec := find(name)
+		if codec != nil {
+			return codec
+		}
+	}
+
+	return nil
+}
+
+func (c *VideoCodec) FindEncoder() *avcodec.Codec {
+	return findCodec(c.Encoders, avcodec.FindEncoderByName)
+}
+
+func (c *VideoCodec) FindDecoder() *avcodec.Codec {
+	return findCodec(c.Decoders, avcodec.FindDecoderByName)
+}
+
+func (c *VideoCodec) EncoderOptions(options map[string]string) map[string]string {
+	result := make(map[string]string, len(options)+len(c.Options))
+	for key, value := range options {
+		result[key] = value
+	}
+	for _, key := range c.Drop {
+		delete(result, key)
+	}
+	for key, value := range c.Options {
+		result[key] = value
+	}
+
+	return result
+}
+
+// AvailableEncoders returns names of codecs which can be encoded on this machine
+func AvailableEncoders() []string {
+	names := make([]string, 0, len(VideoCodecs))
+	for _, c := range VideoCodecs {
+		if c.FindEncoder() != nil {
+			names = append(names, c.Name)
+		}
+	}
+
+	return names
+}
+
+// SelectCodec picks the first preferred codec which is offered by the host and can be decoded locally
+func SelectCodec(offered []string, preferred []string) (*VideoCodec, error) {
+	// Hosts without negotiation support stream only h264
+	if len(offered) == 0 {
+		offered = []string{DefaultCodec}
+	}
+	if len(preferred) == 0 {
+		preferred = []string{DefaultCodec}
+	}
+
+	for _, name := range preferred {
+		for _, o := range offered {
+			if o != name {
+				continue
+			}
+
+			codec, err := FindVideoCodec(name)
+			if err != nil {
+				break
+			}
+			if codec.FindDecoder() != nil {
+				return codec, nil
+			}
+		}
+	}
+
+	return nil, errors.Errorf("None of offered codecs %v can be decoded", offered)
+}
@@ -0,0 +1,91 @@
+package sharingnode
+
+import (
+	"image"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	const width, height, packets = 96, 64, 10
+
+	for _, codec := range VideoCodecs {
+		codec := codec
+		t.Run(codec.Name, func(t *testing.T) {
+			encoded := encodeTestPattern(t, codec, width, height, packets)
+			if len(encoded) != packets {
+				t.Fatalf("got %d packets, want %d", len(encoded), packets)
+			}
+			if !encoded[0].Key() {
+				t.Errorf("the first packet isn't a key frame")
+			}
+			for i, packet := range encoded {
+				if key := isKeyFrame(codec.Name, packet.Data); key != packet.Key() {
+					t.Errorf("packet %d is a key frame in the bitstream %v, flagged %v", i, key, packet.Key())
+				}
+			}
+			for i := 1; i < len(encoded); i++ {
+				if encoded[i].PTS <= encoded[i-1].PTS {
+					t.Errorf("packet %d has pts %d after %d", i, encoded[i].PTS, encoded[i-1].PTS)
+				}
+			}
+
+			images := decodePackets(t, codec, encoded)
+			if len(images) == 0 {
+				t.Fatal("no frames decoded")
+			}
+			for i, img := range images {
+				if img.Rect != image.Rect(0, 0, width, height) {
+					t.Fatalf("frame %d has size %v", i, img.Rect)
+				}
+			}
+
+			// Lossy codecs keep the bars, lossless ones keep every sample
+			limit := 48
+			if codec.Lossless {
+				limit = 0
+			}
+			if diff := imageDiff(images[0], testPatternImage(width, height, 0)); diff > limit {
+				t.Errorf("the first frame differs by %d, the limit is %d", diff, limit)
+			}
+		})
+	}
+}
+
+func TestSelectCodec(t *testing.T) {
+	tests := []struct {
+		name      string
+		offered   []string
+		preferred []string
+		want      string
+	}{
+		{"legacy host", nil, []string{"vp9", "h264"}, "h264"},
+		{"first preferred", []string{"h264", "ffv1"}, []string{"ffv1", "h264"}, "ffv1"},
+		{"default preference", []string{"vp8", "h264"}, nil, "h264"},
+		{"unknown offered", []string{"mjpeg", "h264"}, []string{"mjpeg", "h264"}, "h264"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			codec, err := FindVideoCodec(test.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if codec.FindDecoder() == nil {
+				t.Skipf("%s is not available", test.want)
+			}
+
+			selected, err := SelectCodec(test.offered, test.preferred)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if selected.Name != test.want {
+				t.Errorf("got %s, want %s", selected.Name, test.want)
+			}
+		})
+	}
+
+	_, err := SelectCodec([]string{"mjpeg"}, []string{"mjpeg"})
+	if err == nil {
+		t.Error("unknown codec is selected")
+	}
+}
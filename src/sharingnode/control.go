@@ -0,0 +1,129 @@
+package sharingnode
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"strconv"
+)
+
+// StreamChange is the control message of the viewer which changes the running stream.
+// Zero fields keep the current value
+type StreamChange struct {
+	CRF int `json:"crf,omitempty"`
+	// BitRate is the maxrate in vbv mode and the bitrate in cbr mode, crf mode is switched to vbv
+	BitRate   string  `json:"bitrate,omitempty"`
+	FrameRate int     `json:"frame_rate,omitempty"`
+	Width     int     `json:"width,omitempty"`
+	Height    int     `json:"height,omitempty"`
+	Scale     float64 `json:"scale,omitempty"`
+	// KeyFrame asks for a key frame, viewers without the event stream recover with it
+	KeyFrame bool `json:"key_frame,omitempty"`
+	// Recording tells the host that the viewer started or stopped recording, it doesn't change the encoder
+	Recording *bool `json:"recording,omitempty"`
+}
+
+// Empty tells that the change doesn't change the encoder
+func (c *StreamChange) Empty() bool {
+	return c.CRF == 0 && c.BitRate == "" && c.FrameRate == 0 && c.Width == 0 && c.Height == 0 && c.Scale == 0
+}
+
+func (c *StreamChange) String() string {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+// StreamUpdate is sent to viewers in a control packet when the host applies a change
+type StreamUpdate struct {
+	Output    DisplayInfo `json:"output"`
+	FrameRate int         `json:"frame_rate"`
+}
+
+func copyOptions(options map[string]string) map[string]string {
+	result := make(map[string]string, len(options))
+	for key, value := range options {
+		result[key] = value
+	}
+	return result
+}
+
+// Apply returns a copy of the stream info with the change applied and validated
+func (c *StreamChange) Apply(info StreamInfo) (*StreamInfo, error) {
+	videoCodec, err := FindVideoCodec(info.StreamOptions.Codec)
+	if err != nil {
+		return nil, err
+	}
+	params, err := ParseEncoderParams(videoCodec, info.StreamOptions.Options, info.ScreenOptions.GrabbingOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	stream := copyOptions(info.StreamOptions.Options)
+	grabbing := copyOptions(info.ScreenOptions.GrabbingOptions)
+	if c.CRF != 0 {
+		if params.RateControl == RateCBR || params.RateControl == RateLossless {
+			return nil, errors.Errorf("crf can't be changed with %s rate control", params.RateControl)
+		}
+		stream["crf"] = strconv.Itoa(c.CRF)
+	}
+	if c.BitRate != "" {
+		rate, err := parseBitRate(c.BitRate)
+		if err != nil {
+			return nil, err
+		}
+		switch params.RateControl {
+		case RateCRF, RateVBV:
+			stream["rate_control"] = string(RateVBV)
+			stream["maxrate"] = c.BitRate
+			if params.BufSize < rate {
+				stream["bufsize"] = strconv.FormatInt(rate*2, 10)
+			}
+		case RateCBR:
+			stream["b"] = c.BitRate
+			delete(stream, "maxrate")
+		default:
+			return nil, errors.Errorf("Bitrate can't be changed with %s rate control", params.RateControl)
+		}
+	}
+	if c.FrameRate != 0 {
+		stream["r"] = strconv.Itoa(c.FrameRate)
+		grabbing["r"] = stream["r"]
+	}
+
+	changed := info
+	changed.StreamOptions.Options = stream
+	changed.ScreenOptions.GrabbingOptions = grabbing
+	if c.Width != 0 || c.Height != 0 || c.Scale != 0 {
+		changed.ScreenOptions.Width = c.Width
+		changed.ScreenOptions.Height = c.Height
+		changed.ScreenOptions.Scale = c.Scale
+	}
+
+	_, err = ParseEncoderParams(videoCodec, changed.StreamOptions.Options, changed.ScreenOptions.GrabbingOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	return &changed, nil
+}
+
+// DecodeStreamUpdate parses the payload of a control packet
+func DecodeStreamUpdate(data []byte) (*StreamUpdate, error) {
+	update := &StreamUpdate{}
+	err := json.Unmarshal(data, update)
+	if err != nil {
+		return nil, err
+	}
+	if update.Output.Width <= 0 || update.Output.Height <= 0 || update.FrameRate <= 0 {
+		return nil, errors.New("Wrong stream update")
+	}
+
+	return update, nil
+}
+
+// ControlSink is implemented by sinks which follow changes of the stream
+type ControlSink interface {
+	WriteUpdate(update *StreamUpdate) error
+}
@@ -0,0 +1,230 @@
+package sharingnode
+
+import (
+	"fmt"
+	"fyne.io/fyne"
+	"fyne.io/fyne/widget"
+	"strconv"
+	"sync"
+)
+
+var qualityPresets = map[string]int{
+	"High":   23,
+	"Medium": 30,
+	"Low":    37,
+}
+
+var resolutionPresets = map[string]float64{
+	"100%": 1,
+	"75%":  0.75,
+	"50%":  0.5,
+	"25%":  0.25,
+}
+
+// ViewerControls is a separate window with session controls, so the remote screen keeps the whole viewer window
+type ViewerControls struct {
+	sync.Mutex
+	window  fyne.Window
+	box     *widget.Box
+	status  *widget.Label
+	mode    *widget.Label
+	control *widget.Label
+	token   *widget.Button
+	holding bool
+}
+
+func NewViewerControls(app fyne.App) *ViewerControls {
+	controls := &ViewerControls{
+		window: app.NewWindow("Sharing controls"),
+		box:    widget.NewVBox(),
+		status: widget.NewLabel(""),
+		mode:   widget.NewLabel("View only"),
+	}
+	controls.box.Append(controls.status)
+	controls.box.Append(controls.mode)
+	controls.window.SetContent(controls.box)
+
+	return controls
+}
+
+func (c *ViewerControls) Add(object fyne.CanvasObject) {
+	c.Lock()
+	defer c.Unlock()
+	c.box.Append(object)
+}
+
+func (c *ViewerControls) SetStatus(status string) {
+	c.Lock()
+	defer c.Unlock()
+	c.status.SetText(status)
+}
+
+// SetViewOnly shows whether the remote screen can be controlled
+func (c *ViewerControls) SetViewOnly(viewOnly bool) {
+	c.Lock()
+	defer c.Unlock()
+	if viewOnly {
+		c.mode.Show()
+	} else {
+		c.mode.Hide()
+	}
+}
+
+// AddControl adds the button which requests and releases the input token of the host
+func (c *ViewerControls) AddControl(request func(), release func()) {
+	c.Lock()
+	c.control = widget.NewLabel("")
+	c.token = widget.NewButton("Request control", func() {
+		c.Lock()
+		holding := c.holding
+		c.Unlock()
+		if holding {
+			release()
+		} else {
+			request()
+		}
+	})
+	c.Unlock()
+
+	c.Add(c.control)
+	c.Add(c.token)
+}
+
+// SetControl shows who holds the input token
+func (c *ViewerControls) SetControl(state *ControlState) {
+	c.Lock()
+	defer c.Unlock()
+	if c.control == nil {
+		return
+	}
+
+	c.holding = state.You
+	switch {
+	case state.You:
+		c.control.SetText("You control the remote screen")
+		c.token.SetText("Release control")
+	case state.Holder != "":
+		c.control.SetText(fmt.Sprintf("The remote screen is controlled by %s", state.Holder))
+		c.token.SetText("Request control")
+	default:
+		c.control.SetText("Nobody controls the remote screen")
+		c.token.SetText("Request control")
+	}
+	if state.Requested {
+		c.control.SetText(c.control.Text + ", waiting for the host")
+	}
+	if state.Paused {
+		c.control.SetText(c.control.Text + "\nPaused while the host user is active")
+	}
+}
+
+func (c *ViewerControls) AddAudio(player *AudioPlayer) {
+	mute := widget.NewCheck("Mute audio", func(b bool) {
+		player.SetMuted(b)
+	})
+	mute.Checked = player.Muted()
+	c.Add(mute)
+}
+
+func (c *ViewerControls) AddRecorder(recorder *SessionRecorder) {
+	var record *widget.Check
+	record = widget.NewCheck("Record session", func(b bool) {
+		if !b {
+			recorder.Stop()
+			return
+		}
+
+		err := recorder.Start()
+		if err != nil {
+			logger.Error(err)
+			c.SetStatus(err.Error())
+			record.SetChecked(false)
+		}
+	})
+	record.Checked = recorder.Recording()
+	c.Add(record)
+}
+
+// AddQuality adds the quality control of the running stream. Only selected values are changed
+func (c *ViewerControls) AddQuality(reconfigure func(*StreamChange) error) {
+	quality := widget.NewSelect([]string{"High", "Medium", "Low"}, nil)
+	bitrate := widget.NewSelect([]string{"500k", "1M", "2M", "4M", "8M"}, nil)
+	frameRate := widget.NewSelect([]string{"5", "10", "15", "24", "30"}, nil)
+	resolution := widget.NewSelect([]string{"100%", "75%", "50%", "25%"}, nil)
+
+	form := widget.NewForm(
+		&widget.FormItem{Text: "Quality", Widget: quality},
+		&widget.FormItem{Text: "Bitrate", Widget: bitrate},
+		&widget.FormItem{Text: "Frame rate", Widget: frameRate},
+		&widget.FormItem{Text: "Resolution", Widget: resolution},
+	)
+	form.OnSubmit = func() {
+		change := &StreamChange{
+			CRF:     qualityPresets[quality.Selected],
+			BitRate: bitrate.Selected,
+			Scale:   resolutionPresets[resolution.Selected],
+		}
+		change.FrameRate, _ = strconv.Atoi(frameRate.Selected)
+
+		err := reconfigure(change)
+		if err != nil {
+			logger.Error(err)
+			c.SetStatus(err.Error())
+		}
+	}
+
+	c.Add(widget.NewGroup("Stream quality", form))
+}
+
+// AddTyping adds the entry which types its text on the host, it works for any layout of both sides
+func (c *ViewerControls) AddTyping(typeText func(string)) {
+	text := widget.NewMultiLineEntry()
+	text.SetPlaceHolder("Text to type on the remote screen")
+	typeButton := widget.NewButton("Type", func() {
+		if text.Text == "" {
+			return
+		}
+		typeText(text.Text)
+		text.SetText("")
+	})
+
+	c.Add(widget.NewGroup("Type text", text, typeButton))
+}
+
+// AddMacros adds the menu of macros of the config and the entry for other key sequences,
+// they send combinations which the local system would intercept
+func (c *ViewerControls) AddMacros(macros *MacroSender) {
+	report := func(err error) {
+		if err != nil {
+			logger.Warning(err)
+			c.SetStatus(err.Error())
+		}
+	}
+
+	names := widget.NewSelect(macros.Names(), nil)
+	sendButton := widget.NewButton("Send", func() {
+		if names.Selected == "" {
+			return
+		}
+		report(macros.SendNamed(names.Selected))
+	})
+
+	keys := widget.NewEntry()
+	keys.SetPlaceHolder("Keys like ctrl+alt+delete or text:hello")
+	keysButton := widget.NewButton("Send keys", func() {
+		if keys.Text == "" {
+			return
+		}
+		report(macros.Send(keys.Text))
+	})
+
+	c.Add(widget.NewGroup("Key sequences", widget.NewHBox(names, sendButton), keys, keysButton))
+}
+
+func (c *ViewerControls) Show() {
+	c.window.Show()
+}
+
+func (c *ViewerControls) Close() {
+	c.window.Close()
+}
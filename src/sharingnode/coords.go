@@ -0,0 +1,86 @@
+package sharingnode
+
+import (
+	"github.com/kbinani/screenshot"
+	"github.com/pkg/errors"
+	"image"
+)
+
+// letterbox returns the area of the window which shows the content without distortion,
+// the rest of the window is left empty
+func letterbox(window, content image.Point) image.Rectangle {
+	if window.X <= 0 || window.Y <= 0 || content.X <= 0 || content.Y <= 0 {
+		return image.Rectangle{Max: window}
+	}
+
+	width, height := window.X, content.Y*window.X/content.X
+	if height > window.Y {
+		width, height = content.X*window.Y/content.Y, window.Y
+	}
+	min := image.Pt((window.X-width)/2, (window.Y-height)/2)
+
+	return image.Rectangle{Min: min, Max: min.Add(image.Pt(width, height))}
+}
+
+func clamp(value, min, max int) int {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+// ViewMapping maps positions in the viewer window to the native pixels of the remote display.
+// Window is the size in the units of GLFW cursor positions, so HiDPI scaling doesn't matter
+type ViewMapping struct {
+	Window image.Point
+	Remote image.Point
+}
+
+// ToRemote maps the window position, positions over the empty bars stick to the edge of the display
+func (m ViewMapping) ToRemote(x, y float64) image.Point {
+	picture := letterbox(m.Window, m.Remote)
+	if picture.Empty() || m.Remote.X <= 0 || m.Remote.Y <= 0 {
+		return image.Pt(int(x), int(y))
+	}
+
+	remoteX := int((x - float64(picture.Min.X)) * float64(m.Remote.X) / float64(picture.Dx()))
+	remoteY := int((y - float64(picture.Min.Y)) * float64(m.Remote.Y) / float64(picture.Dy()))
+
+	return image.Pt(clamp(remoteX, 0, m.Remote.X-1), clamp(remoteY, 0, m.Remote.Y-1))
+}
+
+// DesktopMapping maps positions on the shared display to the global desktop of the host
+type DesktopMapping struct {
+	Display image.Rectangle
+}
+
+// NewDesktopMapping uses the bounds of the target display among bounds of all displays
+func NewDesktopMapping(displays []image.Rectangle, target int) (DesktopMapping, error) {
+	if target < 0 || target >= len(displays) {
+		return DesktopMapping{}, errors.Errorf("Display %d doesn't exist", target)
+	}
+	return DesktopMapping{Display: displays[target]}, nil
+}
+
+// ToDesktop maps the display position, positions outside of the display stick to its edge
+func (m DesktopMapping) ToDesktop(x, y int) image.Point {
+	if m.Display.Empty() {
+		return image.Pt(x, y)
+	}
+	return image.Pt(
+		m.Display.Min.X+clamp(x, 0, m.Display.Dx()-1),
+		m.Display.Min.Y+clamp(y, 0, m.Display.Dy()-1),
+	)
+}
+
+// displayBounds returns bounds of displays of the host in the global desktop coordinates
+func displayBounds() []image.Rectangle {
+	displays := make([]image.Rectangle, screenshot.NumActiveDisplays())
+	for i := range displays {
+		displays[i] = screenshot.GetDisplayBounds(i)
+	}
+	return displays
+}
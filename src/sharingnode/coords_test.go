@@ -0,0 +1,106 @@
+package sharingnode
+
+import (
+	"image"
+	"testing"
+)
+
+func TestLetterbox(t *testing.T) {
+	tests := []struct {
+		name    string
+		window  image.Point
+		content image.Point
+		want    image.Rectangle
+	}{
+		{"same aspect", image.Pt(800, 450), image.Pt(1920, 1080), image.Rect(0, 0, 800, 450)},
+		{"bars above and below", image.Pt(800, 600), image.Pt(1920, 1080), image.Rect(0, 75, 800, 525)},
+		{"bars at the sides", image.Pt(1000, 450), image.Pt(1600, 900), image.Rect(100, 0, 900, 450)},
+		{"vertical display", image.Pt(800, 600), image.Pt(1080, 1920), image.Rect(231, 0, 568, 600)},
+		{"empty window", image.Pt(0, 0), image.Pt(1920, 1080), image.Rect(0, 0, 0, 0)},
+		{"unknown content", image.Pt(800, 600), image.Pt(0, 0), image.Rect(0, 0, 800, 600)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := letterbox(test.window, test.content); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestViewMappingToRemote(t *testing.T) {
+	tests := []struct {
+		name   string
+		window image.Point
+		remote image.Point
+		x, y   float64
+		want   image.Point
+	}{
+		{"center", image.Pt(800, 450), image.Pt(1920, 1080), 400, 225, image.Pt(960, 540)},
+		{"last pixel", image.Pt(800, 450), image.Pt(1920, 1080), 799.9, 449.9, image.Pt(1919, 1079)},
+		{"top bar", image.Pt(800, 600), image.Pt(1920, 1080), 400, 10, image.Pt(960, 0)},
+		{"bottom bar", image.Pt(800, 600), image.Pt(1920, 1080), 400, 590, image.Pt(960, 1079)},
+		{"picture between bars", image.Pt(800, 600), image.Pt(1920, 1080), 400, 300, image.Pt(960, 540)},
+		{"side bar of vertical display", image.Pt(800, 600), image.Pt(1080, 1920), 100, 300, image.Pt(0, 960)},
+		{"vertical display", image.Pt(800, 600), image.Pt(1080, 1920), 399.5, 300, image.Pt(540, 960)},
+		// Cursor positions are in window units, so a HiDPI window maps like a normal one
+		{"HiDPI viewer", image.Pt(960, 540), image.Pt(1920, 1080), 480, 270, image.Pt(960, 540)},
+		{"HiDPI host", image.Pt(1280, 720), image.Pt(3840, 2160), 640, 360, image.Pt(1920, 1080)},
+		{"unknown window", image.Pt(0, 0), image.Pt(1920, 1080), 12, 34, image.Pt(12, 34)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mapping := ViewMapping{Window: test.window, Remote: test.remote}
+			if got := mapping.ToRemote(test.x, test.y); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDesktopMappingToDesktop(t *testing.T) {
+	stacked := []image.Rectangle{image.Rect(0, 0, 1920, 1080), image.Rect(0, 1080, 1920, 2160)}
+	leftAbove := []image.Rectangle{image.Rect(0, 0, 1920, 1080), image.Rect(-1280, -200, 0, 824)}
+	mixedDPI := []image.Rectangle{image.Rect(0, 0, 1920, 1080), image.Rect(1920, 0, 5760, 2160)}
+
+	tests := []struct {
+		name     string
+		displays []image.Rectangle
+		target   int
+		x, y     int
+		want     image.Point
+	}{
+		{"first display", stacked, 0, 10, 20, image.Pt(10, 20)},
+		{"stacked display", stacked, 1, 10, 20, image.Pt(10, 1100)},
+		{"outside of stacked display", stacked, 1, 5000, -5, image.Pt(1919, 1080)},
+		{"negative origin", leftAbove, 1, 0, 0, image.Pt(-1280, -200)},
+		{"last pixel of negative origin", leftAbove, 1, 1279, 1023, image.Pt(-1, 823)},
+		{"outside of negative origin", leftAbove, 1, 2000, 2000, image.Pt(-1, 823)},
+		{"HiDPI display", mixedDPI, 1, 3839, 2159, image.Pt(5759, 2159)},
+		{"LoDPI display beside HiDPI one", mixedDPI, 0, 3839, 2159, image.Pt(1919, 1079)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mapping, err := NewDesktopMapping(test.displays, test.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := mapping.ToDesktop(test.x, test.y); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	if got := (DesktopMapping{}).ToDesktop(12, -34); got != image.Pt(12, -34) {
+		t.Errorf("unknown display maps to %v", got)
+	}
+	for _, target := range []int{-1, 2} {
+		_, err := NewDesktopMapping(stacked, target)
+		if err == nil {
+			t.Errorf("display %d is mapped", target)
+		}
+	}
+}
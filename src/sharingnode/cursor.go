@@ -0,0 +1,266 @@
+package sharingnode
+
+import (
+	"encoding/binary"
+	"fyne.io/fyne"
+	"fyne.io/fyne/canvas"
+	"github.com/BurntSushi/xgb"
+	"github.com/BurntSushi/xgb/xfixes"
+	"github.com/pkg/errors"
+	"image"
+	"sync"
+)
+
+const cursorRate = 30
+
+const maxCursorSize = 256
+
+const (
+	cursorPosition byte = iota + 1
+	cursorShape
+)
+
+// CursorUpdate is the content of a cursor packet, either the position or the shape
+type CursorUpdate struct {
+	Position bool
+	// X and Y are relative to the captured display
+	X       int
+	Y       int
+	Visible bool
+
+	Image *image.RGBA
+	HotX  int
+	HotY  int
+}
+
+func encodeCursorPosition(x, y int, visible bool) []byte {
+	data := make([]byte, 10)
+	data[0] = cursorPosition
+	binary.LittleEndian.PutUint32(data[1:5], uint32(int32(x)))
+	binary.LittleEndian.PutUint32(data[5:9], uint32(int32(y)))
+	if visible {
+		data[9] = 1
+	}
+	return data
+}
+
+// encodeCursorShape stores the premultiplied ARGB cursor image of XFixes as RGBA
+func encodeCursorShape(width, height, hotX, hotY int, argb []uint32) []byte {
+	data := make([]byte, 9+width*height*4)
+	data[0] = cursorShape
+	binary.LittleEndian.PutUint16(data[1:3], uint16(width))
+	binary.LittleEndian.PutUint16(data[3:5], uint16(height))
+	binary.LittleEndian.PutUint16(data[5:7], uint16(hotX))
+	binary.LittleEndian.PutUint16(data[7:9], uint16(hotY))
+	pix := data[9:]
+	for i := 0; i < width*height && i < len(argb); i++ {
+		pix[i*4] = byte(argb[i] >> 16)
+		pix[i*4+1] = byte(argb[i] >> 8)
+		pix[i*4+2] = byte(argb[i])
+		pix[i*4+3] = byte(argb[i] >> 24)
+	}
+	return data
+}
+
+// DecodeCursor parses the payload of a cursor packet
+func DecodeCursor(data []byte) (*CursorUpdate, error) {
+	if len(data) == 0 {
+		return nil, errors.New("Empty cursor packet")
+	}
+
+	switch data[0] {
+	case cursorPosition:
+		if len(data) != 10 {
+			return nil, errors.New("Wrong size of cursor position")
+		}
+		return &CursorUpdate{
+			Position: true,
+			X:        int(int32(binary.LittleEndian.Uint32(data[1:5]))),
+			Y:        int(int32(binary.LittleEndian.Uint32(data[5:9]))),
+			Visible:  data[9] != 0,
+		}, nil
+	case cursorShape:
+		if len(data) < 9 {
+			return nil, errors.New("Wrong size of cursor shape")
+		}
+		width := int(binary.LittleEndian.Uint16(data[1:3]))
+		height := int(binary.LittleEndian.Uint16(data[3:5]))
+		if width > maxCursorSize || height > maxCursorSize || len(data) != 9+width*height*4 {
+			return nil, errors.Errorf("Wrong cursor shape %dx%d", width, height)
+		}
+
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		copy(img.Pix, data[9:])
+		return &CursorUpdate{
+			Image: img,
+			HotX:  int(binary.LittleEndian.Uint16(data[5:7])),
+			HotY:  int(binary.LittleEndian.Uint16(data[7:9])),
+		}, nil
+	}
+
+	return nil, errors.Errorf("Unknown cursor packet %d", data[0])
+}
+
+// CursorTracker polls the cursor of the X server through XFixes
+type CursorTracker struct {
+	conn   *xgb.Conn
+	rect   image.Rectangle
+	clock  *frameClock
+	closed chan struct{}
+	once   sync.Once
+}
+
+func NewCursorTracker(display string, rect image.Rectangle) (*CursorTracker, error) {
+	conn, err := xgb.NewConnDisplay(display)
+	if err != nil {
+		return nil, err
+	}
+
+	err = xfixes.Init(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	_, err = xfixes.QueryVersion(conn, 4, 0).Reply()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &CursorTracker{
+		conn:   conn,
+		rect:   rect,
+		clock:  newFrameClock(cursorRate),
+		closed: make(chan struct{}),
+	}, nil
+}
+
+// Run sends payloads of cursor packets when the position or the shape changes
+func (t *CursorTracker) Run(onCursor func(data []byte)) {
+	defer t.conn.Close()
+
+	var serial uint32
+	var x, y int
+	visible := false
+	first := true
+	for {
+		select {
+		case <-t.closed:
+			return
+		default:
+		}
+		t.clock.Wait()
+
+		reply, err := xfixes.GetCursorImage(t.conn).Reply()
+		if err != nil {
+			logger.Warning("Cursor tracking is stopped: ", err)
+			return
+		}
+
+		if first || reply.CursorSerial != serial {
+			serial = reply.CursorSerial
+			width, height := int(reply.Width), int(reply.Height)
+			if width <= maxCursorSize && height <= maxCursorSize {
+				onCursor(encodeCursorShape(width, height, int(reply.Xhot), int(reply.Yhot), reply.CursorImage))
+			}
+		}
+
+		point := image.Pt(int(reply.X), int(reply.Y))
+		inside := point.In(t.rect)
+		point = point.Sub(t.rect.Min)
+		if first || inside != visible || (inside && (point.X != x || point.Y != y)) {
+			x, y, visible = point.X, point.Y, inside
+			onCursor(encodeCursorPosition(x, y, visible))
+		}
+		first = false
+	}
+}
+
+func (t *CursorTracker) Close() {
+	t.once.Do(func() {
+		close(t.closed)
+	})
+}
+
+// CursorSink is implemented by sinks which show the remote cursor
+type CursorSink interface {
+	WriteCursor(update *CursorUpdate) error
+}
+
+// CursorOverlay lays out the remote cursor above the letterboxed image of the remote display
+type CursorOverlay struct {
+	sync.Mutex
+	remote    DisplayInfo
+	cursor    *canvas.Image
+	container *fyne.Container
+	x         int
+	y         int
+	hotX      int
+	hotY      int
+	visible   bool
+	shape     bool
+}
+
+func NewCursorOverlay(img *canvas.Image, remote DisplayInfo) *CursorOverlay {
+	overlay := &CursorOverlay{
+		remote: remote,
+		cursor: canvas.NewImageFromImage(image.NewRGBA(image.Rect(0, 0, 1, 1))),
+	}
+	overlay.cursor.Hide()
+	overlay.container = fyne.NewContainerWithLayout(overlay, img, overlay.cursor)
+
+	return overlay
+}
+
+func (o *CursorOverlay) Content() fyne.CanvasObject {
+	return o.container
+}
+
+func (o *CursorOverlay) Layout(objects []fyne.CanvasObject, size fyne.Size) {
+	o.Lock()
+	defer o.Unlock()
+
+	// Events of the viewer are mapped with the same letterbox
+	picture := letterbox(image.Pt(size.Width, size.Height), image.Pt(o.remote.Width, o.remote.Height))
+	objects[0].Move(fyne.NewPos(picture.Min.X, picture.Min.Y))
+	objects[0].Resize(fyne.NewSize(picture.Dx(), picture.Dy()))
+	if o.remote.Width <= 0 || o.remote.Height <= 0 || !o.shape {
+		return
+	}
+
+	bounds := o.cursor.Image.Bounds()
+	scaleX := float64(picture.Dx()) / float64(o.remote.Width)
+	scaleY := float64(picture.Dy()) / float64(o.remote.Height)
+	objects[1].Move(fyne.NewPos(picture.Min.X+int(float64(o.x-o.hotX)*scaleX), picture.Min.Y+int(float64(o.y-o.hotY)*scaleY)))
+	objects[1].Resize(fyne.NewSize(int(float64(bounds.Dx())*scaleX)+1, int(float64(bounds.Dy())*scaleY)+1))
+}
+
+func (o *CursorOverlay) MinSize(objects []fyne.CanvasObject) fyne.Size {
+	return objects[0].MinSize()
+}
+
+// Update applies the cursor packet, the caller refreshes the canvas
+func (o *CursorOverlay) Update(update *CursorUpdate) {
+	o.Lock()
+	if update.Position {
+		o.x, o.y, o.visible = update.X, update.Y, update.Visible
+	} else {
+		o.cursor.Image = update.Image
+		o.hotX, o.hotY = update.HotX, update.HotY
+		o.shape = true
+	}
+	show := o.visible && o.shape
+	o.Unlock()
+
+	if show {
+		o.cursor.Show()
+	} else {
+		o.cursor.Hide()
+	}
+	o.container.Resize(o.container.Size())
+}
+
+func (o *CursorOverlay) Refresh(c fyne.Canvas) {
+	c.Refresh(o.container)
+}
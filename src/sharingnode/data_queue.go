@@ -1,27 +1,115 @@
 package sharingnode
 
 import (
+	"bytes"
 	"encoding/binary"
+	"github.com/pkg/errors"
+	"hash/crc32"
 	"io"
 	"sync"
+	"sync/atomic"
 )
 
+const (
+	// LegacyFormat is a count of packets, their sizes and the payloads without any metadata
+	LegacyFormat = 0
+	// FramedFormat starts with the magic and the version and every packet has a header
+	FramedFormat = 1
+)
+
+// SupportedFormats are offered to the viewer in order of preference
+var SupportedFormats = []int{FramedFormat, LegacyFormat}
+
+var framedMagic = []byte("DSHR")
+
+const (
+	preambleSize     = 8
+	packetHeaderSize = 16
+	crcSize          = 4
+	preambleFlagCRC  = 1 << 0
+)
+
+// DataFormat describes the wire format of the data stream. The zero value is the legacy format
+type DataFormat struct {
+	Version int  `json:"version"`
+	CRC     bool `json:"crc"`
+}
+
+// SelectFormat returns the newest format offered by the host. Old hosts don't offer anything
+func SelectFormat(offered []int, crc bool) DataFormat {
+	for _, supported := range SupportedFormats {
+		for _, version := range offered {
+			if version == supported {
+				return DataFormat{
+					Version: version,
+					CRC:     crc && version != LegacyFormat,
+				}
+			}
+		}
+	}
+
+	return DataFormat{}
+}
+
+func formatSupported(version int) bool {
+	for _, supported := range SupportedFormats {
+		if version == supported {
+			return true
+		}
+	}
+	return false
+}
+
+type PacketType uint8
+
+const (
+	PacketVideo PacketType = iota + 1
+	PacketAudio
+	PacketCursor
+	PacketControl
+)
+
+type PacketFlags uint8
+
+const (
+	PacketFlagKey PacketFlags = 1 << iota
+)
+
+// Packet is a unit of the data stream. The legacy format carries only Data, such packets are read as video
+type Packet struct {
+	Type  PacketType
+	Flags PacketFlags
+	// PTS is the host time in microseconds, audio and video share it
+	PTS  int64
+	Data []byte
+}
+
+func (p *Packet) Key() bool {
+	return p.Flags&PacketFlagKey != 0
+}
+
 type DataWriter struct {
 	sync.Mutex
-	sizes  []int
-	data   []byte
-	writer io.Writer
-	signal chan struct{}
-	Error  chan error
+	format   DataFormat
+	packets  []*Packet
+	writer   io.Writer
+	signal   chan struct{}
+	preamble bool
+	Error    chan error
 }
 
 func NewDataWriter(writer io.Writer) *DataWriter {
+	return NewDataWriterFormat(writer, DataFormat{})
+}
+
+func NewDataWriterFormat(writer io.Writer, format DataFormat) *DataWriter {
 	data := &DataWriter{
-		sizes:  make([]int, 0),
-		data:   make([]byte, 0),
-		writer: writer,
-		signal: make(chan struct{}, 1),
-		Error:  make(chan error, 1),
+		format:   format,
+		packets:  make([]*Packet, 0),
+		writer:   writer,
+		signal:   make(chan struct{}, 1),
+		preamble: format.Version != LegacyFormat,
+		Error:    make(chan error, 1),
 	}
 
 	go data.write()
@@ -29,42 +117,103 @@ func NewDataWriter(writer io.Writer) *DataWriter {
 	return data
 }
 
+func (q *DataWriter) Format() DataFormat {
+	return q.format
+}
+
 func (q *DataWriter) AddData(data []byte) {
+	q.AddPacket(&Packet{
+		Type: PacketVideo,
+		Data: data,
+	})
+}
+
+func (q *DataWriter) AddPacket(packet *Packet) {
 	select {
 	case q.signal <- struct{}{}:
 	default:
 	}
 
-	if len(data) == 0 {
+	if len(packet.Data) == 0 {
 		return
 	}
 
 	q.Lock()
-	q.sizes = append(q.sizes, len(data))
-	q.data = append(q.data, data...)
+	q.packets = append(q.packets, packet)
 	q.Unlock()
 }
 
+func (q *DataWriter) marshalLegacy(packets []*Packet) []byte {
+	size := 4 + len(packets)*4
+	for _, p := range packets {
+		size += len(p.Data)
+	}
+
+	tmp := make([]byte, size)
+	binary.LittleEndian.PutUint32(tmp[:4], uint32(len(packets)))
+	offset := 4
+	for _, p := range packets {
+		binary.LittleEndian.PutUint32(tmp[offset:offset+4], uint32(len(p.Data)))
+		offset += 4
+	}
+	for _, p := range packets {
+		offset += copy(tmp[offset:], p.Data)
+	}
+
+	return tmp
+}
+
+func (q *DataWriter) marshalFramed(packets []*Packet) []byte {
+	var buf bytes.Buffer
+	if q.preamble {
+		preamble := make([]byte, preambleSize)
+		copy(preamble, framedMagic)
+		binary.LittleEndian.PutUint16(preamble[4:6], uint16(q.format.Version))
+		if q.format.CRC {
+			binary.LittleEndian.PutUint16(preamble[6:8], preambleFlagCRC)
+		}
+		buf.Write(preamble)
+		q.preamble = false
+	}
+
+	header := make([]byte, packetHeaderSize+crcSize)
+	for _, p := range packets {
+		header[0] = byte(p.Type)
+		header[1] = byte(p.Flags)
+		binary.LittleEndian.PutUint16(header[2:4], 0)
+		binary.LittleEndian.PutUint32(header[4:8], uint32(len(p.Data)))
+		binary.LittleEndian.PutUint64(header[8:16], uint64(p.PTS))
+		if q.format.CRC {
+			binary.LittleEndian.PutUint32(header[16:20], crc32.ChecksumIEEE(p.Data))
+			buf.Write(header)
+		} else {
+			buf.Write(header[:packetHeaderSize])
+		}
+		buf.Write(p.Data)
+	}
+
+	return buf.Bytes()
+}
+
 func (q *DataWriter) write() {
 	for {
 		<-q.signal
 
 	Repeat:
 		q.Lock()
-		if len(q.sizes) == 0 {
+		if len(q.packets) == 0 {
 			q.Unlock()
 			continue
 		}
 
-		tmp := make([]byte, 4+len(q.sizes)*4+len(q.data))
-		binary.LittleEndian.PutUint32(tmp[:4], uint32(len(q.sizes)))
-
-		for i, _ := range q.sizes {
-			binary.LittleEndian.PutUint32(tmp[4*(i+1):4*(i+2)], uint32(q.sizes[i]))
+		packets := q.packets
+		q.packets = []*Packet{}
+		var tmp []byte
+		if q.format.Version == LegacyFormat {
+			tmp = q.marshalLegacy(packets)
+		} else {
+			tmp = q.marshalFramed(packets)
 		}
-		copy(tmp[4*(len(q.sizes)+1):], q.data)
-		q.sizes = []int{}
-		q.data = []byte{}
 		q.Unlock()
 
 		_, err := q.writer.Write(tmp)
@@ -78,15 +227,24 @@ func (q *DataWriter) write() {
 }
 
 type DataReader struct {
-	reader io.Reader
-	dataCh chan []byte
-	error  error
+	reader   io.Reader
+	format   DataFormat
+	limits   ReaderLimits
+	buffered int64
+	dataCh   chan *Packet
+	error    error
 }
 
 func NewDataReader(reader io.Reader) *DataReader {
+	return NewDataReaderFormat(reader, DataFormat{}, &DefaultReaderLimits)
+}
+
+func NewDataReaderFormat(reader io.Reader, format DataFormat, limits *ReaderLimits) *DataReader {
 	data := &DataReader{
 		reader: reader,
-		dataCh: make(chan []byte, 1024),
+		format: format,
+		limits: *limits,
+		dataCh: make(chan *Packet, 1024),
 	}
 
 	go data.read()
@@ -94,68 +252,162 @@ func NewDataReader(reader io.Reader) *DataReader {
 	return data
 }
 
+// GetData returns the payload of the next packet of any type
 func (q *DataReader) GetData() ([]byte, error) {
-	data, ok := <-q.dataCh
+	packet, err := q.GetPacket()
+	if err != nil {
+		return nil, err
+	}
+
+	return packet.Data, nil
+}
+
+func (q *DataReader) Format() DataFormat {
+	return q.format
+}
+
+func (q *DataReader) GetPacket() (*Packet, error) {
+	packet, ok := <-q.dataCh
 	if !ok {
 		return nil, q.error
 	}
+	atomic.AddInt64(&q.buffered, -int64(len(packet.Data)))
 
-	return data, nil
+	return packet, nil
 }
 
-func (q *DataReader) read() {
-	readData := func(data []byte) error {
-		done := 0
-		for done < len(data) {
-			n, err := q.reader.Read(data[done:])
-			if err != nil {
-				return err
-			}
-			done += n
-		}
-		return nil
+// reserve accounts the packet of the size before it is allocated
+func (q *DataReader) reserve(size int) error {
+	err := checkLimit("Packet size", size, q.limits.MaxPacketSize)
+	if err != nil {
+		return err
 	}
-	readInt := func() (int, error) {
-		v := make([]byte, 4)
-		err := readData(v)
+
+	buffered := atomic.AddInt64(&q.buffered, int64(size))
+	return checkLimit("Buffered size", int(buffered), q.limits.MaxBuffered)
+}
+
+func (q *DataReader) readData(data []byte) error {
+	_, err := io.ReadFull(q.reader, data)
+	return err
+}
+
+func (q *DataReader) readInt() (int, error) {
+	v := make([]byte, 4)
+	err := q.readData(v)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(binary.LittleEndian.Uint32(v)), nil
+}
+
+func (q *DataReader) readLegacy() error {
+	frames, err := q.readInt()
+	if err != nil {
+		return err
+	}
+	err = checkLimit("Packets in batch", frames, q.limits.MaxBatchPackets)
+	if err != nil {
+		return err
+	}
+
+	sizes := make([]int, frames)
+	for i := 0; i < frames; i++ {
+		sizes[i], err = q.readInt()
 		if err != nil {
-			return 0, err
+			return err
+		}
+		err = q.reserve(sizes[i])
+		if err != nil {
+			return err
 		}
-
-		return int(binary.LittleEndian.Uint32(v)), nil
 	}
 
-	for {
-		var sizes []int
-		frames, err := readInt()
+	for i := 0; i < len(sizes); i++ {
+		data := make([]byte, sizes[i])
+		err = q.readData(data)
 		if err != nil {
-			goto Error
+			return err
 		}
 
-		sizes = make([]int, frames)
-		for i := 0; i < frames; i++ {
-			dataLen, err := readInt()
-			if err != nil {
-				goto Error
-			}
-			sizes[i] = dataLen
+		q.dataCh <- &Packet{
+			Type: PacketVideo,
+			Data: data,
 		}
+	}
 
-		for i := 0; i < len(sizes); i++ {
-			data := make([]byte, sizes[i])
-			err = readData(data)
-			if err != nil {
-				goto Error
-			}
+	return nil
+}
 
-			q.dataCh <- data
-		}
+func (q *DataReader) readPreamble() error {
+	preamble := make([]byte, preambleSize)
+	err := q.readData(preamble)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(preamble[:4], framedMagic) {
+		return ErrBadMagic
+	}
+	version := int(binary.LittleEndian.Uint16(preamble[4:6]))
+	if version != q.format.Version {
+		return errors.Errorf("Unexpected data stream version %d", version)
+	}
+	q.format.CRC = binary.LittleEndian.Uint16(preamble[6:8])&preambleFlagCRC != 0
+
+	return nil
+}
+
+func (q *DataReader) readFramed() error {
+	header := make([]byte, packetHeaderSize+crcSize)
+	if !q.format.CRC {
+		header = header[:packetHeaderSize]
+	}
+	err := q.readData(header)
+	if err != nil {
+		return err
+	}
+
+	size := int(binary.LittleEndian.Uint32(header[4:8]))
+	err = q.reserve(size)
+	if err != nil {
+		return err
+	}
 
-		continue
-	Error:
+	packet := &Packet{
+		Type:  PacketType(header[0]),
+		Flags: PacketFlags(header[1]),
+		PTS:   int64(binary.LittleEndian.Uint64(header[8:16])),
+		Data:  make([]byte, size),
+	}
+	err = q.readData(packet.Data)
+	if err != nil {
+		return err
+	}
 
-		q.error = err
-		close(q.dataCh)
-		break
+	if q.format.CRC && crc32.ChecksumIEEE(packet.Data) != binary.LittleEndian.Uint32(header[16:20]) {
+		return ErrChecksum
 	}
+
+	q.dataCh <- packet
+	return nil
+}
+
+func (q *DataReader) read() {
+	var err error
+	if q.format.Version != LegacyFormat {
+		err = q.readPreamble()
+	}
+
+	for err == nil {
+		if q.format.Version == LegacyFormat {
+			err = q.readLegacy()
+		} else {
+			err = q.readFramed()
+		}
+	}
+
+	q.error = err
+	close(q.dataCh)
 }
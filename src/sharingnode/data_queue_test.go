@@ -0,0 +1,99 @@
+package sharingnode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// marshalPackets returns the stream which the writer sends in the format
+func marshalPackets(format DataFormat, packets []*Packet) []byte {
+	writer := &DataWriter{
+		format:   format,
+		preamble: format.Version != LegacyFormat,
+	}
+	if format.Version == LegacyFormat {
+		return writer.marshalLegacy(packets)
+	}
+	return writer.marshalFramed(packets)
+}
+
+func FuzzDataReader(f *testing.F) {
+	packets := []*Packet{
+		{Type: PacketVideo, Flags: PacketFlagKey, PTS: 1000, Data: []byte{0, 0, 0, 1, 0x65}},
+		{Type: PacketCursor, PTS: 2000, Data: []byte{1, 2, 3}},
+		{Type: PacketAudio, PTS: 3000, Data: []byte{4}},
+	}
+	for _, format := range []DataFormat{{}, {Version: FramedFormat}, {Version: FramedFormat, CRC: true}} {
+		f.Add(format.Version, marshalPackets(format, packets))
+	}
+
+	// Huge batches and packets must be rejected before they are allocated
+	huge := make([]byte, 8)
+	binary.LittleEndian.PutUint32(huge[0:4], 1)
+	binary.LittleEndian.PutUint32(huge[4:8], 0xffffffff)
+	f.Add(LegacyFormat, huge)
+	f.Add(LegacyFormat, []byte{0xff, 0xff, 0xff, 0xff})
+	header := make([]byte, packetHeaderSize)
+	binary.LittleEndian.PutUint32(header[4:8], 0xffffffff)
+	f.Add(FramedFormat, append([]byte("DSHR\x01\x00\x00\x00"), header...))
+	f.Add(FramedFormat, []byte("DSHR\x02\x00\x00\x00"))
+	f.Add(FramedFormat, []byte("XXXX\x01\x00\x00\x00"))
+
+	limits := ReaderLimits{
+		MaxPacketSize:   1 << 10,
+		MaxBatchPackets: 16,
+		MaxBuffered:     4 << 10,
+	}
+	f.Fuzz(func(t *testing.T, version int, data []byte) {
+		if !formatSupported(version) {
+			return
+		}
+
+		reader := NewDataReaderFormat(bytes.NewReader(data), DataFormat{Version: version}, &limits)
+		payload := 0
+		for {
+			packet, err := reader.GetPacket()
+			if err != nil {
+				break
+			}
+			if len(packet.Data) > limits.MaxPacketSize {
+				t.Fatalf("packet of %d bytes exceeds the limit", len(packet.Data))
+			}
+			payload += len(packet.Data)
+		}
+		if payload > len(data) {
+			t.Fatalf("read %d bytes of payload from %d bytes", payload, len(data))
+		}
+	})
+}
+
+func TestDataRoundTrip(t *testing.T) {
+	packets := []*Packet{
+		{Type: PacketVideo, Flags: PacketFlagKey, PTS: 1000, Data: []byte("key frame")},
+		{Type: PacketAudio, PTS: -20, Data: []byte("audio")},
+		{Type: PacketControl, PTS: 3000, Data: []byte("{}")},
+	}
+
+	for _, format := range []DataFormat{{Version: FramedFormat}, {Version: FramedFormat, CRC: true}} {
+		reader := NewDataReaderFormat(bytes.NewReader(marshalPackets(format, packets)), format, &DefaultReaderLimits)
+		for i, want := range packets {
+			got, err := reader.GetPacket()
+			if err != nil {
+				t.Fatalf("crc %v, packet %d: %v", format.CRC, i, err)
+			}
+			if got.Type != want.Type || got.Flags != want.Flags || got.PTS != want.PTS || !bytes.Equal(got.Data, want.Data) {
+				t.Errorf("crc %v: got %+v, want %+v", format.CRC, got, want)
+			}
+		}
+	}
+
+	// Broken payloads are detected with the checksum
+	format := DataFormat{Version: FramedFormat, CRC: true}
+	data := marshalPackets(format, packets[:1])
+	data[len(data)-1] ^= 0xff
+	_, err := NewDataReaderFormat(bytes.NewReader(data), format, &DefaultReaderLimits).GetPacket()
+	if err != ErrChecksum {
+		t.Errorf("got %v for the broken packet, want %v", err, ErrChecksum)
+	}
+}
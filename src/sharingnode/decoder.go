@@ -0,0 +1,253 @@
+package sharingnode
+
+// #include <stdlib.h>
+import "C"
+import (
+	"github.com/imkira/go-libav/avcodec"
+	"github.com/imkira/go-libav/avutil"
+	"github.com/imkira/go-libav/swscale"
+	"github.com/pkg/errors"
+	"image"
+	"strconv"
+)
+
+const defaultImagePool = 4
+
+var threadTypes = map[string]avcodec.ThreadType{
+	"none":        0,
+	"frame":       avcodec.ThreadTypeFrame,
+	"slice":       avcodec.ThreadTypeSlice,
+	"frame+slice": avcodec.ThreadTypeFrame | avcodec.ThreadTypeSlice,
+}
+
+// VideoDecoder decodes packets into images of its pool. Decoded frames are copied into the images,
+// so an image doesn't change until the pool wraps and never references memory of the decoder
+type VideoDecoder struct {
+	codec         *VideoCodec
+	codecContext  *avcodec.Context
+	parserContext *avcodec.ParserContext
+	packet        *avcodec.Packet
+	images        []*image.YCbCr
+	next          int
+	// scratch keeps frames of other formats converted to YUV420P
+	scratch    *avutil.Frame
+	swsContext *swscale.Context
+	swsFormat  avutil.PixelFormat
+	swsSize    DisplayInfo
+	algorithm  string
+}
+
+// NewVideoDecoder configures threading and the pool size from the options:
+// threads (0 is auto), thread_type (none, frame, slice or frame+slice) and frames.
+// Slice threading is the default, frame threading delays every frame by a frame per thread
+func NewVideoDecoder(videoCodec *VideoCodec, options map[string]string) (*VideoDecoder, error) {
+	decoder := &VideoDecoder{
+		codec:     videoCodec,
+		images:    make([]*image.YCbCr, defaultImagePool),
+		algorithm: options["algorithm"],
+	}
+
+	var err error
+	threadType := avcodec.ThreadTypeSlice
+	threads := 0
+	codec := videoCodec.FindDecoder()
+	if codec == nil {
+		err = &CodecError{Codec: videoCodec.Name}
+		goto Error
+	}
+
+	if v, ok := options["threads"]; ok && v != "" {
+		threads, err = strconv.Atoi(v)
+		if err != nil {
+			goto Error
+		}
+	}
+	if v, ok := options["thread_type"]; ok && v != "" {
+		threadType, ok = threadTypes[v]
+		if !ok {
+			err = errors.Errorf("Unknown thread type %s", v)
+			goto Error
+		}
+	}
+	if v, ok := options["frames"]; ok && v != "" {
+		frames, convErr := strconv.Atoi(v)
+		if convErr != nil || frames < 2 {
+			err = errors.Errorf("Wrong size of the image pool %s", v)
+			goto Error
+		}
+		decoder.images = make([]*image.YCbCr, frames)
+	}
+
+	decoder.codecContext, err = avcodec.NewContextWithCodec(codec)
+	if err != nil {
+		goto Error
+	}
+	decoder.codecContext.SetThreadCount(threads)
+	decoder.codecContext.SetThreadType(threadType)
+
+	err = decoder.codecContext.OpenWithCodec(codec, nil)
+	if err != nil {
+		goto Error
+	}
+
+	decoder.packet, err = avcodec.NewPacket()
+	if err != nil {
+		goto Error
+	}
+
+	decoder.scratch, err = avutil.NewFrame()
+	if err != nil {
+		goto Error
+	}
+
+	if videoCodec.Parse {
+		decoder.parserContext, err = avcodec.NewParserContext(decoder.codecContext)
+		if err != nil {
+			goto Error
+		}
+	}
+
+	return decoder, nil
+
+Error:
+	decoder.Close()
+	return nil, err
+}
+
+// nextImage returns the next image of the pool, images of another size are replaced
+func (d *VideoDecoder) nextImage(width, height int) *image.YCbCr {
+	img := d.images[d.next]
+	if img == nil || img.Rect.Dx() != width || img.Rect.Dy() != height {
+		img = image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
+		d.images[d.next] = img
+	}
+	d.next = (d.next + 1) % len(d.images)
+
+	return img
+}
+
+// convert converts the frame of another format to YUV420P in the scratch frame
+func (d *VideoDecoder) convert(f *avutil.Frame) (*avutil.Frame, error) {
+	size := DisplayInfo{f.Width(), f.Height()}
+	if d.swsContext == nil || d.swsFormat != f.PixelFormat() || d.swsSize != size {
+		if d.swsContext != nil {
+			d.swsContext.Free()
+		}
+		var err error
+		d.swsContext, err = newScaleContext(
+			&swscale.DataDescription{size.Width, size.Height, f.PixelFormat()},
+			&swscale.DataDescription{size.Width, size.Height, avutil.PIX_FMT_YUV420P},
+			d.algorithm,
+		)
+		if err != nil {
+			d.swsContext = nil
+			return nil, err
+		}
+		d.swsFormat, d.swsSize = f.PixelFormat(), size
+
+		d.scratch.Unref()
+		d.scratch.SetWidth(size.Width)
+		d.scratch.SetHeight(size.Height)
+		d.scratch.SetPixelFormat(avutil.PIX_FMT_YUV420P)
+		err = d.scratch.GetBuffer()
+		if err != nil {
+			d.swsContext.Free()
+			d.swsContext = nil
+			return nil, err
+		}
+	}
+	d.swsContext.Scale(f, 0, size.Height, d.scratch)
+
+	return d.scratch, nil
+}
+
+// keep copies the decoded frame into the image of the pool, rows are copied with line sizes of the frame
+func (d *VideoDecoder) keep(f *avutil.Frame) (*image.YCbCr, error) {
+	frame := f
+	if f.PixelFormat() != avutil.PIX_FMT_YUV420P {
+		var err error
+		frame, err = d.convert(f)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	width, height := frame.Width(), frame.Height()
+	img := d.nextImage(width, height)
+	copyFromPlane(img.Y, img.YStride, frame, 0, width, height)
+	copyFromPlane(img.Cb, img.CStride, frame, 1, (width+1)/2, (height+1)/2)
+	copyFromPlane(img.Cr, img.CStride, frame, 2, (width+1)/2, (height+1)/2)
+
+	return img, nil
+}
+
+// Decode decodes one packet of the stream and passes every decoded image to onImage
+func (d *VideoDecoder) Decode(data []byte, onImage func(*image.YCbCr) error) error {
+	onFrame := func(f *avutil.Frame) error {
+		img, err := d.keep(f)
+		if err != nil {
+			return err
+		}
+		return onImage(img)
+	}
+
+	dataSize := len(data)
+	for dataSize > 0 {
+		parse := d.parserContext != nil
+		if parse {
+			ret, err := d.parserContext.Parse(data, dataSize, d.packet)
+			if err != nil {
+				return err
+			}
+
+			data = data[ret:]
+			dataSize = dataSize - ret
+
+			if d.packet.Size() == 0 {
+				continue
+			}
+		} else {
+			d.packet.SetData(data)
+			d.packet.SetSize(dataSize)
+			dataSize = 0
+		}
+
+		_, err := d.codecContext.DecodeVideo(d.packet, onFrame)
+		if parse {
+			// The parser is needed only to initialize the decoder from the first packet
+			d.parserContext.Free()
+			d.parserContext = nil
+		} else {
+			C.free(d.packet.Data())
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *VideoDecoder) Close() {
+	if d.parserContext != nil {
+		d.parserContext.Free()
+		d.parserContext = nil
+	}
+	if d.codecContext != nil {
+		d.codecContext.Free()
+		d.codecContext = nil
+	}
+	if d.packet != nil {
+		d.packet.Free()
+		d.packet = nil
+	}
+	if d.scratch != nil {
+		d.scratch.Free()
+		d.scratch = nil
+	}
+	if d.swsContext != nil {
+		d.swsContext.Free()
+		d.swsContext = nil
+	}
+}
@@ -0,0 +1,85 @@
+package sharingnode
+
+import (
+	"image"
+	"testing"
+)
+
+func TestDecoderImages(t *testing.T) {
+	// The odd size makes line sizes of frames larger than strides of images
+	const width, height, packets = 90, 50, 6
+
+	codec := availableCodec(t)
+	encoded := encodeTestPattern(t, codec, width, height, packets)
+
+	decoder, err := NewVideoDecoder(codec, map[string]string{"threads": "1", "thread_type": "none", "frames": "8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var first, clone *image.YCbCr
+	for i, packet := range encoded {
+		err = decoder.Decode(packet.Data, func(img *image.YCbCr) error {
+			if img.Rect != image.Rect(0, 0, width, height) {
+				t.Errorf("packet %d is decoded with size %v", i, img.Rect)
+			}
+			if first == nil {
+				first, clone = img, cloneImage(img)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+	}
+	if first == nil {
+		t.Fatal("no frames decoded")
+	}
+	if diff := imageDiff(clone, testPatternImage(width, height, 0)); diff > 48 {
+		t.Errorf("the first frame differs by %d", diff)
+	}
+
+	// The pool doesn't wrap, so the image is unchanged and stays valid after the decoder is freed
+	decoder.Close()
+	if diff := imageDiff(first, clone); diff != 0 {
+		t.Errorf("the first image changed by %d", diff)
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	const width, height, packets = 640, 360, 60
+
+	for _, name := range []string{"h264", "vp8", "vp9"} {
+		codec, err := FindVideoCodec(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(name, func(b *testing.B) {
+			// Packets of the encoder are the ones the viewer receives
+			encoded := encodeTestPattern(b, codec, width, height, packets)
+			size := 0
+			for _, packet := range encoded {
+				size += len(packet.Data)
+			}
+
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				decoder, err := NewVideoDecoder(codec, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, packet := range encoded {
+					err = decoder.Decode(packet.Data, func(img *image.YCbCr) error {
+						return nil
+					})
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				decoder.Close()
+			}
+		})
+	}
+}
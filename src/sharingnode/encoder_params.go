@@ -0,0 +1,220 @@
+package sharingnode
+
+import (
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxFrameRate = 120
+	maxCRF       = 63
+)
+
+// RateControl is the bitrate mode of the encoder
+type RateControl string
+
+const (
+	// RateCRF keeps the constant quality without limits of the bitrate
+	RateCRF RateControl = "crf"
+	// RateVBV keeps the constant quality, but caps the bitrate with maxrate and bufsize
+	RateVBV RateControl = "vbv"
+	// RateCBR keeps the constant bitrate b
+	RateCBR RateControl = "cbr"
+	// RateLossless is used by lossless codecs which don't have rate control
+	RateLossless RateControl = "lossless"
+)
+
+// encoderKeys are stream options which are applied through EncoderParams instead of the codec options
+var encoderKeys = []string{"r", "rate_control", "b", "maxrate", "bufsize", "g", "threads"}
+
+// EncoderParams are typed encoder settings parsed from the stream options
+type EncoderParams struct {
+	FrameRate   int
+	RateControl RateControl
+	CRF         int
+	// BitRate, MaxRate and BufSize are in bits
+	BitRate int64
+	MaxRate int64
+	BufSize int64
+	// GOP is the distance between key frames in frames, 0 is the encoder default
+	GOP     int
+	Threads int
+}
+
+// parseBitRate parses bitrates like 750000, 750k or 1.5M
+func parseBitRate(value string) (int64, error) {
+	multiplier := 1.0
+	number := value
+	switch {
+	case strings.HasSuffix(value, "k"), strings.HasSuffix(value, "K"):
+		multiplier, number = 1e3, value[:len(value)-1]
+	case strings.HasSuffix(value, "M"):
+		multiplier, number = 1e6, value[:len(value)-1]
+	}
+
+	rate, err := strconv.ParseFloat(number, 64)
+	if err != nil || rate <= 0 {
+		return 0, errors.Errorf("Wrong bitrate %s", value)
+	}
+
+	return int64(rate * multiplier), nil
+}
+
+func optionalInt(options map[string]string, key string) (int, bool, error) {
+	value := options[key]
+	if value == "" {
+		return 0, false, nil
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false, errors.Errorf("Wrong %s %s", key, value)
+	}
+	return number, true, nil
+}
+
+func optionalBitRate(options map[string]string, key string) (int64, bool, error) {
+	value := options[key]
+	if value == "" {
+		return 0, false, nil
+	}
+
+	rate, err := parseBitRate(value)
+	if err != nil {
+		return 0, false, errors.Wrap(err, key)
+	}
+	return rate, true, nil
+}
+
+// ParseEncoderParams parses the stream options of the codec. The frame rate is taken from the
+// stream options and falls back to the grabbing options, both must agree when both are set.
+// Without rate_control the mode is guessed: cbr with b, vbv with maxrate or bufsize, crf otherwise
+func ParseEncoderParams(videoCodec *VideoCodec, stream map[string]string, grabbing map[string]string) (*EncoderParams, error) {
+	params := &EncoderParams{
+		FrameRate: defaultFrameRate,
+	}
+
+	rate, hasRate, err := optionalInt(stream, "r")
+	if err != nil {
+		return nil, err
+	}
+	grabRate, hasGrabRate, err := optionalInt(grabbing, "r")
+	if err != nil {
+		return nil, err
+	}
+	if hasRate && hasGrabRate && rate != grabRate {
+		return nil, errors.Errorf("Frame rate of the stream %d differs from the frame rate of grabbing %d", rate, grabRate)
+	}
+	if hasGrabRate {
+		params.FrameRate = grabRate
+	}
+	if hasRate {
+		params.FrameRate = rate
+	}
+	if params.FrameRate <= 0 || params.FrameRate > maxFrameRate {
+		return nil, errors.Errorf("Frame rate %d is out of range 1-%d", params.FrameRate, maxFrameRate)
+	}
+
+	var hasGOP, hasCRF, hasBitRate, hasMaxRate, hasBufSize bool
+	params.GOP, hasGOP, err = optionalInt(stream, "g")
+	if err != nil {
+		return nil, err
+	}
+	if hasGOP && params.GOP < 1 {
+		return nil, errors.Errorf("GOP length %d must be positive", params.GOP)
+	}
+
+	params.Threads, _, err = optionalInt(stream, "threads")
+	if err != nil {
+		return nil, err
+	}
+	if params.Threads < 0 {
+		return nil, errors.Errorf("Number of threads %d can't be negative", params.Threads)
+	}
+
+	if videoCodec.Lossless {
+		params.RateControl = RateLossless
+		return params, nil
+	}
+
+	params.CRF, hasCRF, err = optionalInt(stream, "crf")
+	if err != nil {
+		return nil, err
+	}
+	if hasCRF && (params.CRF < 0 || params.CRF > maxCRF) {
+		return nil, errors.Errorf("CRF %d is out of range 0-%d", params.CRF, maxCRF)
+	}
+	params.BitRate, hasBitRate, err = optionalBitRate(stream, "b")
+	if err != nil {
+		return nil, err
+	}
+	params.MaxRate, hasMaxRate, err = optionalBitRate(stream, "maxrate")
+	if err != nil {
+		return nil, err
+	}
+	params.BufSize, hasBufSize, err = optionalBitRate(stream, "bufsize")
+	if err != nil {
+		return nil, err
+	}
+
+	params.RateControl = RateControl(stream["rate_control"])
+	if params.RateControl == "" {
+		switch {
+		case hasBitRate:
+			params.RateControl = RateCBR
+		case hasMaxRate || hasBufSize:
+			params.RateControl = RateVBV
+		default:
+			params.RateControl = RateCRF
+		}
+	}
+
+	switch params.RateControl {
+	case RateCRF:
+		if hasBitRate || hasMaxRate || hasBufSize {
+			return nil, errors.New("crf rate control doesn't limit the bitrate, remove b, maxrate and bufsize or use vbv")
+		}
+	case RateVBV:
+		if hasBitRate {
+			return nil, errors.New("vbv rate control caps the quality mode, use maxrate instead of b or use cbr")
+		}
+		if !hasMaxRate || !hasBufSize {
+			return nil, errors.New("vbv rate control requires both maxrate and bufsize")
+		}
+	case RateCBR:
+		if hasCRF {
+			return nil, errors.New("cbr rate control can't be combined with crf, remove crf or use vbv")
+		}
+		if !hasBitRate {
+			return nil, errors.New("cbr rate control requires the bitrate b")
+		}
+		if hasMaxRate && params.MaxRate != params.BitRate {
+			return nil, errors.Errorf("cbr rate control requires maxrate equal to b %d", params.BitRate)
+		}
+		params.MaxRate = params.BitRate
+		if !hasBufSize {
+			params.BufSize = params.BitRate
+		}
+	default:
+		return nil, errors.Errorf("Unknown rate control %s, use crf, vbv or cbr", params.RateControl)
+	}
+	if params.RateControl != RateCRF && params.BufSize < params.MaxRate/int64(params.FrameRate) {
+		return nil, errors.Errorf("bufsize %d is smaller than one frame at maxrate %d", params.BufSize, params.MaxRate)
+	}
+
+	return params, nil
+}
+
+// CodecOptions returns codec private options without keys which are applied through the params
+func (p *EncoderParams) CodecOptions(videoCodec *VideoCodec, stream map[string]string) map[string]string {
+	options := videoCodec.EncoderOptions(stream)
+	for _, key := range encoderKeys {
+		delete(options, key)
+	}
+	if p.RateControl == RateCBR {
+		delete(options, "crf")
+	}
+
+	return options
+}
@@ -0,0 +1,33 @@
+package sharingnode
+
+import (
+	"fmt"
+)
+
+// CodecError is returned when the codec negotiated with the peer isn't available locally
+type CodecError struct {
+	Codec   string
+	Encoder bool
+}
+
+func (e *CodecError) Error() string {
+	if e.Encoder {
+		return fmt.Sprintf("Encoder for %s not found", e.Codec)
+	}
+	return fmt.Sprintf("Decoder for %s not found", e.Codec)
+}
+
+// DecodeError is returned when a packet of the stream can't be decoded.
+// The stream continues from the next key frame
+type DecodeError struct {
+	PTS int64
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("Can't decode packet at %dus: %v", e.PTS, e.Err)
+}
+
+func (e *DecodeError) Cause() error {
+	return e.Err
+}
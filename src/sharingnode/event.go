@@ -6,8 +6,8 @@ import (
 	"encoding/json"
 	"fyne.io/fyne"
 	"github.com/go-gl/glfw/v3.2/glfw"
-	"github.com/go-vgo/robotgo"
-	"math"
+	"github.com/pkg/errors"
+	"image"
 	"sync"
 	"time"
 )
@@ -23,89 +23,343 @@ const (
 	KeyDown
 	KeyRepeat
 	Scroll
+	RecordStart
+	RecordStop
+	KeyFrameRequest
+	ControlRequest
+	ControlRelease
+	TextInput
+	SelectDisplay
+	// Heartbeat is sent while the viewer holds keys or buttons, so the host doesn't release them
+	Heartbeat
 )
 
+// input tells whether the event is injected into the host
+func (t EventType) input() bool {
+	return t <= Scroll || t == TextInput
+}
+
 type Event struct {
 	Type EventType `json:"id"`
 
 	Key    glfw.Key         `json:"keycode"`
 	Button glfw.MouseButton `json:"button"`
+	// Mods is the state of modifiers before the event, Name is the key label in the viewer's layout
+	Mods     glfw.ModifierKey `json:"mods,omitempty"`
+	Scancode int              `json:"scancode,omitempty"`
+	Name     string           `json:"name,omitempty"`
+	// Text is typed by TextInput events
+	Text string `json:"text,omitempty"`
+	// Display is the index of the host display which SelectDisplay shares
+	Display int `json:"display,omitempty"`
 
 	X int `json:"x"`
 	Y int `json:"y"`
 
 	Xoff float64 `json:"xoff"`
 	Yoff float64 `json:"yoff"`
+
+	// Seq and Time are sent only in the binary format, Time is milliseconds since the sender start
+	Seq  uint32 `json:"-"`
+	Time uint32 `json:"-"`
+}
+
+// ControlGrant is the first line of the event stream, it tells whether the host accepts events
+type ControlGrant struct {
+	Allowed bool `json:"allowed"`
 }
 
+// eventBatchDelay is the time the sender collects events before writing them in one batch
+const eventBatchDelay = 20 * time.Millisecond
+
+// heartbeatInterval is the period of heartbeats, it is much shorter than DefaultHoldTimeout
+const heartbeatInterval = time.Second
+
+// maxQueuedEvents is the backlog of the sender after which moves and scrolls are merged into queued ones
+const maxQueuedEvents = 256
+
 type EventSender struct {
 	sync.Mutex
+	enabled          bool
 	writer           *bufio.Writer
+	format           int
+	text             bool
+	pressed          map[glfw.Key]bool
 	activeMouseClick bool
 	mousePos         fyne.Position
-	remoteWidth      int
-	remoteHeight     int
-	localWidth       int
-	localHeight      int
+	view             ViewMapping
+	started          time.Time
+	seq              uint32
 	queue            events
+	queued           chan struct{}
+	closed           bool
+}
+
+// NewEventSender starts the goroutine which writes events in order of sending in the negotiated format
+func NewEventSender(writer *bufio.Writer, remoteWidth, remoteHeight int, format int) *EventSender {
+	e := &EventSender{
+		enabled: true,
+		writer:  writer,
+		format:  format,
+		view:    ViewMapping{Remote: image.Pt(remoteWidth, remoteHeight)},
+		pressed: make(map[glfw.Key]bool),
+		started: time.Now(),
+		queued:  make(chan struct{}, 1),
+	}
+	go e.run()
+	go e.heartbeat()
+
+	return e
+}
+
+// SetEnabled drops input events while the host doesn't accept them
+func (e *EventSender) SetEnabled(enabled bool) {
+	e.Lock()
+	defer e.Unlock()
+	e.enabled = enabled
+}
+
+// SetTextInput sends characters as text events, so the host types them in any layout.
+// Hosts without text input receive only key events
+func (e *EventSender) SetTextInput(text bool) {
+	e.Lock()
+	defer e.Unlock()
+	e.text = text
+}
+
+// Close stops the sender after the queued events are written
+func (e *EventSender) Close() {
+	e.Lock()
+	defer e.Unlock()
+	e.closed = true
+	e.signal()
+}
+
+// signal wakes up the writer, it never blocks
+func (e *EventSender) signal() {
+	select {
+	case e.queued <- struct{}{}:
+	default:
+	}
+}
+
+// holding tells whether the viewer holds keys or buttons
+func (e *EventSender) holding() bool {
+	e.Lock()
+	defer e.Unlock()
+	if e.activeMouseClick {
+		return true
+	}
+	for _, down := range e.pressed {
+		if down {
+			return true
+		}
+	}
+	return false
 }
 
-func NewEventSender(writer *bufio.Writer, remoteWidth, remoteHeight int) *EventSender {
-	return &EventSender{
-		writer:       writer,
-		remoteWidth:  remoteWidth,
-		remoteHeight: remoteHeight,
+// heartbeat keeps input held on the host while the viewer holds it without sending events
+func (e *EventSender) heartbeat() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		e.Lock()
+		closed := e.closed
+		e.Unlock()
+		if closed {
+			return
+		}
+		if e.holding() {
+			e.sendEvent(&Event{Type: Heartbeat})
+		}
 	}
 }
 
 func (e *EventSender) sendEvent(ev *Event) {
+	e.sendEvents(ev)
+}
+
+// sendEvents queues the events one after another, so other input doesn't get between them.
+// It doesn't wait for the stream, so the window isn't frozen when the network is slow
+func (e *EventSender) sendEvents(evs ...*Event) {
 	e.Lock()
 	defer e.Unlock()
-	scaleX := float64(e.remoteWidth) / float64(e.localWidth)
-	scaleY := float64(e.remoteHeight) / float64(e.localHeight)
+	defer e.signal()
+	for _, ev := range evs {
+		if e.closed || (!e.enabled && ev.Type.input()) {
+			return
+		}
+		switch ev.Type {
+		case MouseMove, MouseDrag, MouseUp, MouseDown:
+			remote := e.view.ToRemote(float64(ev.X), float64(ev.Y))
+			ev.X, ev.Y = remote.X, remote.Y
+		}
 
-	ev.X = int(float64(ev.X) * scaleX)
-	ev.Y = int(float64(ev.Y) * scaleY)
+		ev.Time = uint32(time.Since(e.started) / time.Millisecond)
+		if len(e.queue) >= maxQueuedEvents && e.merge(ev) {
+			continue
+		}
+		e.seq++
+		ev.Seq = e.seq
+		e.queue = append(e.queue, ev)
+	}
+}
 
-	active := len(e.queue) > 0
+// merge replaces the stale move or scroll in the backlog by the event, the sender must be locked.
+// Only moves and scrolls after the last key, button or text are merged, so their order with input is kept.
+// Heartbeats are dropped, because the host doesn't receive the backlog in time anyway
+func (e *EventSender) merge(ev *Event) bool {
+	switch ev.Type {
+	case Heartbeat:
+		return true
+	case MouseMove, MouseDrag, Scroll:
+	default:
+		return false
+	}
 
-	e.queue = append(e.queue, ev)
+	for i := len(e.queue) - 1; i >= 0; i-- {
+		queued := e.queue[i]
+		switch queued.Type {
+		case MouseMove, MouseDrag, Scroll, Heartbeat:
+		default:
+			return false
+		}
+		if queued.Type != ev.Type || queued.Button != ev.Button {
+			continue
+		}
+
+		if ev.Type == Scroll {
+			queued.Xoff += ev.Xoff
+			queued.Yoff += ev.Yoff
+		} else {
+			queued.X, queued.Y = ev.X, ev.Y
+		}
+		queued.Time = ev.Time
+		return true
+	}
+	return false
+}
 
-	if !active {
-		go func() {
-			time.Sleep(20 * time.Millisecond)
+// SendMacro sends events of the macro, the text is typed by key events if the host doesn't support text input
+func (e *EventSender) SendMacro(macro Macro) error {
+	e.Lock()
+	enabled, text := e.enabled, e.text
+	e.Unlock()
+	if !enabled {
+		return errors.New("The remote node doesn't accept input now")
+	}
 
-			e.Lock()
-			temp := e.queue
-			e.queue = events{}
-			e.Unlock()
+	e.sendEvents(macro.events(text)...)
+	return nil
+}
 
-			b, err := json.Marshal(temp)
-			if err != nil {
-				logger.Error(err)
-				return
-			}
+// collect waits for the events of one batch, it returns false when the sender is closed and the queue is written
+func (e *EventSender) collect() (events, bool) {
+	for {
+		e.Lock()
+		empty, closed := len(e.queue) == 0, e.closed
+		e.Unlock()
+		if !empty {
+			break
+		}
+		if closed {
+			return nil, false
+		}
+		<-e.queued
+	}
 
-			b = append(b, '\n')
+	timeout := time.After(eventBatchDelay)
+	for !e.batchReady() {
+		select {
+		case <-e.queued:
+		case <-timeout:
+			return e.takeBatch(), true
+		}
+	}
+	return e.takeBatch(), true
+}
 
-			_, err = e.writer.Write(b)
-			if err != nil {
-				logger.Error(err)
-				return
-			}
+// batchReady tells whether the batch is written without waiting for more events
+func (e *EventSender) batchReady() bool {
+	e.Lock()
+	defer e.Unlock()
+	return e.closed || len(e.queue) >= DefaultReaderLimits.MaxEventBatch
+}
+
+// takeBatch removes the events of the next batch from the queue
+func (e *EventSender) takeBatch() events {
+	e.Lock()
+	defer e.Unlock()
+	size := len(e.queue)
+	if size > DefaultReaderLimits.MaxEventBatch {
+		size = DefaultReaderLimits.MaxEventBatch
+	}
+	batch := e.queue[:size:size]
+	e.queue = e.queue[size:]
+	return batch
+}
+
+// abort drops the queue of the broken stream, events aren't queued to it anymore
+func (e *EventSender) abort() {
+	e.Lock()
+	defer e.Unlock()
+	e.closed = true
+	e.queue = nil
+}
+
+func (e *EventSender) run() {
+	if e.format == EventFormatBinary {
+		err := writeEventPreamble(e.writer)
+		if err != nil {
+			logger.Error(err)
+			e.abort()
+			return
+		}
+	}
+
+	for {
+		batch, ok := e.collect()
+		if !ok {
+			return
+		}
+
+		b, err := encodeEvents(e.format, batch)
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
 
+		_, err = e.writer.Write(b)
+		if err == nil {
 			err = e.writer.Flush()
-			if err != nil {
-				logger.Error(err)
-				return
-			}
-		}()
+		}
+		if err != nil {
+			logger.Error(err)
+			e.abort()
+			return
+		}
 	}
 }
 
 func (e *EventSender) keyEvent(w *glfw.Window, key glfw.Key, scancode int, action glfw.Action, mods glfw.ModifierKey) {
+	e.Lock()
+	// Characters come from the char callback, keys pressed as shortcuts are released by key events
+	skip := e.text && typesText(key, mods) && !(action == glfw.Release && e.pressed[key])
+	if !skip {
+		e.pressed[key] = action != glfw.Release
+	}
+	e.Unlock()
+	if skip {
+		return
+	}
+
 	event := &Event{}
 	event.Key = key
+	event.Mods = mods
+	event.Scancode = scancode
+	if printableKey(key) {
+		event.Name = glfw.GetKeyName(key, scancode)
+	}
 
 	switch action {
 	case glfw.Press:
@@ -119,6 +373,26 @@ func (e *EventSender) keyEvent(w *glfw.Window, key glfw.Key, scancode int, actio
 	e.sendEvent(event)
 }
 
+func (e *EventSender) charEvent(w *glfw.Window, char rune, mods glfw.ModifierKey) {
+	event := &Event{}
+	event.Type = TextInput
+	event.Mods = mods
+	event.Text = string(char)
+
+	e.sendEvent(event)
+}
+
+// TypeText types the text on the host
+func (e *EventSender) TypeText(text string) {
+	for _, part := range splitText(text, maxTextSize) {
+		event := &Event{}
+		event.Type = TextInput
+		event.Text = part
+
+		e.sendEvent(event)
+	}
+}
+
 func (e *EventSender) mouseMoveEvent(w *glfw.Window, xpos float64, ypos float64) {
 	e.mousePos.X = int(xpos)
 	e.mousePos.Y = int(ypos)
@@ -127,7 +401,10 @@ func (e *EventSender) mouseMoveEvent(w *glfw.Window, xpos float64, ypos float64)
 	event.X = e.mousePos.X
 	event.Y = e.mousePos.Y
 
-	switch e.activeMouseClick {
+	e.Lock()
+	drag := e.activeMouseClick
+	e.Unlock()
+	switch drag {
 	case true:
 		event.Type = MouseDrag
 	case false:
@@ -143,6 +420,7 @@ func (e *EventSender) mouseClick(w *glfw.Window, button glfw.MouseButton, action
 	event.Y = e.mousePos.Y
 	event.Button = button
 
+	e.Lock()
 	switch action {
 	case glfw.Press:
 		event.Type = MouseDown
@@ -151,6 +429,7 @@ func (e *EventSender) mouseClick(w *glfw.Window, button glfw.MouseButton, action
 		event.Type = MouseUp
 		e.activeMouseClick = false
 	}
+	e.Unlock()
 
 	e.sendEvent(event)
 }
@@ -164,93 +443,380 @@ func (e *EventSender) scrollEvent(w *glfw.Window, xoff float64, yoff float64) {
 	e.sendEvent(event)
 }
 
+// SendRecording notifies the host that the viewer started or stopped recording
+func (e *EventSender) SendRecording(recording bool) {
+	event := &Event{}
+	event.Type = RecordStop
+	if recording {
+		event.Type = RecordStart
+	}
+
+	e.sendEvent(event)
+}
+
+// SelectDisplay tells the host which of its displays is shared, mouse positions are on this display
+func (e *EventSender) SelectDisplay(display int) {
+	event := &Event{}
+	event.Type = SelectDisplay
+	event.Display = display
+
+	e.sendEvent(event)
+}
+
+// RequestKeyFrame asks the host to encode the next frame as a key frame
+func (e *EventSender) RequestKeyFrame() {
+	event := &Event{}
+	event.Type = KeyFrameRequest
+
+	e.sendEvent(event)
+}
+
+// RequestControl asks the host for the input token, ReleaseControl gives it back
+func (e *EventSender) RequestControl() {
+	event := &Event{}
+	event.Type = ControlRequest
+
+	e.sendEvent(event)
+}
+
+func (e *EventSender) ReleaseControl() {
+	event := &Event{}
+	event.Type = ControlRelease
+
+	e.sendEvent(event)
+}
+
 func (e *EventSender) Subscribe(win fyne.Window) {
 	win.Viewport().SetCursorPosCallback(e.mouseMoveEvent)
 	win.Viewport().SetMouseButtonCallback(e.mouseClick)
 	win.Viewport().SetScrollCallback(e.scrollEvent)
 	win.Viewport().SetKeyCallback(e.keyEvent)
+	e.Lock()
+	if e.text {
+		win.Viewport().SetCharModsCallback(e.charEvent)
+	}
+	e.view.Window = image.Pt(win.Viewport().GetSize())
+	e.Unlock()
 	var superSizeCallback glfw.SizeCallback
 	superSizeCallback = win.Viewport().SetSizeCallback(func(w *glfw.Window, width int, height int) {
 		e.Lock()
 		defer e.Unlock()
 		superSizeCallback(w, width, height)
-		e.localWidth = width
-		e.localHeight = height
+		e.view.Window = image.Pt(width, height)
 	})
 }
 
 type EventReceiver struct {
 	sync.Mutex
-	reader  *bufio.Reader
-	offsetX int
+	reader   *bufio.Reader
+	displays []image.Rectangle
+	desktop  DesktopMapping
+	limits   ReaderLimits
+	format   int
+	detected bool
+	backend  InputBackend
+	state    *inputState
+	// HoldTimeout releases held keys and buttons when the viewer is silent, zero disables it
+	HoldTimeout time.Duration
+	// ScrollScale multiplies scroll offsets of the viewer
+	ScrollScale float64
+	// clicks is used only by the goroutine of Run
+	clicks clickTiming
+	// Sequence counts gaps and reorders of the binary format
+	Sequence    SequenceStats
+	OnRecording func(bool)
+	OnKeyFrame  func()
+	OnControl   func(request bool)
+	// Allowed filters input events, the viewer without the input token is ignored
+	Allowed func() bool
+	// Filter drops events which the viewer isn't allowed to send, nil allows everything
+	Filter *InputFilter
+	// Local suspends injection while the host user is active, nil never suspends it
+	Local *LocalActivity
 }
 
-func NewEventReceiver(reader *bufio.Reader, offsetX int) *EventReceiver {
+// NewEventReceiver maps mouse positions to the first of displays until the viewer selects another one
+func NewEventReceiver(reader *bufio.Reader, displays []image.Rectangle, limits *ReaderLimits, backend InputBackend) *EventReceiver {
+	desktop, _ := NewDesktopMapping(displays, 0)
 	return &EventReceiver{
-		reader:  reader,
-		offsetX: offsetX,
+		reader:      reader,
+		displays:    displays,
+		desktop:     desktop,
+		limits:      *limits,
+		backend:     backend,
+		state:       newInputState(),
+		HoldTimeout: DefaultHoldTimeout,
+		ScrollScale: 1,
 	}
 }
 
 type events []*Event
 
-func (e *EventReceiver) receiveEvent() (events, error) {
-	b, err := e.reader.ReadBytes('\n')
+// readLine reads one line without growing the buffer over the limit
+func readLine(reader *bufio.Reader, limit int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > limit {
+			return nil, &LimitError{
+				Limit: "Event line size",
+				Value: len(line) + len(chunk),
+				Max:   limit,
+			}
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		return line, err
+	}
+}
+
+// DecodeEvents parses one batch of events received from the viewer
+func DecodeEvents(data []byte, limits *ReaderLimits) (events, error) {
+	ev := events{}
+	err := json.Unmarshal(data, &ev)
 	if err != nil {
 		return nil, err
 	}
 
-	ev := &events{}
-
-	err = json.Unmarshal(b, ev)
+	err = checkLimit("Events in batch", len(ev), limits.MaxEventBatch)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, event := range *ev {
-		event.X = event.X + int(e.offsetX)
+	for _, event := range ev {
+		if event == nil {
+			return nil, errors.New("Empty event")
+		}
+	}
+
+	return ev, nil
+}
+
+// readBinary reads the next record which keeps the order of the sender
+func (e *EventReceiver) readBinary() (events, error) {
+	for {
+		ev, err := readEvent(e.reader)
+		if err != nil {
+			return nil, err
+		}
+
+		gaps := e.Sequence.Gaps
+		if !e.Sequence.check(ev.Seq) {
+			logger.Warningf("Dropped reordered event %d of type %d", ev.Seq, ev.Type)
+			continue
+		}
+		if e.Sequence.Gaps != gaps {
+			logger.Warningf("Missed %d events before %d", e.Sequence.Gaps-gaps, ev.Seq)
+		}
+
+		return events{ev}, nil
+	}
+}
+
+func (e *EventReceiver) receiveEvent() (events, error) {
+	if !e.detected {
+		format, err := detectEventFormat(e.reader)
+		if err != nil {
+			return nil, err
+		}
+		e.format = format
+		e.detected = true
+	}
+
+	var ev events
+	if e.format == EventFormatBinary {
+		var err error
+		ev, err = e.readBinary()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		b, err := readLine(e.reader, e.limits.MaxEventLine)
+		if err != nil {
+			return nil, err
+		}
+
+		ev, err = DecodeEvents(b, &e.limits)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ev, nil
+}
+
+// releaseStale releases modifiers which are released on the viewer, their events can be lost
+// when the viewer window loses focus
+func (e *EventReceiver) releaseStale(ev *Event) {
+	for key, name := range e.state.stale(ev.Mods, ev.Key) {
+		e.state.release(key)
+		e.backend.KeyToggle(name, false)
+	}
+}
+
+// ControlChanged releases input of the viewer when it loses the token or the host user is active
+func (e *EventReceiver) ControlChanged(state *ControlState) {
+	if !state.You || state.Paused {
+		e.ReleaseAll()
+	}
+}
+
+// ReleaseAll releases keys and buttons held by the viewer. It is called when the viewer
+// disconnects, is silent for HoldTimeout or loses control
+func (e *EventReceiver) ReleaseAll() {
+	e.Lock()
+	defer e.Unlock()
+	held := e.state.held()
+	if held == 0 {
+		return
+	}
+	logger.Infof("Releasing %d held keys and buttons", held)
+	e.state.releaseAll(e.backend)
+}
+
+func (e *EventReceiver) selectDisplay(display int) {
+	e.Lock()
+	defer e.Unlock()
+	desktop, err := NewDesktopMapping(e.displays, display)
+	if err != nil {
+		logger.Warning(err)
+		return
+	}
+	e.desktop = desktop
+}
+
+// injected tells the local activity detector about the move of the viewer
+func (e *EventReceiver) injected(position image.Point) {
+	if e.Local != nil {
+		e.Local.Injected(position)
+	}
+}
+
+// inject applies the input event to the host
+func (e *EventReceiver) inject(ev *Event) {
+	// Clicks keep the viewer's intervals, so double clicks aren't split or merged by batching.
+	// The receiver isn't locked while it waits, so held input can be released meanwhile
+	if _, ok := MouseMap[ev.Button]; ok && (ev.Type == MouseDown || ev.Type == MouseUp) {
+		e.clicks.wait(ev.Time)
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	if e.Allowed != nil && !e.Allowed() {
+		return
+	}
+	if e.Filter != nil && !e.Filter.Allow(ev, ev.Mods|e.state.mods()) {
+		return
+	}
+	if e.Local != nil && e.Local.Paused() {
+		return
 	}
 
-	return *ev, nil
+	switch ev.Type {
+	case MouseMove:
+		position := e.desktop.ToDesktop(ev.X, ev.Y)
+		e.injected(position)
+		e.backend.MoveMouse(position.X, position.Y)
+	case MouseDrag:
+		position := e.desktop.ToDesktop(ev.X, ev.Y)
+		e.injected(position)
+		button := e.state.dragButton()
+		if button == "" {
+			e.backend.MoveMouse(position.X, position.Y)
+			return
+		}
+		e.backend.DragMouse(position.X, position.Y, button)
+	case MouseDown, MouseUp:
+		button, ok := MouseMap[ev.Button]
+		if !ok {
+			return
+		}
+		if ev.Type == MouseDown {
+			e.state.buttons[ev.Button] = button
+		} else {
+			delete(e.state.buttons, ev.Button)
+		}
+		e.backend.MouseToggle(button, ev.Type == MouseDown)
+	case Scroll:
+		e.backend.Scroll(ev.Xoff*e.ScrollScale, ev.Yoff*e.ScrollScale)
+	case KeyDown, KeyRepeat:
+		e.releaseStale(ev)
+		key := hostKey(ev)
+		if key == "" {
+			return
+		}
+		e.state.press(ev.Key, key)
+		e.backend.KeyToggle(key, true)
+	case KeyUp:
+		// The key is released by the name it was pressed with
+		key, ok := e.state.pressed[ev.Key]
+		if !ok {
+			key = hostKey(ev)
+		}
+		e.state.release(ev.Key)
+		e.releaseStale(ev)
+		if key == "" {
+			return
+		}
+		e.backend.KeyToggle(key, false)
+	case TextInput:
+		e.releaseStale(ev)
+		e.backend.TypeText(ev.Text)
+	}
 }
 
 func (e *EventReceiver) Run() {
-	robotgo.SetMouseDelay(0)
-	robotgo.SetKeyboardDelay(0)
-	robotgo.SetKeyDelay(0)
+	defer e.ReleaseAll()
+	var timeout *time.Timer
+	if e.HoldTimeout > 0 {
+		timeout = time.AfterFunc(e.HoldTimeout, e.ReleaseAll)
+		defer timeout.Stop()
+	}
+
 	for {
 		evs, err := e.receiveEvent()
 		if err != nil {
 			logger.Error(err)
+			if e.format == EventFormatBinary {
+				logger.Infof("Events received: %d, missed: %d, reordered: %d",
+					e.Sequence.Received, e.Sequence.Gaps, e.Sequence.Reordered)
+			}
+			if e.Filter != nil {
+				for reason, count := range e.Filter.Dropped() {
+					logger.Infof("Events dropped by %s filter: %d", reason, count)
+				}
+			}
 			return
 		}
 
+		if timeout != nil {
+			timeout.Reset(e.HoldTimeout)
+		}
+
 		now := time.Now()
 		for _, ev := range evs {
+			if ev.Type.input() {
+				e.inject(ev)
+				continue
+			}
 			switch ev.Type {
-			case MouseMove:
-				robotgo.MoveMouse(int(ev.X), int(ev.Y))
-			case MouseDown:
-				robotgo.MouseToggle("down", MouseMap[ev.Button])
-			case MouseUp:
-				robotgo.MouseToggle("up", MouseMap[ev.Button])
-			case MouseDrag:
-				robotgo.MoveMouse(int(ev.X), int(ev.Y))
-			case Scroll:
-				direction := "up"
-				if ev.Yoff < 0 {
-					direction = "down"
+			case RecordStart, RecordStop:
+				if e.OnRecording != nil {
+					e.OnRecording(ev.Type == RecordStart)
+				}
+			case SelectDisplay:
+				e.selectDisplay(ev.Display)
+			case KeyFrameRequest:
+				if e.OnKeyFrame != nil {
+					e.OnKeyFrame()
+				}
+			case ControlRequest, ControlRelease:
+				if e.OnControl != nil {
+					e.OnControl(ev.Type == ControlRequest)
 				}
-				robotgo.ScrollMouse(int(math.Abs(ev.Yoff)*float64(2)), direction)
-			case KeyDown:
-				key := KeyToString[ev.Key]
-				robotgo.KeyToggle(key, "down")
-			case KeyUp:
-				key := KeyToString[ev.Key]
-				robotgo.KeyToggle(key, "up")
-			case KeyRepeat:
-			default:
-				continue
 			}
 		}
 		logger.Debug("Event processed for ", time.Now().Sub(now))
@@ -0,0 +1,251 @@
+package sharingnode
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/go-gl/glfw/v3.2/glfw"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+)
+
+const (
+	// EventFormatJSON is the newline delimited JSON batches of old viewers
+	EventFormatJSON = iota
+	// EventFormatBinary is the sequenced binary records
+	EventFormatBinary
+)
+
+// SupportedEventFormats are offered by the host in ScreenInfo
+var SupportedEventFormats = []int{EventFormatJSON, EventFormatBinary}
+
+var eventMagic = [4]byte{'D', 'S', 'E', 'V'}
+
+const eventPreambleSize = 8
+
+// eventHeaderSize is seq(4) time(4) type(1) payload length(1)
+const eventHeaderSize = 10
+
+// SelectEventFormat picks the binary format when the host offers it
+func SelectEventFormat(offered []int) int {
+	for _, format := range offered {
+		if format == EventFormatBinary {
+			return EventFormatBinary
+		}
+	}
+	return EventFormatJSON
+}
+
+// writeEventPreamble starts the binary event stream, JSON streams don't have a preamble
+func writeEventPreamble(w io.Writer) error {
+	preamble := make([]byte, eventPreambleSize)
+	copy(preamble, eventMagic[:])
+	binary.LittleEndian.PutUint16(preamble[4:6], EventFormatBinary)
+	_, err := w.Write(preamble)
+	return err
+}
+
+// detectEventFormat tells the format of the event stream by its first bytes
+func detectEventFormat(reader *bufio.Reader) (int, error) {
+	magic, err := reader.Peek(len(eventMagic))
+	if err != nil {
+		return 0, err
+	}
+	if string(magic) != string(eventMagic[:]) {
+		return EventFormatJSON, nil
+	}
+
+	preamble := make([]byte, eventPreambleSize)
+	_, err = io.ReadFull(reader, preamble)
+	if err != nil {
+		return 0, err
+	}
+	version := int(binary.LittleEndian.Uint16(preamble[4:6]))
+	if version != EventFormatBinary {
+		return 0, errors.Errorf("Unsupported event format %d", version)
+	}
+
+	return version, nil
+}
+
+// eventPayload encodes fields which are used by the event type
+func eventPayload(ev *Event) []byte {
+	switch ev.Type {
+	case MouseMove, MouseDrag, MouseUp, MouseDown:
+		payload := make([]byte, 9)
+		binary.LittleEndian.PutUint32(payload[0:4], uint32(int32(ev.X)))
+		binary.LittleEndian.PutUint32(payload[4:8], uint32(int32(ev.Y)))
+		payload[8] = byte(ev.Button)
+		return payload
+	case KeyUp, KeyDown, KeyRepeat:
+		payload := make([]byte, 7, 7+len(ev.Name))
+		binary.LittleEndian.PutUint16(payload[0:2], uint16(int16(ev.Key)))
+		payload[2] = byte(ev.Mods)
+		binary.LittleEndian.PutUint32(payload[3:7], uint32(int32(ev.Scancode)))
+		return append(payload, ev.Name...)
+	case TextInput:
+		return append([]byte{byte(ev.Mods)}, ev.Text...)
+	case SelectDisplay:
+		// Old hosts read the first byte, it is the index of little endian
+		payload := make([]byte, 4)
+		binary.LittleEndian.PutUint32(payload, uint32(int32(ev.Display)))
+		return payload
+	case Scroll:
+		payload := make([]byte, 16)
+		binary.LittleEndian.PutUint64(payload[0:8], math.Float64bits(ev.Xoff))
+		binary.LittleEndian.PutUint64(payload[8:16], math.Float64bits(ev.Yoff))
+		return payload
+	}
+	return nil
+}
+
+// AppendEvent appends the binary record of the event, the payload must fit the record
+func AppendEvent(buf []byte, ev *Event) ([]byte, error) {
+	payload := eventPayload(ev)
+	if len(payload) > math.MaxUint8 {
+		return buf, errors.Errorf("Payload of event %d is %d bytes, the limit is %d", ev.Type, len(payload), math.MaxUint8)
+	}
+	header := make([]byte, eventHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], ev.Seq)
+	binary.LittleEndian.PutUint32(header[4:8], ev.Time)
+	header[8] = byte(ev.Type)
+	header[9] = byte(len(payload))
+
+	return append(append(buf, header...), payload...), nil
+}
+
+// DecodeEvent parses one binary record and returns its size. Payloads longer than known
+// are accepted, so new fields can be appended without breaking old hosts
+func DecodeEvent(data []byte) (*Event, int, error) {
+	if len(data) < eventHeaderSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	size := eventHeaderSize + int(data[9])
+	if len(data) < size {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	ev := &Event{
+		Seq:  binary.LittleEndian.Uint32(data[0:4]),
+		Time: binary.LittleEndian.Uint32(data[4:8]),
+		Type: EventType(data[8]),
+	}
+	payload := data[eventHeaderSize:size]
+
+	short := errors.Errorf("Short payload of event %d", ev.Type)
+	switch ev.Type {
+	case MouseMove, MouseDrag, MouseUp, MouseDown:
+		if len(payload) < 9 {
+			return nil, 0, short
+		}
+		ev.X = int(int32(binary.LittleEndian.Uint32(payload[0:4])))
+		ev.Y = int(int32(binary.LittleEndian.Uint32(payload[4:8])))
+		ev.Button = glfw.MouseButton(payload[8])
+	case KeyUp, KeyDown, KeyRepeat:
+		if len(payload) < 2 {
+			return nil, 0, short
+		}
+		ev.Key = glfw.Key(int16(binary.LittleEndian.Uint16(payload[0:2])))
+		// Modifiers, the scancode and the name are added later
+		if len(payload) >= 7 {
+			ev.Mods = glfw.ModifierKey(payload[2])
+			ev.Scancode = int(int32(binary.LittleEndian.Uint32(payload[3:7])))
+			ev.Name = string(payload[7:])
+		}
+	case TextInput:
+		if len(payload) < 1 {
+			return nil, 0, short
+		}
+		ev.Mods = glfw.ModifierKey(payload[0])
+		ev.Text = string(payload[1:])
+	case SelectDisplay:
+		if len(payload) < 4 {
+			return nil, 0, short
+		}
+		ev.Display = int(int32(binary.LittleEndian.Uint32(payload[0:4])))
+	case Scroll:
+		if len(payload) < 16 {
+			return nil, 0, short
+		}
+		ev.Xoff = math.Float64frombits(binary.LittleEndian.Uint64(payload[0:8]))
+		ev.Yoff = math.Float64frombits(binary.LittleEndian.Uint64(payload[8:16]))
+	}
+
+	return ev, size, nil
+}
+
+// readEvent reads one binary record from the stream
+func readEvent(reader *bufio.Reader) (*Event, error) {
+	header := make([]byte, eventHeaderSize)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+
+	record := make([]byte, eventHeaderSize+int(header[9]))
+	copy(record, header)
+	_, err = io.ReadFull(reader, record[eventHeaderSize:])
+	if err != nil {
+		return nil, err
+	}
+
+	ev, _, err := DecodeEvent(record)
+	return ev, err
+}
+
+// encodeEvents encodes one batch of events in the format
+func encodeEvents(format int, batch events) ([]byte, error) {
+	if format == EventFormatBinary {
+		var buf []byte
+		for _, ev := range batch {
+			var err error
+			buf, err = AppendEvent(buf, ev)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+
+	b, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// SequenceStats counts broken ordering of the received events. The stream keeps the order of
+// its bytes, so gaps and reorders come only from the sender, like the batches which racing
+// goroutines wrote before the binary format. They are counted to show such bugs in the log
+type SequenceStats struct {
+	Received uint64
+	// Gaps counts the missed events
+	Gaps uint64
+	// Reordered counts events which came after newer ones, they are dropped
+	Reordered uint64
+	last      uint32
+	started   bool
+}
+
+// check tells whether the event must be applied
+func (s *SequenceStats) check(seq uint32) bool {
+	s.Received++
+	if !s.started {
+		s.started = true
+		s.last = seq
+		return true
+	}
+
+	diff := int32(seq - s.last)
+	switch {
+	case diff <= 0:
+		s.Reordered++
+		return false
+	case diff > 1:
+		s.Gaps += uint64(diff - 1)
+	}
+	s.last = seq
+
+	return true
+}
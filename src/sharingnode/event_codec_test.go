@@ -0,0 +1,201 @@
+package sharingnode
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/go-gl/glfw/v3.2/glfw"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// codecEvents has an event of every type with the fields its payload carries
+var codecEvents = events{
+	{Type: MouseMove, X: 10, Y: -20},
+	{Type: MouseDrag, X: 1 << 20, Y: 3, Button: glfw.MouseButtonLeft},
+	{Type: MouseUp, X: 4, Y: 5, Button: glfw.MouseButtonMiddle},
+	{Type: MouseDown, X: -1, Y: -2, Button: glfw.MouseButtonRight},
+	{Type: KeyUp, Key: glfw.KeyA, Mods: glfw.ModControl, Scancode: 38, Name: "a"},
+	{Type: KeyDown, Key: glfw.KeyUnknown, Mods: glfw.ModShift | glfw.ModAlt, Scancode: 300, Name: "ß"},
+	{Type: KeyRepeat, Key: glfw.KeyEnter},
+	{Type: Scroll, Xoff: 0.5, Yoff: -1.25},
+	{Type: RecordStart},
+	{Type: RecordStop},
+	{Type: KeyFrameRequest},
+	{Type: ControlRequest},
+	{Type: ControlRelease},
+	{Type: TextInput, Mods: glfw.ModShift, Text: "hello, мир"},
+	{Type: SelectDisplay, Display: 300},
+	{Type: Heartbeat},
+}
+
+func TestEventCodecTypes(t *testing.T) {
+	seen := make(map[EventType]bool)
+	for _, ev := range codecEvents {
+		seen[ev.Type] = true
+	}
+	for typ := MouseMove; typ <= Heartbeat; typ++ {
+		if !seen[typ] {
+			t.Errorf("event %d isn't tested", typ)
+		}
+	}
+}
+
+func TestBinaryEventRoundTrip(t *testing.T) {
+	var buf []byte
+	for i, ev := range codecEvents {
+		ev.Seq = uint32(i + 1)
+		ev.Time = uint32(i * 10)
+
+		var err error
+		buf, err = AppendEvent(buf, ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, want := range codecEvents {
+		got, size, err := DecodeEvent(buf)
+		if err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("event %d: got %+v, want %+v", i, got, want)
+		}
+		buf = buf[size:]
+	}
+	if len(buf) != 0 {
+		t.Errorf("%d bytes are left", len(buf))
+	}
+}
+
+func TestJSONEventRoundTrip(t *testing.T) {
+	data, err := encodeEvents(EventFormatJSON, codecEvents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeEvents(data, &DefaultReaderLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// JSON doesn't carry the sequence
+	want := make(events, len(codecEvents))
+	for i, ev := range codecEvents {
+		plain := *ev
+		plain.Seq, plain.Time = 0, 0
+		want[i] = &plain
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestAppendEventLimit(t *testing.T) {
+	buf := []byte{1}
+	result, err := AppendEvent(buf, &Event{Type: TextInput, Text: strings.Repeat("a", math.MaxUint8)})
+	if err == nil {
+		t.Fatal("the long payload is appended")
+	}
+	if !bytes.Equal(result, buf) {
+		t.Error("the buffer is changed by the failed event")
+	}
+
+	_, err = encodeEvents(EventFormatBinary, events{{Type: KeyDown, Name: strings.Repeat("a", math.MaxUint8)}})
+	if err == nil {
+		t.Error("the batch with the long payload is encoded")
+	}
+}
+
+func TestDecodeShortSelectDisplay(t *testing.T) {
+	record := []byte{1, 0, 0, 0, 0, 0, 0, 0, byte(SelectDisplay), 1, 2}
+	_, _, err := DecodeEvent(record)
+	if err == nil {
+		t.Error("the display of one byte is decoded")
+	}
+}
+
+func TestSequenceStats(t *testing.T) {
+	tests := []struct {
+		name      string
+		seqs      []uint32
+		applied   []bool
+		gaps      uint64
+		reordered uint64
+	}{
+		{"in order", []uint32{5, 6, 7}, []bool{true, true, true}, 0, 0},
+		{"gap", []uint32{1, 2, 5, 6}, []bool{true, true, true, true}, 2, 0},
+		{"reorder", []uint32{1, 3, 2, 4}, []bool{true, true, false, true}, 1, 1},
+		{"duplicate", []uint32{1, 2, 2}, []bool{true, true, false}, 0, 1},
+		{"wraparound", []uint32{math.MaxUint32 - 1, math.MaxUint32, 0, 2}, []bool{true, true, true, true}, 1, 0},
+		{"old before wraparound", []uint32{math.MaxUint32, 0, math.MaxUint32}, []bool{true, true, false}, 0, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stats := &SequenceStats{}
+			for i, seq := range test.seqs {
+				if applied := stats.check(seq); applied != test.applied[i] {
+					t.Errorf("event %d with seq %d: applied %v, want %v", i, seq, applied, test.applied[i])
+				}
+			}
+			if stats.Received != uint64(len(test.seqs)) || stats.Gaps != test.gaps || stats.Reordered != test.reordered {
+				t.Errorf("got %d received, %d gaps, %d reordered", stats.Received, stats.Gaps, stats.Reordered)
+			}
+		})
+	}
+}
+
+func TestDetectEventFormat(t *testing.T) {
+	var binaryStream bytes.Buffer
+	err := writeEventPreamble(&binaryStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := AppendEvent(nil, &Event{Type: KeyFrameRequest, Seq: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	binaryStream.Write(record)
+
+	reader := bufio.NewReader(&binaryStream)
+	format, err := detectEventFormat(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != EventFormatBinary {
+		t.Fatalf("got format %d of the binary stream", format)
+	}
+	// The preamble is consumed, so records follow
+	ev, err := readEvent(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != KeyFrameRequest || ev.Seq != 7 {
+		t.Errorf("got %+v after the preamble", ev)
+	}
+
+	jsonStream, err := encodeEvents(EventFormatJSON, codecEvents[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader = bufio.NewReader(bytes.NewReader(jsonStream))
+	format, err = detectEventFormat(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != EventFormatJSON {
+		t.Fatalf("got format %d of the JSON stream", format)
+	}
+	// JSON streams don't have a preamble, so nothing is consumed
+	if reader.Buffered() != len(jsonStream) {
+		t.Errorf("%d of %d bytes are left", reader.Buffered(), len(jsonStream))
+	}
+
+	unsupported := append(append([]byte(nil), eventMagic[:]...), 9, 0, 0, 0)
+	_, err = detectEventFormat(bufio.NewReader(bytes.NewReader(unsupported)))
+	if err == nil {
+		t.Error("the unsupported version is accepted")
+	}
+}
@@ -0,0 +1,338 @@
+package sharingnode
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/go-gl/glfw/v3.2/glfw"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"image"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testEvents = events{
+	{Type: MouseMove, X: 10, Y: -20},
+	{Type: MouseDown, Button: glfw.MouseButtonRight, X: 1, Y: 2},
+	{Type: KeyDown, Key: glfw.KeyA, Mods: glfw.ModShift, Scancode: 38, Name: "a"},
+	{Type: TextInput, Text: "hello"},
+	{Type: Scroll, Xoff: 0.5, Yoff: -1},
+	{Type: SelectDisplay, Display: 1},
+}
+
+func FuzzDecodeEvents(f *testing.F) {
+	for _, format := range []int{EventFormatJSON, EventFormatBinary} {
+		data, err := encodeEvents(format, testEvents)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte("[null]"))
+	f.Add([]byte("[" + strings.Repeat("{},", 300) + "{}]"))
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 0, 0, byte(MouseMove), 255})
+
+	limits := DefaultReaderLimits
+	f.Fuzz(func(t *testing.T, data []byte) {
+		batch, err := DecodeEvents(data, &limits)
+		if err == nil {
+			if len(batch) > limits.MaxEventBatch {
+				t.Fatalf("decoded %d events over the limit", len(batch))
+			}
+			for _, ev := range batch {
+				if ev == nil {
+					t.Fatal("decoded an empty event")
+				}
+			}
+		}
+
+		// Binary records of the same bytes are read from the stream one by one
+		reader := bufio.NewReader(bytes.NewReader(data))
+		for {
+			ev, err := readEvent(reader)
+			if err != nil {
+				break
+			}
+			if ev == nil {
+				t.Fatal("decoded an empty event")
+			}
+		}
+	})
+}
+
+// holdEvents press a key and a button of the viewer
+var holdEvents = events{
+	{Type: KeyDown, Key: glfw.KeyLeftControl},
+	{Type: MouseDown, Button: glfw.MouseButtonLeft, X: 5, Y: 5},
+}
+
+var heldInput = []string{"key " + KeyToString[glfw.KeyLeftControl], "button " + MouseMap[glfw.MouseButtonLeft]}
+
+func newTestReceiver(reader io.Reader, backend InputBackend) *EventReceiver {
+	displays := []image.Rectangle{image.Rect(0, 0, 100, 100)}
+	return NewEventReceiver(bufio.NewReader(reader), displays, &DefaultReaderLimits, backend)
+}
+
+// holdInput runs the receiver until it presses keys and buttons of holdEvents, the channel is closed when it stops
+func holdInput(t *testing.T, receiver *EventReceiver, writer io.Writer, recorder *InputRecorder) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		receiver.Run()
+		close(done)
+	}()
+
+	data, err := encodeEvents(EventFormatJSON, holdEvents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = writer.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitHeld(t, recorder, heldInput)
+
+	return done
+}
+
+// waitHeld waits until the recorder holds the input
+func waitHeld(t *testing.T, recorder *InputRecorder, want []string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		recorder.Lock()
+		count := len(recorder.actions)
+		recorder.Unlock()
+		held := recorder.Held()
+		if reflect.DeepEqual(held, want) || (len(want) == 0 && len(held) == 0 && count > 0) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("held %v, want %v", held, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReleaseOnDisconnect(t *testing.T) {
+	recorder := NewInputRecorder()
+	reader, writer := io.Pipe()
+	receiver := newTestReceiver(reader, recorder)
+	receiver.HoldTimeout = 0
+
+	done := holdInput(t, receiver, writer, recorder)
+	writer.Close()
+	<-done
+	if held := recorder.Held(); len(held) != 0 {
+		t.Errorf("%v are held after the viewer is gone", held)
+	}
+}
+
+func TestReleaseOnTimeout(t *testing.T) {
+	recorder := NewInputRecorder()
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	receiver := newTestReceiver(reader, recorder)
+	receiver.HoldTimeout = 200 * time.Millisecond
+
+	holdInput(t, receiver, writer, recorder)
+	// Heartbeats keep the input held
+	for i := 0; i < 4; i++ {
+		time.Sleep(receiver.HoldTimeout / 2)
+		data, err := encodeEvents(EventFormatJSON, events{{Type: Heartbeat}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = writer.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if held := recorder.Held(); !reflect.DeepEqual(held, heldInput) {
+		t.Fatalf("%v are held while heartbeats come, want %v", held, heldInput)
+	}
+
+	waitHeld(t, recorder, nil)
+}
+
+func TestReleaseOnControl(t *testing.T) {
+	const viewer = peer.ID("viewer")
+
+	for _, lose := range []struct {
+		name   string
+		change func(*ControlArbiter)
+	}{
+		{"revoke", func(a *ControlArbiter) { a.Revoke() }},
+		{"pause", func(a *ControlArbiter) { a.SetPaused(true) }},
+	} {
+		t.Run(lose.name, func(t *testing.T) {
+			recorder := NewInputRecorder()
+			reader, writer := io.Pipe()
+			defer writer.Close()
+			receiver := newTestReceiver(reader, recorder)
+
+			arbiter := NewControlArbiter()
+			session := arbiter.Join(viewer, receiver.ControlChanged)
+			defer arbiter.Leave(session)
+			err := arbiter.Grant(viewer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			receiver.Allowed = func() bool {
+				return arbiter.Allowed(viewer)
+			}
+
+			holdInput(t, receiver, writer, recorder)
+			lose.change(arbiter)
+			if held := recorder.Held(); len(held) != 0 {
+				t.Errorf("%v are held after %s", held, lose.name)
+			}
+		})
+	}
+}
+
+func TestReleaseDuringClickWait(t *testing.T) {
+	recorder := NewInputRecorder()
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	receiver := newTestReceiver(reader, recorder)
+	go receiver.Run()
+
+	err := writeEventPreamble(writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clicks := events{
+		{Type: MouseDown, Button: glfw.MouseButtonLeft, Seq: 1, Time: 1},
+		// The viewer released the button a second later, so the host waits before the release
+		{Type: MouseUp, Button: glfw.MouseButtonLeft, Seq: 2, Time: 1001},
+	}
+	var data []byte
+	for _, ev := range clicks {
+		data, err = AppendEvent(data, ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = writer.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitHeld(t, recorder, []string{"button " + MouseMap[glfw.MouseButtonLeft]})
+	time.Sleep(maxClickDelay / 5)
+
+	started := time.Now()
+	receiver.ReleaseAll()
+	if elapsed := time.Since(started); elapsed > maxClickDelay/2 {
+		t.Errorf("releasing waited %v for the click", elapsed)
+	}
+	if held := recorder.Held(); len(held) != 0 {
+		t.Errorf("%v are held after releasing", held)
+	}
+}
+
+func TestSenderHeartbeat(t *testing.T) {
+	reader, writer := io.Pipe()
+	sender := NewEventSender(bufio.NewWriter(writer), 100, 100, EventFormatJSON)
+	defer sender.Close()
+
+	received := make(chan EventType, 16)
+	go func() {
+		lines := bufio.NewReader(reader)
+		for {
+			line, err := lines.ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			batch, err := DecodeEvents(line, &DefaultReaderLimits)
+			if err != nil {
+				return
+			}
+			for _, ev := range batch {
+				received <- ev.Type
+			}
+		}
+	}()
+
+	sender.keyEvent(nil, glfw.KeyLeftShift, 50, glfw.Press, 0)
+	if typ := <-received; typ != KeyDown {
+		t.Fatalf("got event %d, want the key", typ)
+	}
+	select {
+	case typ := <-received:
+		if typ != Heartbeat {
+			t.Errorf("got event %d, want the heartbeat", typ)
+		}
+	case <-time.After(3 * heartbeatInterval):
+		t.Fatal("no heartbeat while the key is held")
+	}
+
+	sender.keyEvent(nil, glfw.KeyLeftShift, 50, glfw.Release, 0)
+	for typ := <-received; typ == Heartbeat; typ = <-received {
+	}
+	select {
+	case typ := <-received:
+		t.Errorf("got event %d after the key is released", typ)
+	case <-time.After(2 * heartbeatInterval):
+	}
+	reader.Close()
+}
+
+func TestSenderBackpressure(t *testing.T) {
+	const moves = 10 * maxQueuedEvents
+
+	reader, writer := io.Pipe()
+	defer reader.Close()
+	sender := NewEventSender(bufio.NewWriter(writer), 100, 100, EventFormatJSON)
+
+	// Nobody reads the stream yet, so the writer of the sender is blocked
+	done := make(chan struct{})
+	go func() {
+		for i := 1; i <= moves; i++ {
+			sender.sendEvent(&Event{Type: MouseMove, X: i % 100, Y: 1})
+			sender.sendEvent(&Event{Type: Scroll, Yoff: 1})
+		}
+		sender.sendEvent(&Event{Type: KeyDown, Key: glfw.KeyLeftShift})
+		sender.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sending is blocked by the stream")
+	}
+
+	var received events
+	lines := bufio.NewReader(reader)
+	for len(received) == 0 || received[len(received)-1].Type != KeyDown {
+		line, err := lines.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch, err := DecodeEvents(line, &DefaultReaderLimits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, batch...)
+	}
+
+	if len(received) > 3*maxQueuedEvents {
+		t.Errorf("%d events are written, the backlog isn't merged", len(received))
+	}
+	scrolled := 0.0
+	var last *Event
+	for _, ev := range received {
+		switch ev.Type {
+		case Scroll:
+			scrolled += ev.Yoff
+		case MouseMove:
+			last = ev
+		}
+	}
+	if scrolled != moves {
+		t.Errorf("scrolled by %v, want %d", scrolled, moves)
+	}
+	if last == nil || last.X != moves%100 {
+		t.Errorf("the last move is %+v, want x %d", last, moves%100)
+	}
+}
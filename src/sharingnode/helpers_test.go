@@ -0,0 +1,151 @@
+package sharingnode
+
+import (
+	"image"
+	"testing"
+	"time"
+)
+
+const testFrameRate = "100"
+
+// testStreamOptions are fast options of the software encoders, codecs drop the ones they don't know
+func testStreamOptions(codec string) StreamOptions {
+	return StreamOptions{
+		Codec: codec,
+		Options: map[string]string{
+			"preset":  "ultrafast",
+			"tune":    "zerolatency",
+			"crf":     "30",
+			"threads": "1",
+			"r":       testFrameRate,
+		},
+	}
+}
+
+// encodeTestPattern encodes the test pattern until the encoder returns the number of packets.
+// The test is skipped when the codec can't be encoded and decoded on this machine
+func encodeTestPattern(tb testing.TB, codec *VideoCodec, width, height, packets int) []*Packet {
+	if codec.FindEncoder() == nil || codec.FindDecoder() == nil {
+		tb.Skipf("%s is not available", codec.Name)
+	}
+
+	screen := &ScreenOptions{GrabbingOptions: map[string]string{"r": testFrameRate}}
+	provider, err := NewTestPatternProvider(screen, width, height)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	stream := testStreamOptions(codec.Name)
+	params, err := ParseEncoderParams(codec, stream.Options, screen.GrabbingOptions)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	encoder := NewVideoEncoder(&stream, params)
+	ch, err := encoder.Encode(provider, nil, time.Second)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	var result []*Packet
+	timeout := time.After(30 * time.Second)
+	for {
+		select {
+		case packet, ok := <-ch:
+			if !ok {
+				return result
+			}
+			if len(result) < packets {
+				result = append(result, packet)
+			}
+			if len(result) == packets {
+				// The encoder waits for the channel under its lock, so it is closed while the channel is drained
+				go encoder.Close()
+				packets = -1
+			}
+		case <-timeout:
+			encoder.Close()
+			tb.Fatalf("%s encoded only %d packets", codec.Name, len(result))
+		}
+	}
+}
+
+// availableCodec returns the first codec which can be encoded and decoded on this machine
+func availableCodec(tb testing.TB) *VideoCodec {
+	for _, codec := range VideoCodecs {
+		if codec.FindEncoder() != nil && codec.FindDecoder() != nil {
+			return codec
+		}
+	}
+	tb.Skip("no video codec is available")
+	return nil
+}
+
+func cloneImage(img *image.YCbCr) *image.YCbCr {
+	clone := image.NewYCbCr(img.Rect, img.SubsampleRatio)
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			clone.Y[clone.YOffset(x, y)] = img.Y[img.YOffset(x, y)]
+			clone.Cb[clone.COffset(x, y)] = img.Cb[img.COffset(x, y)]
+			clone.Cr[clone.COffset(x, y)] = img.Cr[img.COffset(x, y)]
+		}
+	}
+	return clone
+}
+
+// decodePackets decodes packets without frame threading, so every packet returns its frame at once
+func decodePackets(tb testing.TB, codec *VideoCodec, packets []*Packet) []*image.YCbCr {
+	decoder, err := NewVideoDecoder(codec, map[string]string{"threads": "1", "thread_type": "none"})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer decoder.Close()
+
+	var images []*image.YCbCr
+	for i, packet := range packets {
+		err = decoder.Decode(packet.Data, func(img *image.YCbCr) error {
+			images = append(images, cloneImage(img))
+			return nil
+		})
+		if err != nil {
+			tb.Fatalf("packet %d: %v", i, err)
+		}
+	}
+	return images
+}
+
+// testPatternImage draws the frame of the test pattern with the index
+func testPatternImage(width, height, index int) *image.YCbCr {
+	pattern := &TestPatternProvider{
+		DisplayInfo: DisplayInfo{width, height},
+		image:       image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420),
+		index:       index,
+	}
+	pattern.draw()
+	return pattern.image
+}
+
+// imageDiff returns the largest difference of samples of the images
+func imageDiff(a, b *image.YCbCr) int {
+	diff := func(x, y byte) int {
+		if x > y {
+			return int(x - y)
+		}
+		return int(y - x)
+	}
+
+	max := 0
+	for y := a.Rect.Min.Y; y < a.Rect.Max.Y; y++ {
+		for x := a.Rect.Min.X; x < a.Rect.Max.X; x++ {
+			for _, d := range []int{
+				diff(a.Y[a.YOffset(x, y)], b.Y[b.YOffset(x, y)]),
+				diff(a.Cb[a.COffset(x, y)], b.Cb[b.COffset(x, y)]),
+				diff(a.Cr[a.COffset(x, y)], b.Cr[b.COffset(x, y)]),
+			} {
+				if d > max {
+					max = d
+				}
+			}
+		}
+	}
+	return max
+}
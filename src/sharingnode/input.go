@@ -0,0 +1,286 @@
+package sharingnode
+
+import (
+	"github.com/go-gl/glfw/v3.2/glfw"
+	"github.com/go-vgo/robotgo"
+	"github.com/pkg/errors"
+	"image"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	InputBackendRobotgo = "robotgo"
+	InputBackendXTest   = "xtest"
+	InputBackendUInput  = "uinput"
+)
+
+// DefaultHoldTimeout releases held keys and buttons when the viewer doesn't send events for this time
+const DefaultHoldTimeout = 10 * time.Second
+
+// InputBackend injects input into the host, key and button names are the names of KeyToString and MouseMap
+type InputBackend interface {
+	MoveMouse(x, y int)
+	// DragMouse moves the mouse while the button is held
+	DragMouse(x, y int, button string)
+	MouseToggle(button string, down bool)
+	// Scroll scrolls by wheel notches like GLFW offsets, positive dy scrolls up and positive dx
+	// scrolls left. Backends without smooth scrolling keep fractions until they make a notch
+	Scroll(dx, dy float64)
+	KeyToggle(key string, down bool)
+	TypeText(text string)
+	// Close frees the connection or the device of the backend
+	Close()
+}
+
+// NewInputBackend creates the backend selected in the input options, robotgo and xtest use the display of the capture options.
+// uinput takes the pointer range of uinput_size or of the displays
+func NewInputBackend(input map[string]string, capture map[string]string) (InputBackend, error) {
+	switch input["backend"] {
+	case "", InputBackendRobotgo:
+		return NewRobotgoBackend(captureDisplay(capture)), nil
+	case InputBackendXTest:
+		return NewXTestBackend(captureDisplay(capture))
+	case InputBackendUInput:
+		return NewUInputBackend(input["uinput_size"])
+	}
+
+	return nil, errors.Errorf("Unknown input backend %s", input["backend"])
+}
+
+// ScrollScale parses the multiplier of scroll offsets of the input options
+func ScrollScale(options map[string]string) float64 {
+	value, ok := options["scroll_scale"]
+	if !ok {
+		return 1
+	}
+	scale, err := strconv.ParseFloat(value, 64)
+	if err != nil || scale <= 0 {
+		logger.Warning("Wrong scroll scale ", value, ", using 1")
+		return 1
+	}
+	return scale
+}
+
+// scrollAccumulator turns smooth offsets into whole notches
+type scrollAccumulator struct {
+	x float64
+	y float64
+}
+
+func (a *scrollAccumulator) add(dx, dy float64) (int, int) {
+	a.x += dx
+	a.y += dy
+	x, y := int(a.x), int(a.y)
+	a.x -= float64(x)
+	a.y -= float64(y)
+	return x, y
+}
+
+// HoldTimeout parses the hold timeout of the input options
+func HoldTimeout(options map[string]string) time.Duration {
+	value, ok := options["hold_timeout"]
+	if !ok {
+		return DefaultHoldTimeout
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		logger.Warning("Wrong hold timeout ", value, ", using ", DefaultHoldTimeout)
+		return DefaultHoldTimeout
+	}
+	return timeout
+}
+
+// extraButtons presses the buttons which the backend can't press through XTest,
+// without XTest they are dropped with a warning
+type extraButtons struct {
+	sync.Mutex
+	backend InputBackend
+	dropped map[string]bool
+}
+
+func (e *extraButtons) toggle(button string, down bool) {
+	if e.backend != nil {
+		e.backend.MouseToggle(button, down)
+		return
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	if !e.dropped[button] {
+		logger.Warning("Button ", button, " can't be pressed without XTest, it is dropped")
+	}
+	e.dropped[button] = true
+}
+
+func (e *extraButtons) close() {
+	if e.backend != nil {
+		e.backend.Close()
+	}
+}
+
+// robotgoButtons are buttons which robotgo can press, others are extra buttons
+var robotgoButtons = map[string]bool{
+	"left":   true,
+	"center": true,
+	"right":  true,
+}
+
+type robotgoBackend struct {
+	sync.Mutex
+	scroll scrollAccumulator
+	extra  extraButtons
+}
+
+// NewRobotgoBackend injects input with robotgo, back, forward and buttons 6-8 are pressed through XTest of the display
+func NewRobotgoBackend(display string) InputBackend {
+	robotgo.SetMouseDelay(0)
+	robotgo.SetKeyboardDelay(0)
+	robotgo.SetKeyDelay(0)
+
+	backend := &robotgoBackend{
+		extra: extraButtons{dropped: make(map[string]bool)},
+	}
+	xtest, err := NewXTestBackend(display)
+	if err != nil {
+		logger.Warning("XTest is not available, only left, center and right buttons are pressed: ", err)
+	} else {
+		backend.extra.backend = xtest
+	}
+	return backend
+}
+
+func toggleDirection(down bool) string {
+	if down {
+		return "down"
+	}
+	return "up"
+}
+
+func (b *robotgoBackend) Close() {
+	b.extra.close()
+}
+
+func (b *robotgoBackend) Pointer() (image.Point, error) {
+	x, y := robotgo.GetMousePos()
+	return image.Pt(x, y), nil
+}
+
+func (b *robotgoBackend) MoveMouse(x, y int) {
+	robotgo.MoveMouse(x, y)
+}
+
+func (b *robotgoBackend) DragMouse(x, y int, button string) {
+	// Extra buttons are held by XTest, so the X server reports the motion with them
+	if !robotgoButtons[button] {
+		robotgo.MoveMouse(x, y)
+		return
+	}
+	robotgo.DragMouse(x, y, button)
+}
+
+func (b *robotgoBackend) MouseToggle(button string, down bool) {
+	if !robotgoButtons[button] {
+		b.extra.toggle(button, down)
+		return
+	}
+	robotgo.MouseToggle(toggleDirection(down), button)
+}
+
+func (b *robotgoBackend) Scroll(dx, dy float64) {
+	b.Lock()
+	x, y := b.scroll.add(dx, dy)
+	b.Unlock()
+	if x != 0 || y != 0 {
+		robotgo.Scroll(x, y, 0)
+	}
+}
+
+func (b *robotgoBackend) KeyToggle(key string, down bool) {
+	robotgo.KeyToggle(key, toggleDirection(down))
+}
+
+func (b *robotgoBackend) TypeText(text string) {
+	robotgo.TypeStr(text)
+}
+
+// inputState tracks keys and buttons pressed on the host by the viewer
+type inputState struct {
+	pressed map[glfw.Key]string
+	buttons map[glfw.MouseButton]string
+}
+
+func newInputState() *inputState {
+	return &inputState{
+		pressed: make(map[glfw.Key]string),
+		buttons: make(map[glfw.MouseButton]string),
+	}
+}
+
+func (s *inputState) press(key glfw.Key, name string) {
+	s.pressed[key] = name
+}
+
+func (s *inputState) release(key glfw.Key) {
+	delete(s.pressed, key)
+}
+
+// dragButton returns the held button which drags, the left button is preferred
+func (s *inputState) dragButton() string {
+	for _, button := range []glfw.MouseButton{glfw.MouseButton1, glfw.MouseButton3, glfw.MouseButton2} {
+		if name, ok := s.buttons[button]; ok {
+			return name
+		}
+	}
+	for _, name := range s.buttons {
+		return name
+	}
+	return ""
+}
+
+// maxClickDelay bounds the delay of one click, so a stalled viewer doesn't stall the host
+const maxClickDelay = 500 * time.Millisecond
+
+// clickTiming delays clicks to the intervals measured by the viewer
+type clickTiming struct {
+	sent     uint32
+	injected time.Time
+}
+
+// wait sleeps until the interval since the previous click reaches the viewer's one. Events
+// without the viewer's time are injected at once
+func (c *clickTiming) wait(sent uint32) {
+	if sent == 0 {
+		return
+	}
+	if !c.injected.IsZero() && sent > c.sent {
+		interval := time.Duration(sent-c.sent) * time.Millisecond
+		delay := interval - time.Since(c.injected)
+		if delay > maxClickDelay {
+			delay = maxClickDelay
+		}
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+	c.sent = sent
+	c.injected = time.Now()
+}
+
+// held tells the number of pressed keys and buttons
+func (s *inputState) held() int {
+	return len(s.pressed) + len(s.buttons)
+}
+
+// releaseAll releases everything pressed, so nothing stays stuck on the host
+func (s *inputState) releaseAll(backend InputBackend) {
+	for key, name := range s.pressed {
+		backend.KeyToggle(name, false)
+		delete(s.pressed, key)
+	}
+	for button, name := range s.buttons {
+		backend.MouseToggle(name, false)
+		delete(s.buttons, button)
+	}
+}
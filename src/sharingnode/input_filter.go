@@ -0,0 +1,190 @@
+package sharingnode
+
+import (
+	"github.com/go-gl/glfw/v3.2/glfw"
+	"github.com/pkg/errors"
+	"github.com/xgreenx/desktop-sharing/src/node"
+	"strings"
+	"sync"
+)
+
+// DefaultBlockedChords are blocked for all viewers unless the input options override them.
+// Ctrl+Alt+Delete isn't blocked, viewers send it to log in or unlock the host
+const DefaultBlockedChords = "ctrl+alt+backspace,super+l"
+
+var chordModifiers = map[string]glfw.ModifierKey{
+	"ctrl":    glfw.ModControl,
+	"control": glfw.ModControl,
+	"alt":     glfw.ModAlt,
+	"shift":   glfw.ModShift,
+	"super":   glfw.ModSuper,
+	"cmd":     glfw.ModSuper,
+	"win":     glfw.ModSuper,
+}
+
+// modifierNames are names of modifiers of chords in the order of ParseKeyChord input
+var modifierNames = []struct {
+	mod  glfw.ModifierKey
+	name string
+}{
+	{glfw.ModControl, "ctrl"},
+	{glfw.ModAlt, "alt"},
+	{glfw.ModShift, "shift"},
+	{glfw.ModSuper, "super"},
+}
+
+// KeyChord is the key pressed while the modifiers are held
+type KeyChord struct {
+	Mods glfw.ModifierKey
+	// Key is the name of KeyToString
+	Key string
+}
+
+// String returns the chord in the form of ParseKeyChord
+func (c KeyChord) String() string {
+	var parts []string
+	for _, m := range modifierNames {
+		if c.Mods&m.mod != 0 {
+			parts = append(parts, m.name)
+		}
+	}
+	return strings.Join(append(parts, c.Key), "+")
+}
+
+// ParseKeyChord parses chords like ctrl+alt+backspace
+func ParseKeyChord(chord string) (KeyChord, error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(chord)), "+")
+	result := KeyChord{Key: parts[len(parts)-1]}
+	for _, part := range parts[:len(parts)-1] {
+		mod, ok := chordModifiers[part]
+		if !ok {
+			return KeyChord{}, errors.Errorf("Unknown modifier %s in key chord %s", part, chord)
+		}
+		result.Mods |= mod
+	}
+	if result.Key == "" {
+		return KeyChord{}, errors.Errorf("Key chord %s doesn't have a key", chord)
+	}
+
+	return result, nil
+}
+
+// ParseKeyChords parses the comma separated list of chords
+func ParseKeyChords(chords []string) ([]KeyChord, error) {
+	var result []KeyChord
+	for _, list := range chords {
+		for _, chord := range strings.Split(list, ",") {
+			if strings.TrimSpace(chord) == "" {
+				continue
+			}
+			parsed, err := ParseKeyChord(chord)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, parsed)
+		}
+	}
+	return result, nil
+}
+
+// Matches tells that the key is pressed with at least the modifiers of the chord
+func (c KeyChord) Matches(mods glfw.ModifierKey, names ...string) bool {
+	if mods&c.Mods != c.Mods {
+		return false
+	}
+	for _, name := range names {
+		if strings.ToLower(name) == c.Key {
+			return true
+		}
+	}
+	return false
+}
+
+// InputFilter drops input events which the host doesn't allow to the viewer and counts them
+type InputFilter struct {
+	sync.Mutex
+	Pointer  bool
+	Keyboard bool
+	Scroll   bool
+	Blocked  []KeyChord
+	dropped  map[string]uint64
+	// OnBlocked is called when the viewer presses the blocked chord, so it can be told about it
+	OnBlocked func(chord KeyChord)
+}
+
+// NewInputFilter uses capabilities of the peer and blocks its chords with the chords of the input options
+func NewInputFilter(rights *node.Rights, options map[string]string) (*InputFilter, error) {
+	global, ok := options["blocked_chords"]
+	if !ok {
+		global = DefaultBlockedChords
+	}
+	blocked, err := ParseKeyChords(append([]string{global}, rights.BlockedChords...))
+	if err != nil {
+		return nil, err
+	}
+
+	return &InputFilter{
+		Pointer:  rights.HasCapability(node.CapabilityPointer),
+		Keyboard: rights.HasCapability(node.CapabilityKeyboard),
+		Scroll:   rights.HasCapability(node.CapabilityScroll),
+		Blocked:  blocked,
+		dropped:  make(map[string]uint64),
+	}, nil
+}
+
+func (f *InputFilter) drop(reason string) bool {
+	f.Lock()
+	defer f.Unlock()
+	f.dropped[reason]++
+	return false
+}
+
+// Allow tells whether the event can be injected, mods are modifiers held on the host and the viewer
+func (f *InputFilter) Allow(ev *Event, mods glfw.ModifierKey) bool {
+	switch ev.Type {
+	case MouseMove, MouseDrag, MouseUp, MouseDown:
+		if !f.Pointer {
+			return f.drop(node.CapabilityPointer)
+		}
+	case Scroll:
+		if !f.Scroll {
+			return f.drop(node.CapabilityScroll)
+		}
+	case KeyDown, KeyRepeat, KeyUp, TextInput:
+		if !f.Keyboard {
+			return f.drop(node.CapabilityKeyboard)
+		}
+		// Releases pass, so no key stays held
+		if ev.Type == KeyUp {
+			return true
+		}
+		names := []string{hostKey(ev), KeyToString[ev.Key]}
+		if ev.Type == TextInput {
+			// Characters typed while modifiers are held make chords like keys do
+			names = names[:0]
+			for _, r := range ev.Text {
+				names = append(names, string(r))
+			}
+		}
+		for _, chord := range f.Blocked {
+			if chord.Matches(mods, names...) {
+				if ev.Type != KeyRepeat && f.OnBlocked != nil {
+					f.OnBlocked(chord)
+				}
+				return f.drop("chord")
+			}
+		}
+	}
+	return true
+}
+
+// Dropped returns the number of dropped events by the reason
+func (f *InputFilter) Dropped() map[string]uint64 {
+	f.Lock()
+	defer f.Unlock()
+	result := make(map[string]uint64, len(f.dropped))
+	for reason, count := range f.dropped {
+		result[reason] = count
+	}
+	return result
+}
@@ -0,0 +1,141 @@
+package sharingnode
+
+import (
+	"github.com/go-gl/glfw/v3.2/glfw"
+	"github.com/xgreenx/desktop-sharing/src/config"
+	"github.com/xgreenx/desktop-sharing/src/node"
+	"io"
+	"testing"
+)
+
+func TestDefaultMacrosPassFilter(t *testing.T) {
+	options := config.NewSharingConfig(config.NewBootstrapConfig()).SharingOptions
+	if options.InputOptions["blocked_chords"] != DefaultBlockedChords {
+		t.Errorf("the config blocks %s, the default is %s", options.InputOptions["blocked_chords"], DefaultBlockedChords)
+	}
+
+	rights := &node.Rights{}
+	filter, err := NewInputFilter(rights, options.InputOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range MacroNames(options.Macros) {
+		macro, err := ParseMacro(options.Macros[name])
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, ev := range macro.events(true) {
+			if !filter.Allow(ev, ev.Mods) {
+				t.Errorf("%s is dropped by the default filter", name)
+				break
+			}
+		}
+	}
+}
+
+func TestFilterBlockedChord(t *testing.T) {
+	filter, err := NewInputFilter(&node.Rights{BlockedChords: []string{"ctrl+alt+f1"}}, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blocked []string
+	filter.OnBlocked = func(chord KeyChord) {
+		blocked = append(blocked, chord.String())
+	}
+
+	macro, err := ParseMacro("alt+ctrl+F1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ev := range macro.events(false) {
+		allowed := filter.Allow(ev, ev.Mods)
+		if ev.Type == KeyDown && ev.Key == glfw.KeyF1 && allowed {
+			t.Error("the blocked chord is allowed")
+		}
+	}
+	if len(blocked) != 1 || blocked[0] != "ctrl+alt+f1" {
+		t.Errorf("got blocked chords %v", blocked)
+	}
+	if filter.Dropped()["chord"] != 1 {
+		t.Errorf("dropped %v", filter.Dropped())
+	}
+}
+
+func TestFilterBlockedText(t *testing.T) {
+	filter, err := NewInputFilter(&node.Rights{}, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blocked []string
+	filter.OnBlocked = func(chord KeyChord) {
+		blocked = append(blocked, chord.String())
+	}
+
+	tests := []struct {
+		name    string
+		ev      *Event
+		mods    glfw.ModifierKey
+		allowed bool
+	}{
+		{"plain text", &Event{Type: TextInput, Text: "hello"}, 0, true},
+		{"text with shift", &Event{Type: TextInput, Text: "L"}, glfw.ModShift, true},
+		{"text while super is held", &Event{Type: TextInput, Text: "l"}, glfw.ModSuper, false},
+		{"capital while super is held", &Event{Type: TextInput, Text: "hL"}, glfw.ModSuper | glfw.ModShift, false},
+		{"other text while super is held", &Event{Type: TextInput, Text: "k"}, glfw.ModSuper, true},
+		{"release of the blocked key", &Event{Type: KeyUp, Key: glfw.KeyL}, glfw.ModSuper, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if allowed := filter.Allow(test.ev, test.mods); allowed != test.allowed {
+				t.Errorf("allowed %v, want %v", allowed, test.allowed)
+			}
+		})
+	}
+	if len(blocked) != 2 || blocked[0] != "super+l" {
+		t.Errorf("got blocked chords %v", blocked)
+	}
+}
+
+func TestReceiverBlocksTextWithHeldModifier(t *testing.T) {
+	recorder := NewInputRecorder()
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	receiver := newTestReceiver(reader, recorder)
+	var err error
+	receiver.Filter, err = NewInputFilter(&node.Rights{}, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		receiver.Run()
+		close(done)
+	}()
+
+	// The viewer holds super on the host and types the blocked chord as text
+	data, err := encodeEvents(EventFormatJSON, events{
+		{Type: KeyDown, Key: glfw.KeyLeftSuper},
+		{Type: TextInput, Text: "l"},
+		{Type: KeyUp, Key: glfw.KeyLeftSuper},
+		{Type: TextInput, Text: "l"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = writer.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	<-done
+
+	var texts []string
+	for _, action := range recorder.Actions() {
+		if action.Action == "text" {
+			texts = append(texts, action.Text)
+		}
+	}
+	if len(texts) != 1 {
+		t.Errorf("typed %v, want the text after super is released", texts)
+	}
+}
@@ -0,0 +1,93 @@
+package sharingnode
+
+import "sync"
+
+// InputAction is one call of the input backend
+type InputAction struct {
+	Action string
+	Name   string
+	Down   bool
+	X      int
+	Y      int
+	DX     float64
+	DY     float64
+	Text   string
+}
+
+// InputRecorder is the input backend of tests which only records calls
+type InputRecorder struct {
+	sync.Mutex
+	actions []InputAction
+}
+
+func NewInputRecorder() *InputRecorder {
+	return &InputRecorder{}
+}
+
+func (r *InputRecorder) record(action InputAction) {
+	r.Lock()
+	defer r.Unlock()
+	r.actions = append(r.actions, action)
+}
+
+func (r *InputRecorder) MoveMouse(x, y int) {
+	r.record(InputAction{Action: "move", X: x, Y: y})
+}
+
+func (r *InputRecorder) MouseToggle(button string, down bool) {
+	r.record(InputAction{Action: "button", Name: button, Down: down})
+}
+
+func (r *InputRecorder) DragMouse(x, y int, button string) {
+	r.record(InputAction{Action: "drag", Name: button, X: x, Y: y})
+}
+
+func (r *InputRecorder) Scroll(dx, dy float64) {
+	r.record(InputAction{Action: "scroll", DX: dx, DY: dy})
+}
+
+func (r *InputRecorder) KeyToggle(key string, down bool) {
+	r.record(InputAction{Action: "key", Name: key, Down: down})
+}
+
+func (r *InputRecorder) TypeText(text string) {
+	r.record(InputAction{Action: "text", Text: text})
+}
+
+func (r *InputRecorder) Close() {
+}
+
+// Actions returns the recorded calls and clears them
+func (r *InputRecorder) Actions() []InputAction {
+	r.Lock()
+	defer r.Unlock()
+	actions := r.actions
+	r.actions = nil
+	return actions
+}
+
+// Held returns keys and buttons which are pressed and not released by the recorded calls
+func (r *InputRecorder) Held() []string {
+	r.Lock()
+	defer r.Unlock()
+	pressed := make(map[string]bool)
+	var order []string
+	for _, action := range r.actions {
+		if action.Action != "key" && action.Action != "button" {
+			continue
+		}
+		name := action.Action + " " + action.Name
+		if action.Down && !pressed[name] {
+			order = append(order, name)
+		}
+		pressed[name] = action.Down
+	}
+
+	var held []string
+	for _, name := range order {
+		if pressed[name] {
+			held = append(held, name)
+		}
+	}
+	return held
+}
@@ -0,0 +1,29 @@
+package sharingnode
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExtraButtons(t *testing.T) {
+	recorder := NewInputRecorder()
+	extra := &extraButtons{backend: recorder, dropped: make(map[string]bool)}
+	extra.toggle("back", true)
+	extra.toggle("back", false)
+	want := []InputAction{
+		{Action: "button", Name: "back", Down: true},
+		{Action: "button", Name: "back", Down: false},
+	}
+	if actions := recorder.Actions(); !reflect.DeepEqual(actions, want) {
+		t.Errorf("got %+v, want %+v", actions, want)
+	}
+
+	// Without XTest the buttons are dropped
+	dropping := &extraButtons{dropped: make(map[string]bool)}
+	for _, button := range []string{"forward", "button8", "forward"} {
+		dropping.toggle(button, true)
+	}
+	if want := map[string]bool{"forward": true, "button8": true}; !reflect.DeepEqual(dropping.dropped, want) {
+		t.Errorf("dropped %v, want %v", dropping.dropped, want)
+	}
+}
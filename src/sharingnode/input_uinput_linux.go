@@ -0,0 +1,390 @@
+package sharingnode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	uiSetEvBit   = 0x40045564
+	uiSetKeyBit  = 0x40045565
+	uiSetRelBit  = 0x40045566
+	uiSetAbsBit  = 0x40045567
+	uiDevCreate  = 0x5501
+	uiDevDestroy = 0x5502
+
+	evSyn = 0x00
+	evKey = 0x01
+	evRel = 0x02
+	evAbs = 0x03
+
+	synReport      = 0
+	relHWheel      = 0x06
+	relWheel       = 0x08
+	relWheelHiRes  = 0x0b
+	relHWheelHiRes = 0x0c
+	// hiResNotch is the high resolution value of one notch
+	hiResNotch = 120
+	absX       = 0x00
+	absY       = 0x01
+
+	btnLeft    = 0x110
+	btnRight   = 0x111
+	btnMiddle  = 0x112
+	btnSide    = 0x113
+	btnExtra   = 0x114
+	btnForward = 0x115
+	btnBack    = 0x116
+	btnTask    = 0x117
+
+	keyLeftShift = 42
+	absCount     = 64
+)
+
+// linuxKeys maps key names of KeyToString to Linux key codes of the US layout
+var linuxKeys = map[string]uint16{
+	"esc": 1, "1": 2, "2": 3, "3": 4, "4": 5, "5": 6, "6": 7, "7": 8, "8": 9, "9": 10, "0": 11,
+	"-": 12, "=": 13, "backspace": 14, "tab": 15,
+	"q": 16, "w": 17, "e": 18, "r": 19, "t": 20, "y": 21, "u": 22, "i": 23, "o": 24, "p": 25,
+	"[": 26, "]": 27, "enter": 28, "lctrl": 29,
+	"a": 30, "s": 31, "d": 32, "f": 33, "g": 34, "h": 35, "j": 36, "k": 37, "l": 38,
+	";": 39, "'": 40, "`": 41, "lshift": 42, "\\": 43,
+	"z": 44, "x": 45, "c": 46, "v": 47, "b": 48, "n": 49, "m": 50,
+	",": 51, ".": 52, "/": 53, "rshift": 54, "num*": 55, "lalt": 56, "space": 57, "capslock": 58,
+	"num_lock": 69, "num7": 71, "num8": 72, "num9": 73, "num-": 74, "num4": 75, "num5": 76,
+	"num6": 77, "num+": 78, "num1": 79, "num2": 80, "num3": 81, "num0": 82, "num.": 83,
+	"num_enter": 96, "rctrl": 97, "num/": 98, "print": 99, "ralt": 100,
+	"home": 102, "up": 103, "pageup": 104, "left": 105, "right": 106, "end": 107, "down": 108,
+	"pagedown": 109, "insert": 110, "delete": 111, "num_equal": 117,
+	"lcmd": 125, "rcmd": 126, "menu": 127,
+}
+
+// shiftedChars are typed with shift on the US layout
+var shiftedChars = map[rune]string{
+	'!': "1", '@': "2", '#': "3", '$': "4", '%': "5", '^': "6", '&': "7", '*': "8", '(': "9", ')': "0",
+	'_': "-", '+': "=", '{': "[", '}': "]", '|': "\\", ':': ";", '"': "'", '~': "`", '<': ",", '>': ".", '?': "/",
+}
+
+func init() {
+	for i := 1; i <= 10; i++ {
+		linuxKeys["f"+strconv.Itoa(i)] = uint16(58 + i)
+	}
+	linuxKeys["f11"] = 87
+	linuxKeys["f12"] = 88
+	for i := 13; i <= 24; i++ {
+		linuxKeys["f"+strconv.Itoa(i)] = uint16(183 + i - 13)
+	}
+}
+
+var linuxButtons = map[string]uint16{
+	"left":    btnLeft,
+	"center":  btnMiddle,
+	"right":   btnRight,
+	"back":    btnSide,
+	"forward": btnExtra,
+	"button6": btnForward,
+	"button7": btnBack,
+	"button8": btnTask,
+}
+
+type inputEvent struct {
+	Time  syscall.Timeval
+	Type  uint16
+	Code  uint16
+	Value int32
+}
+
+type uinputUserDev struct {
+	Name         [80]byte
+	BusType      uint16
+	Vendor       uint16
+	Product      uint16
+	Version      uint16
+	FFEffectsMax uint32
+	AbsMax       [absCount]int32
+	AbsMin       [absCount]int32
+	AbsFuzz      [absCount]int32
+	AbsFlat      [absCount]int32
+}
+
+// UInputBackend injects input through a virtual device of /dev/uinput, so it works under
+// Wayland and on the console. Text is typed with the US layout
+type UInputBackend struct {
+	sync.Mutex
+	file *os.File
+	// origin is the corner of the desktop, absolute positions start at it
+	origin image.Point
+	scroll scrollAccumulator
+}
+
+func ioctl(file *os.File, request, value uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), request, value)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// parseSize parses the size like 1920x1080
+func parseSize(size string) (image.Rectangle, error) {
+	parts := strings.Split(strings.TrimSpace(size), "x")
+	if len(parts) == 2 {
+		width, widthErr := strconv.Atoi(parts[0])
+		height, heightErr := strconv.Atoi(parts[1])
+		if widthErr == nil && heightErr == nil && width > 0 && height > 0 {
+			return image.Rect(0, 0, width, height), nil
+		}
+	}
+	return image.Rectangle{}, errors.Errorf("Wrong size %s", size)
+}
+
+// drmBounds returns the mode of the first connected output, the console and Wayland have it without X
+func drmBounds() image.Rectangle {
+	connectors, _ := filepath.Glob("/sys/class/drm/card*-*")
+	sort.Strings(connectors)
+	for _, connector := range connectors {
+		status, err := ioutil.ReadFile(filepath.Join(connector, "status"))
+		if err != nil || strings.TrimSpace(string(status)) != "connected" {
+			continue
+		}
+		modes, err := ioutil.ReadFile(filepath.Join(connector, "modes"))
+		if err != nil {
+			continue
+		}
+		// The first mode is the preferred one
+		mode := strings.SplitN(string(modes), "\n", 2)[0]
+		bounds, err := parseSize(strings.TrimRight(mode, "i"))
+		if err == nil {
+			return bounds
+		}
+	}
+	return image.Rectangle{}
+}
+
+// screenBounds returns the range of absolute positions. The size of the config is preferred,
+// then the area of X displays and the DRM mode when X isn't running
+func screenBounds(size string) (image.Rectangle, error) {
+	if size != "" {
+		return parseSize(size)
+	}
+
+	var bounds image.Rectangle
+	for _, display := range displayBounds() {
+		bounds = bounds.Union(display)
+	}
+	if bounds.Empty() {
+		bounds = drmBounds()
+	}
+	if bounds.Empty() {
+		return bounds, errors.New("Size of the screen is unknown, set uinput_size of the input options")
+	}
+	return bounds, nil
+}
+
+// NewUInputBackend creates the virtual device, absolute positions cover the size like 1920x1080
+// or the screen when the size is empty
+func NewUInputBackend(size string) (*UInputBackend, error) {
+	bounds, err := screenBounds(size)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile("/dev/uinput", os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "uinput is not available")
+	}
+
+	dev := uinputUserDev{
+		BusType: 0x06,
+		Vendor:  0x1,
+		Product: 0x1,
+		Version: 1,
+	}
+	copy(dev.Name[:], "desktop-sharing")
+	dev.AbsMax[absX] = int32(bounds.Dx() - 1)
+	dev.AbsMax[absY] = int32(bounds.Dy() - 1)
+
+	var buf bytes.Buffer
+	for _, ev := range []uintptr{evKey, evRel, evAbs, evSyn} {
+		err = ioctl(file, uiSetEvBit, ev)
+		if err != nil {
+			goto Error
+		}
+	}
+	for _, code := range linuxKeys {
+		err = ioctl(file, uiSetKeyBit, uintptr(code))
+		if err != nil {
+			goto Error
+		}
+	}
+	for _, code := range linuxButtons {
+		err = ioctl(file, uiSetKeyBit, uintptr(code))
+		if err != nil {
+			goto Error
+		}
+	}
+	for _, code := range []uintptr{relWheel, relHWheel, relWheelHiRes, relHWheelHiRes} {
+		err = ioctl(file, uiSetRelBit, code)
+		if err != nil {
+			goto Error
+		}
+	}
+	for _, code := range []uintptr{absX, absY} {
+		err = ioctl(file, uiSetAbsBit, code)
+		if err != nil {
+			goto Error
+		}
+	}
+
+	err = binary.Write(&buf, binary.LittleEndian, &dev)
+	if err != nil {
+		goto Error
+	}
+	_, err = file.Write(buf.Bytes())
+	if err != nil {
+		goto Error
+	}
+	err = ioctl(file, uiDevCreate, 0)
+	if err != nil {
+		goto Error
+	}
+
+	return &UInputBackend{file: file, origin: bounds.Min}, nil
+
+Error:
+	file.Close()
+	return nil, errors.Wrap(err, "Can't create the uinput device")
+}
+
+// emit writes the events followed by the report, the lock must be held
+func (b *UInputBackend) emit(events ...inputEvent) {
+	events = append(events, inputEvent{Type: evSyn, Code: synReport})
+	size := int(unsafe.Sizeof(inputEvent{}))
+	data := make([]byte, 0, size*len(events))
+	for i := range events {
+		data = append(data, (*[1 << 10]byte)(unsafe.Pointer(&events[i]))[:size]...)
+	}
+
+	_, err := b.file.Write(data)
+	if err != nil {
+		logger.Warning(err)
+	}
+}
+
+func uinputKey(code uint16, down bool) inputEvent {
+	value := int32(0)
+	if down {
+		value = 1
+	}
+	return inputEvent{Type: evKey, Code: code, Value: value}
+}
+
+func (b *UInputBackend) MoveMouse(x, y int) {
+	b.Lock()
+	defer b.Unlock()
+	b.emit(inputEvent{Type: evAbs, Code: absX, Value: int32(x - b.origin.X)}, inputEvent{Type: evAbs, Code: absY, Value: int32(y - b.origin.Y)})
+}
+
+// DragMouse moves the mouse, the held button is the state of the device
+func (b *UInputBackend) DragMouse(x, y int, button string) {
+	b.MoveMouse(x, y)
+}
+
+func (b *UInputBackend) MouseToggle(button string, down bool) {
+	b.Lock()
+	defer b.Unlock()
+	code, ok := linuxButtons[button]
+	if !ok {
+		return
+	}
+	b.emit(uinputKey(code, down))
+}
+
+// Scroll sends high resolution offsets for smooth scrolling and whole notches for old clients.
+// The horizontal wheel of Linux scrolls right with positive values
+func (b *UInputBackend) Scroll(dx, dy float64) {
+	b.Lock()
+	defer b.Unlock()
+	x, y := b.scroll.add(dx, dy)
+	events := []inputEvent{
+		{Type: evRel, Code: relWheelHiRes, Value: int32(dy * hiResNotch)},
+		{Type: evRel, Code: relHWheelHiRes, Value: int32(-dx * hiResNotch)},
+	}
+	if y != 0 {
+		events = append(events, inputEvent{Type: evRel, Code: relWheel, Value: int32(y)})
+	}
+	if x != 0 {
+		events = append(events, inputEvent{Type: evRel, Code: relHWheel, Value: int32(-x)})
+	}
+	b.emit(events...)
+}
+
+func (b *UInputBackend) KeyToggle(key string, down bool) {
+	b.Lock()
+	defer b.Unlock()
+	code, ok := linuxKeys[strings.ToLower(key)]
+	if !ok {
+		logger.Debug("Key ", key, " doesn't have a Linux key code")
+		return
+	}
+	b.emit(uinputKey(code, down))
+}
+
+func (b *UInputBackend) TypeText(text string) {
+	b.Lock()
+	defer b.Unlock()
+	for _, r := range text {
+		name := string(r)
+		shift := false
+		switch {
+		case r == ' ':
+			name = "space"
+		case r == '\n':
+			name = "enter"
+		case r == '\t':
+			name = "tab"
+		case r >= 'A' && r <= 'Z':
+			name = strings.ToLower(name)
+			shift = true
+		case shiftedChars[r] != "":
+			name = shiftedChars[r]
+			shift = true
+		}
+
+		code, ok := linuxKeys[name]
+		if !ok {
+			logger.Warning("Can't type ", name, " with uinput")
+			continue
+		}
+		if shift {
+			b.emit(uinputKey(keyLeftShift, true))
+		}
+		b.emit(uinputKey(code, true))
+		b.emit(uinputKey(code, false))
+		if shift {
+			b.emit(uinputKey(keyLeftShift, false))
+		}
+	}
+}
+
+// Close destroys the virtual device
+func (b *UInputBackend) Close() {
+	b.Lock()
+	defer b.Unlock()
+	err := ioctl(b.file, uiDevDestroy, 0)
+	if err != nil {
+		logger.Warning(err)
+	}
+	b.file.Close()
+}
@@ -0,0 +1,30 @@
+package sharingnode
+
+import (
+	"image"
+	"testing"
+)
+
+func TestScreenBoundsSize(t *testing.T) {
+	tests := []struct {
+		size  string
+		want  image.Rectangle
+		valid bool
+	}{
+		{"1920x1080", image.Rect(0, 0, 1920, 1080), true},
+		{" 800x600 ", image.Rect(0, 0, 800, 600), true},
+		{"1920", image.Rectangle{}, false},
+		{"0x1080", image.Rectangle{}, false},
+		{"wide x tall", image.Rectangle{}, false},
+	}
+
+	for _, test := range tests {
+		bounds, err := screenBounds(test.size)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: got error %v", test.size, err)
+		}
+		if bounds != test.want {
+			t.Errorf("%q: got %v, want %v", test.size, bounds, test.want)
+		}
+	}
+}
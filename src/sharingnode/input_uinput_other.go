@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package sharingnode
+
+import "github.com/pkg/errors"
+
+// UInputBackend is available only on Linux
+type UInputBackend struct {
+	InputBackend
+}
+
+func NewUInputBackend(size string) (*UInputBackend, error) {
+	return nil, errors.New("uinput is available only on Linux")
+}
+
+func (b *UInputBackend) Close() {
+}
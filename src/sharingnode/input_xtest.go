@@ -0,0 +1,297 @@
+package sharingnode
+
+import (
+	"github.com/BurntSushi/xgb"
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/BurntSushi/xgb/xtest"
+	"github.com/pkg/errors"
+	"image"
+	"strconv"
+	"sync"
+)
+
+// xKeysyms maps key names of KeyToString to X keysyms, single characters are their own keysyms
+var xKeysyms = map[string]xproto.Keysym{
+	"backspace": 0xff08,
+	"tab":       0xff09,
+	"enter":     0xff0d,
+	"esc":       0xff1b,
+	"delete":    0xffff,
+	"home":      0xff50,
+	"left":      0xff51,
+	"up":        0xff52,
+	"right":     0xff53,
+	"down":      0xff54,
+	"pageup":    0xff55,
+	"pagedown":  0xff56,
+	"end":       0xff57,
+	"print":     0xff61,
+	"insert":    0xff63,
+	"menu":      0xff67,
+	"num_lock":  0xff7f,
+	"num_enter": 0xff8d,
+	"num*":      0xffaa,
+	"num+":      0xffab,
+	"num-":      0xffad,
+	"num.":      0xffae,
+	"num/":      0xffaf,
+	"num_equal": 0xffbd,
+	"lshift":    0xffe1,
+	"rshift":    0xffe2,
+	"lctrl":     0xffe3,
+	"rctrl":     0xffe4,
+	"capslock":  0xffe5,
+	"lalt":      0xffe9,
+	"ralt":      0xffea,
+	"lcmd":      0xffeb,
+	"rcmd":      0xffec,
+	"space":     0x20,
+}
+
+func init() {
+	for i := 0; i < 10; i++ {
+		xKeysyms["num"+strconv.Itoa(i)] = xproto.Keysym(0xffb0 + i)
+	}
+	for i := 1; i <= 24; i++ {
+		xKeysyms["f"+strconv.Itoa(i)] = xproto.Keysym(0xffbe + i - 1)
+	}
+}
+
+// xButtons maps button names of MouseMap to X buttons
+var xButtons = map[string]byte{
+	"left":    1,
+	"center":  2,
+	"right":   3,
+	"back":    8,
+	"forward": 9,
+	"button6": 10,
+	"button7": 11,
+	"button8": 12,
+}
+
+// runeKeysym returns the keysym which types the rune
+func runeKeysym(r rune) xproto.Keysym {
+	switch {
+	case r == '\n':
+		return xKeysyms["enter"]
+	case r == '\t':
+		return xKeysyms["tab"]
+	case r >= 0x20 && r <= 0x7e, r >= 0xa0 && r <= 0xff:
+		return xproto.Keysym(r)
+	}
+	return xproto.Keysym(0x01000000 | r)
+}
+
+type xKey struct {
+	code  xproto.Keycode
+	shift bool
+}
+
+// XTestBackend injects input through the XTEST extension of the X server. Characters which
+// aren't in the keyboard mapping are typed by remapping a spare keycode
+type XTestBackend struct {
+	sync.Mutex
+	conn      *xgb.Conn
+	root      xproto.Window
+	keys      map[xproto.Keysym]xKey
+	perCode   byte
+	spare     xproto.Keycode
+	spareUsed bool
+	scroll    scrollAccumulator
+}
+
+func NewXTestBackend(display string) (*XTestBackend, error) {
+	conn, err := xgb.NewConnDisplay(display)
+	if err != nil {
+		return nil, err
+	}
+
+	setup := xproto.Setup(conn)
+	backend := &XTestBackend{
+		conn: conn,
+		root: setup.DefaultScreen(conn).Root,
+		keys: make(map[xproto.Keysym]xKey),
+	}
+
+	var mapping *xproto.GetKeyboardMappingReply
+	count := int(setup.MaxKeycode) - int(setup.MinKeycode) + 1
+	err = xtest.Init(conn)
+	if err != nil {
+		goto Error
+	}
+
+	mapping, err = xproto.GetKeyboardMapping(conn, setup.MinKeycode, byte(count)).Reply()
+	if err != nil {
+		goto Error
+	}
+
+	backend.perCode = mapping.KeysymsPerKeycode
+	for i := count - 1; i >= 0; i-- {
+		code := xproto.Keycode(int(setup.MinKeycode) + i)
+		syms := mapping.Keysyms[i*int(mapping.KeysymsPerKeycode) : (i+1)*int(mapping.KeysymsPerKeycode)]
+		empty := true
+		for column := len(syms) - 1; column >= 0; column-- {
+			if syms[column] == 0 {
+				continue
+			}
+			empty = false
+			// Lower keycodes and the unshifted column win
+			if column < 2 {
+				backend.keys[syms[column]] = xKey{code, column == 1}
+			}
+		}
+		if empty {
+			backend.spare = code
+		}
+	}
+
+	return backend, nil
+
+Error:
+	conn.Close()
+	return nil, err
+}
+
+func (b *XTestBackend) fake(event byte, detail byte, x, y int) {
+	xtest.FakeInput(b.conn, event, detail, 0, b.root, int16(x), int16(y), 0)
+}
+
+// Pointer returns the pointer position on the root window
+func (b *XTestBackend) Pointer() (image.Point, error) {
+	reply, err := xproto.QueryPointer(b.conn, b.root).Reply()
+	if err != nil {
+		return image.Point{}, err
+	}
+	return image.Pt(int(reply.RootX), int(reply.RootY)), nil
+}
+
+func (b *XTestBackend) MoveMouse(x, y int) {
+	b.Lock()
+	defer b.Unlock()
+	b.fake(xproto.MotionNotify, 0, x, y)
+	b.conn.Sync()
+}
+
+// DragMouse moves the mouse, the X server reports the motion with the held button
+func (b *XTestBackend) DragMouse(x, y int, button string) {
+	b.MoveMouse(x, y)
+}
+
+func (b *XTestBackend) MouseToggle(button string, down bool) {
+	b.Lock()
+	defer b.Unlock()
+	detail, ok := xButtons[button]
+	if !ok {
+		return
+	}
+	event := byte(xproto.ButtonRelease)
+	if down {
+		event = xproto.ButtonPress
+	}
+	b.fake(event, detail, 0, 0)
+	b.conn.Sync()
+}
+
+// clicks presses the wheel button, the lock must be held
+func (b *XTestBackend) clicks(positive, negative byte, count int) {
+	detail := positive
+	if count < 0 {
+		detail = negative
+		count = -count
+	}
+	for i := 0; i < count; i++ {
+		b.fake(xproto.ButtonPress, detail, 0, 0)
+		b.fake(xproto.ButtonRelease, detail, 0, 0)
+	}
+}
+
+// Scroll presses buttons 4 and 5 for vertical and 6 and 7 for horizontal notches
+func (b *XTestBackend) Scroll(dx, dy float64) {
+	b.Lock()
+	defer b.Unlock()
+	x, y := b.scroll.add(dx, dy)
+	b.clicks(4, 5, y)
+	b.clicks(6, 7, x)
+	b.conn.Sync()
+}
+
+// keyToggle presses the keycode, the lock must be held
+func (b *XTestBackend) keyToggle(code xproto.Keycode, down bool) {
+	event := byte(xproto.KeyRelease)
+	if down {
+		event = xproto.KeyPress
+	}
+	b.fake(event, byte(code), 0, 0)
+}
+
+func (b *XTestBackend) KeyToggle(key string, down bool) {
+	b.Lock()
+	defer b.Unlock()
+	sym, ok := xKeysyms[key]
+	if !ok && len(key) == 1 {
+		sym, ok = runeKeysym(rune(key[0])), true
+	}
+	k, found := b.keys[sym]
+	if !ok || !found {
+		logger.Debug("Key ", key, " isn't in the keyboard mapping")
+		return
+	}
+	b.keyToggle(k.code, down)
+	b.conn.Sync()
+}
+
+// remap maps the spare keycode to the keysym, the lock must be held
+func (b *XTestBackend) remap(sym xproto.Keysym) (xKey, error) {
+	if b.spare == 0 {
+		return xKey{}, errors.New("Keyboard mapping doesn't have a spare keycode")
+	}
+	syms := make([]xproto.Keysym, b.perCode)
+	for i := range syms {
+		syms[i] = sym
+	}
+	err := xproto.ChangeKeyboardMappingChecked(b.conn, 1, b.spare, b.perCode, syms).Check()
+	if err != nil {
+		return xKey{}, err
+	}
+	b.spareUsed = true
+	return xKey{code: b.spare}, nil
+}
+
+func (b *XTestBackend) TypeText(text string) {
+	b.Lock()
+	defer b.Unlock()
+	shift := b.keys[xKeysyms["lshift"]]
+	for _, r := range text {
+		k, ok := b.keys[runeKeysym(r)]
+		if !ok {
+			var err error
+			k, err = b.remap(runeKeysym(r))
+			if err != nil {
+				logger.Warning("Can't type ", string(r), ": ", err)
+				continue
+			}
+		}
+
+		if k.shift {
+			b.keyToggle(shift.code, true)
+		}
+		b.keyToggle(k.code, true)
+		b.keyToggle(k.code, false)
+		if k.shift {
+			b.keyToggle(shift.code, false)
+		}
+		b.conn.Sync()
+	}
+}
+
+// Close restores the spare keycode and closes the connection
+func (b *XTestBackend) Close() {
+	b.Lock()
+	defer b.Unlock()
+	if b.spareUsed {
+		syms := make([]xproto.Keysym, b.perCode)
+		xproto.ChangeKeyboardMapping(b.conn, 1, b.spare, b.perCode, syms)
+		b.conn.Sync()
+	}
+	b.conn.Close()
+}
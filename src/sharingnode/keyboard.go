@@ -0,0 +1,104 @@
+package sharingnode
+
+import (
+	"github.com/go-gl/glfw/v3.2/glfw"
+	"unicode/utf8"
+)
+
+// maxTextSize keeps text events in the payload of one binary record
+const maxTextSize = 200
+
+// modifierKeys are keys which set the modifier in the state sent with key events
+var modifierKeys = map[glfw.ModifierKey][]glfw.Key{
+	glfw.ModShift:   {glfw.KeyLeftShift, glfw.KeyRightShift},
+	glfw.ModControl: {glfw.KeyLeftControl, glfw.KeyRightControl},
+	glfw.ModAlt:     {glfw.KeyLeftAlt, glfw.KeyRightAlt},
+	glfw.ModSuper:   {glfw.KeyLeftSuper, glfw.KeyRightSuper},
+}
+
+// keyModifier returns the modifier set by the key, zero for other keys
+func keyModifier(key glfw.Key) glfw.ModifierKey {
+	for mod, keys := range modifierKeys {
+		for _, k := range keys {
+			if k == key {
+				return mod
+			}
+		}
+	}
+	return 0
+}
+
+// printableKey tells that the key produces a character, GLFW reports it with the char callback too
+func printableKey(key glfw.Key) bool {
+	switch {
+	case key >= glfw.KeySpace && key <= glfw.KeyGraveAccent:
+		return true
+	case key == glfw.KeyWorld1 || key == glfw.KeyWorld2:
+		return true
+	case key >= glfw.KeyKP0 && key <= glfw.KeyKPEqual:
+		return key != glfw.KeyKPEnter
+	}
+	return false
+}
+
+// typesText tells that the key is delivered as text. GLFW doesn't report characters of
+// shortcuts with Control or Alt, AltGr combinations are reported as characters
+func typesText(key glfw.Key, mods glfw.ModifierKey) bool {
+	return printableKey(key) && mods&(glfw.ModControl|glfw.ModAlt|glfw.ModSuper) == 0
+}
+
+// hostKey maps the key to the name of the host key. Names from the viewer's layout are
+// preferred, so shortcuts press the key with the same label rather than the same position
+func hostKey(ev *Event) string {
+	if len(ev.Name) == 1 && ev.Name[0] > ' ' && ev.Name[0] < utf8.RuneSelf {
+		return ev.Name
+	}
+	return KeyToString[ev.Key]
+}
+
+// splitText splits the text into parts which fit into text events without breaking runes
+func splitText(text string, size int) []string {
+	var parts []string
+	for len(text) > size {
+		end := size
+		for end > 0 && !utf8.RuneStart(text[end]) {
+			end--
+		}
+		if end == 0 {
+			_, end = utf8.DecodeRuneInString(text)
+		}
+		parts = append(parts, text[:end])
+		text = text[end:]
+	}
+	if text != "" {
+		parts = append(parts, text)
+	}
+	return parts
+}
+
+// stale returns pressed modifier keys which the viewer doesn't hold anymore. The modifier of
+// the key in the event is skipped, because the state is reported before the event is applied
+func (s *inputState) stale(mods glfw.ModifierKey, key glfw.Key) map[glfw.Key]string {
+	own := keyModifier(key)
+	result := make(map[glfw.Key]string)
+	for mod, keys := range modifierKeys {
+		if mods&mod != 0 || mod == own {
+			continue
+		}
+		for _, k := range keys {
+			if name, ok := s.pressed[k]; ok {
+				result[k] = name
+			}
+		}
+	}
+	return result
+}
+
+// mods returns modifiers held on the host by the viewer
+func (s *inputState) mods() glfw.ModifierKey {
+	var mods glfw.ModifierKey
+	for key := range s.pressed {
+		mods |= keyModifier(key)
+	}
+	return mods
+}
@@ -6,6 +6,11 @@ var MouseMap = map[glfw.MouseButton]string{
 	glfw.MouseButton1: "left",
 	glfw.MouseButton2: "right",
 	glfw.MouseButton3: "center",
+	glfw.MouseButton4: "back",
+	glfw.MouseButton5: "forward",
+	glfw.MouseButton6: "button6",
+	glfw.MouseButton7: "button7",
+	glfw.MouseButton8: "button8",
 }
 
 var KeyToString = map[glfw.Key]string{
@@ -0,0 +1,81 @@
+package sharingnode
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"strconv"
+)
+
+// ReaderLimits bound the memory which a peer can make the reader allocate
+type ReaderLimits struct {
+	// MaxPacketSize is the size of one data packet
+	MaxPacketSize int
+	// MaxBatchPackets is the number of packets in one batch of the legacy format
+	MaxBatchPackets int
+	// MaxBuffered is the size of received packets which are not consumed yet
+	MaxBuffered int
+	// MaxEventLine is the size of one batch of events
+	MaxEventLine int
+	// MaxEventBatch is the number of events in one batch
+	MaxEventBatch int
+}
+
+var DefaultReaderLimits = ReaderLimits{
+	MaxPacketSize:   16 << 20,
+	MaxBatchPackets: 1024,
+	MaxBuffered:     64 << 20,
+	MaxEventLine:    64 << 10,
+	MaxEventBatch:   256,
+}
+
+// NewReaderLimits overrides default limits with values from the options
+func NewReaderLimits(options map[string]string) *ReaderLimits {
+	limits := DefaultReaderLimits
+	for key, value := range map[string]*int{
+		"max_packet":      &limits.MaxPacketSize,
+		"max_batch":       &limits.MaxBatchPackets,
+		"max_buffered":    &limits.MaxBuffered,
+		"max_event_line":  &limits.MaxEventLine,
+		"max_event_batch": &limits.MaxEventBatch,
+	} {
+		v, ok := options[key]
+		if !ok {
+			continue
+		}
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 {
+			logger.Warning("Wrong limit ", key, ": ", v)
+			continue
+		}
+		*value = parsed
+	}
+
+	return &limits
+}
+
+// LimitError is returned when the peer exceeds one of the reader limits
+type LimitError struct {
+	Limit string
+	Value int
+	Max   int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s %d exceeds the limit %d", e.Limit, e.Value, e.Max)
+}
+
+func checkLimit(limit string, value, max int) error {
+	if value < 0 || value > max {
+		return &LimitError{
+			Limit: limit,
+			Value: value,
+			Max:   max,
+		}
+	}
+	return nil
+}
+
+var (
+	ErrBadMagic = errors.New("Wrong magic of the data stream")
+	ErrChecksum = errors.New("Checksum mismatch of the data packet")
+)
@@ -0,0 +1,124 @@
+package sharingnode
+
+import (
+	"context"
+	"image"
+	"sync"
+	"time"
+)
+
+// DefaultLocalGrace pauses remote input for this time after the host user moves the mouse
+const DefaultLocalGrace = 2 * time.Second
+
+// localPollInterval is the period of polling the pointer of the host
+const localPollInterval = 100 * time.Millisecond
+
+// injectedHistory is the number of recently injected positions, the poll may see any of them
+const injectedHistory = 16
+
+// PointerSource is the input backend which reads the pointer of the host. Backends which can't
+// read it, like uinput under Wayland, don't implement it and local activity isn't detected
+type PointerSource interface {
+	// Pointer returns the pointer position in the global desktop coordinates
+	Pointer() (image.Point, error)
+}
+
+// LocalActivity detects input of the host user, so it takes priority over remote input. The pointer
+// is polled and moves to positions which weren't injected are the host user's. Local typing
+// isn't detected, because injected keys can't be told apart from physical ones
+type LocalActivity struct {
+	sync.Mutex
+	// Grace is the time remote input stays paused after the last local move
+	Grace    time.Duration
+	injected []image.Point
+	last     image.Point
+	seen     bool
+	until    time.Time
+	paused   bool
+	OnPause  func(paused bool)
+}
+
+func NewLocalActivity(grace time.Duration) *LocalActivity {
+	return &LocalActivity{
+		Grace: grace,
+	}
+}
+
+// Injected remembers the position of the remote pointer, so its move isn't taken for local activity
+func (l *LocalActivity) Injected(position image.Point) {
+	l.Lock()
+	defer l.Unlock()
+	l.injected = append(l.injected, position)
+	if len(l.injected) > injectedHistory {
+		l.injected = l.injected[len(l.injected)-injectedHistory:]
+	}
+}
+
+// remote tells whether the position was injected, backends may round it by a pixel
+func (l *LocalActivity) remote(position image.Point) bool {
+	for _, injected := range l.injected {
+		d := position.Sub(injected)
+		if d.X >= -1 && d.X <= 1 && d.Y >= -1 && d.Y <= 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// observe takes the pointer position at the time, it tells whether the pause started or ended
+func (l *LocalActivity) observe(position image.Point, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.seen && position != l.last && !l.remote(position) {
+		l.until = now.Add(l.Grace)
+	}
+	l.seen = true
+	l.last = position
+
+	paused := now.Before(l.until)
+	changed := paused != l.paused
+	l.paused = paused
+	return changed
+}
+
+// Paused tells whether remote input is suspended
+func (l *LocalActivity) Paused() bool {
+	l.Lock()
+	defer l.Unlock()
+	return l.paused
+}
+
+// Run polls the pointer until the context is done, failed polls are skipped
+func (l *LocalActivity) Run(ctx context.Context, source PointerSource) {
+	ticker := time.NewTicker(localPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			position, err := source.Pointer()
+			if err != nil {
+				logger.Debug("Pointer is not read: ", err)
+				continue
+			}
+			if l.observe(position, now) && l.OnPause != nil {
+				l.OnPause(l.Paused())
+			}
+		}
+	}
+}
+
+// LocalGrace parses the grace period of the input options, zero disables the detection
+func LocalGrace(options map[string]string) time.Duration {
+	value, ok := options["local_grace"]
+	if !ok {
+		return DefaultLocalGrace
+	}
+	grace, err := time.ParseDuration(value)
+	if err != nil || grace < 0 {
+		logger.Warning("Wrong local grace ", value, ", using ", DefaultLocalGrace)
+		return DefaultLocalGrace
+	}
+	return grace
+}
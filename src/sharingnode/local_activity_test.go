@@ -0,0 +1,109 @@
+package sharingnode
+
+import (
+	"context"
+	"image"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLocalActivityObserve(t *testing.T) {
+	const grace = time.Second
+	start := time.Now()
+	at := func(offset time.Duration) time.Time {
+		return start.Add(offset)
+	}
+
+	tests := []struct {
+		name     string
+		injected []image.Point
+		position image.Point
+		now      time.Time
+		changed  bool
+		paused   bool
+	}{
+		{"first position", nil, image.Pt(10, 10), at(0), false, false},
+		{"still pointer", nil, image.Pt(10, 10), at(100 * time.Millisecond), false, false},
+		{"injected move", []image.Point{image.Pt(50, 50)}, image.Pt(50, 50), at(200 * time.Millisecond), false, false},
+		{"rounded injected move", []image.Point{image.Pt(80, 80)}, image.Pt(81, 79), at(300 * time.Millisecond), false, false},
+		{"local move", nil, image.Pt(200, 200), at(400 * time.Millisecond), true, true},
+		{"during grace", nil, image.Pt(200, 200), at(400*time.Millisecond + grace/2), false, true},
+		{"injected move during grace", []image.Point{image.Pt(5, 5)}, image.Pt(5, 5), at(400*time.Millisecond + grace*3/4), false, true},
+		{"after grace", nil, image.Pt(5, 5), at(400*time.Millisecond + grace), true, false},
+	}
+
+	local := NewLocalActivity(grace)
+	for _, test := range tests {
+		for _, position := range test.injected {
+			local.Injected(position)
+		}
+		if changed := local.observe(test.position, test.now); changed != test.changed {
+			t.Errorf("%s: changed %v, want %v", test.name, changed, test.changed)
+		}
+		if paused := local.Paused(); paused != test.paused {
+			t.Errorf("%s: paused %v, want %v", test.name, paused, test.paused)
+		}
+	}
+}
+
+func TestLocalActivityHistory(t *testing.T) {
+	local := NewLocalActivity(time.Second)
+	now := time.Now()
+	local.observe(image.Pt(0, 0), now)
+
+	for i := 1; i <= injectedHistory+1; i++ {
+		local.Injected(image.Pt(i*10, 0))
+	}
+	// The poll may see any of the recent positions
+	for i := injectedHistory + 1; i >= 2; i-- {
+		local.observe(image.Pt(i*10, 0), now)
+		if local.Paused() {
+			t.Fatalf("injected position %d is taken for local activity", i)
+		}
+	}
+	// The oldest position is forgotten
+	local.observe(image.Pt(10, 0), now)
+	if !local.Paused() {
+		t.Error("the forgotten position isn't taken for local activity")
+	}
+}
+
+// fakePointer is the pointer source which moves to the position of the host user
+type fakePointer struct {
+	sync.Mutex
+	position image.Point
+}
+
+func (p *fakePointer) Pointer() (image.Point, error) {
+	p.Lock()
+	defer p.Unlock()
+	return p.position, nil
+}
+
+func TestLocalActivityRun(t *testing.T) {
+	local := NewLocalActivity(time.Hour)
+	pauses := make(chan bool, 1)
+	local.OnPause = func(paused bool) {
+		pauses <- paused
+	}
+
+	pointer := &fakePointer{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go local.Run(ctx, pointer)
+
+	time.Sleep(3 * localPollInterval)
+	pointer.Lock()
+	pointer.position = image.Pt(100, 100)
+	pointer.Unlock()
+
+	select {
+	case paused := <-pauses:
+		if !paused {
+			t.Error("remote input is resumed by the local move")
+		}
+	case <-time.After(20 * localPollInterval):
+		t.Fatal("the local move isn't detected")
+	}
+}
@@ -0,0 +1,213 @@
+package sharingnode
+
+import (
+	"github.com/go-gl/glfw/v3.2/glfw"
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// macroText starts the step which types the rest of the macro
+const macroText = "text:"
+
+// chordKeys are pressed for modifiers of chords in this order
+var chordKeys = []struct {
+	mod glfw.ModifierKey
+	key glfw.Key
+}{
+	{glfw.ModControl, glfw.KeyLeftControl},
+	{glfw.ModAlt, glfw.KeyLeftAlt},
+	{glfw.ModShift, glfw.KeyLeftShift},
+	{glfw.ModSuper, glfw.KeyLeftSuper},
+}
+
+var stringToKey = make(map[string]glfw.Key)
+
+func init() {
+	for key, name := range KeyToString {
+		stringToKey[name] = key
+	}
+}
+
+// chordKey returns the key of the name, modifier names press the left modifier key
+func chordKey(name string) (glfw.Key, bool) {
+	if mod, ok := chordModifiers[name]; ok {
+		for _, m := range chordKeys {
+			if m.mod == mod {
+				return m.key, true
+			}
+		}
+	}
+	key, ok := stringToKey[name]
+	return key, ok
+}
+
+// MacroStep presses the chord or types the text
+type MacroStep struct {
+	Chord KeyChord
+	Text  string
+}
+
+// Macro is the sequence of steps which the viewer sends at once
+type Macro []MacroStep
+
+// ParseMacro parses chords separated by spaces, like "ctrl+a ctrl+c". The text: step types
+// the rest of the definition, so "ctrl+a text:hello world" replaces the selection
+func ParseMacro(definition string) (Macro, error) {
+	var macro Macro
+	rest := strings.TrimSpace(definition)
+	for rest != "" {
+		if strings.HasPrefix(rest, macroText) {
+			macro = append(macro, MacroStep{Text: rest[len(macroText):]})
+			break
+		}
+
+		step := rest
+		rest = ""
+		if i := strings.IndexByte(step, ' '); i >= 0 {
+			step, rest = step[:i], strings.TrimSpace(step[i+1:])
+		}
+		chord, err := ParseKeyChord(step)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := chordKey(chord.Key); !ok {
+			return nil, errors.Errorf("Unknown key %s in macro %s", chord.Key, definition)
+		}
+		macro = append(macro, MacroStep{Chord: chord})
+	}
+	if len(macro) == 0 {
+		return nil, errors.New("Macro is empty")
+	}
+
+	return macro, nil
+}
+
+// chordEvents presses modifiers of the chord, then presses and releases the key and releases
+// modifiers in reverse order
+func chordEvents(chord KeyChord) events {
+	key, _ := chordKey(chord.Key)
+	var mods glfw.ModifierKey
+	var held []glfw.Key
+	var evs events
+	for _, m := range chordKeys {
+		if chord.Mods&m.mod == 0 {
+			continue
+		}
+		mods |= m.mod
+		held = append(held, m.key)
+		evs = append(evs, &Event{Type: KeyDown, Key: m.key, Mods: mods})
+	}
+
+	evs = append(evs, &Event{Type: KeyDown, Key: key, Mods: mods}, &Event{Type: KeyUp, Key: key, Mods: mods})
+	for i := len(held) - 1; i >= 0; i-- {
+		mods &^= keyModifier(held[i])
+		evs = append(evs, &Event{Type: KeyUp, Key: held[i], Mods: mods})
+	}
+	return evs
+}
+
+// textKeyEvents types the text with key events for hosts without text input. Characters
+// without their own key are skipped
+func textKeyEvents(text string) events {
+	var evs events
+	for _, r := range text {
+		chord := KeyChord{Key: strings.ToLower(string(r))}
+		switch {
+		case r == ' ':
+			chord.Key = "space"
+		case r == '\n':
+			chord.Key = "enter"
+		case r == '\t':
+			chord.Key = "tab"
+		case unicode.IsUpper(r):
+			chord.Mods = glfw.ModShift
+		}
+
+		if _, ok := stringToKey[chord.Key]; !ok {
+			logger.Warning("Can't type ", string(r), " without text input")
+			continue
+		}
+		evs = append(evs, chordEvents(chord)...)
+	}
+	return evs
+}
+
+// events returns events of the macro, text is typed by text events if the host supports them
+func (m Macro) events(text bool) events {
+	var evs events
+	for _, step := range m {
+		switch {
+		case step.Chord.Key != "":
+			evs = append(evs, chordEvents(step.Chord)...)
+		case text:
+			for _, part := range splitText(step.Text, maxTextSize) {
+				evs = append(evs, &Event{Type: TextInput, Text: part})
+			}
+		default:
+			evs = append(evs, textKeyEvents(step.Text)...)
+		}
+	}
+	return evs
+}
+
+// MacroNames returns names of the macros in order
+func MacroNames(macros map[string]string) []string {
+	names := make([]string, 0, len(macros))
+	for name := range macros {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MacroSender sends macros of the config and of the user to the running viewer session
+type MacroSender struct {
+	sync.Mutex
+	macros map[string]string
+	sender *EventSender
+}
+
+func NewMacroSender(macros map[string]string) *MacroSender {
+	return &MacroSender{
+		macros: macros,
+	}
+}
+
+// SetSender sets the event sender of the session which has control, nil stops sending
+func (m *MacroSender) SetSender(sender *EventSender) {
+	m.Lock()
+	defer m.Unlock()
+	m.sender = sender
+}
+
+func (m *MacroSender) Names() []string {
+	return MacroNames(m.macros)
+}
+
+// Send parses the definition of ParseMacro and sends it
+func (m *MacroSender) Send(definition string) error {
+	m.Lock()
+	sender := m.sender
+	m.Unlock()
+	if sender == nil {
+		return errors.New("There is no session which controls the remote screen")
+	}
+
+	macro, err := ParseMacro(definition)
+	if err != nil {
+		return err
+	}
+	return sender.SendMacro(macro)
+}
+
+// SendNamed sends the macro of the config
+func (m *MacroSender) SendNamed(name string) error {
+	definition, ok := m.macros[name]
+	if !ok {
+		return errors.Errorf("Macro %s doesn't exist", name)
+	}
+	return m.Send(definition)
+}
@@ -0,0 +1,60 @@
+package sharingnode
+
+import (
+	"sync"
+	"time"
+)
+
+// maxClockLead is the longest wait for a packet, packets further ahead restart the clock
+const maxClockLead = 2 * time.Second
+
+// hostTime is the timestamp of packets in microseconds, audio and video of the host share it
+func hostTime(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Microsecond)
+}
+
+// MediaClock maps host timestamps to the local time. Audio and video share the clock, so they
+// play in sync. Packets which come later than the latency move the clock for both media
+type MediaClock struct {
+	sync.Mutex
+	latency time.Duration
+	base    time.Time
+	stopped bool
+}
+
+func NewMediaClock(latency time.Duration) *MediaClock {
+	return &MediaClock{
+		latency: latency,
+	}
+}
+
+// Due returns the local time when the packet with pts in microseconds must be played
+func (c *MediaClock) Due(pts int64, now time.Time) time.Time {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.stopped {
+		return now
+	}
+
+	offset := time.Duration(pts) * time.Microsecond
+	due := c.base.Add(offset)
+	if c.base.IsZero() || now.Sub(due) > c.latency || due.Sub(now) > c.latency+maxClockLead {
+		c.base = now.Add(c.latency - offset)
+		due = c.base.Add(offset)
+	}
+
+	return due
+}
+
+// Wait sleeps until the packet with pts in microseconds must be played
+func (c *MediaClock) Wait(pts int64) {
+	time.Sleep(time.Until(c.Due(pts, time.Now())))
+}
+
+// Stop plays packets at once, when one of the media is gone the other one doesn't wait for it
+func (c *MediaClock) Stop() {
+	c.Lock()
+	defer c.Unlock()
+	c.stopped = true
+}
@@ -0,0 +1,43 @@
+package sharingnode
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMediaClock(t *testing.T) {
+	const latency = 100 * time.Millisecond
+	now := time.Unix(1000, 0)
+	host := hostTime(now)
+	clock := NewMediaClock(latency)
+
+	// The first packet starts the clock with the latency
+	if due := clock.Due(host, now); due != now.Add(latency) {
+		t.Fatalf("first packet is due at %v, want %v", due, now.Add(latency))
+	}
+
+	// Video of the same host time plays with audio
+	if due := clock.Due(host+20000, now.Add(5*time.Millisecond)); due != now.Add(latency+20*time.Millisecond) {
+		t.Errorf("second packet is due at %v", due)
+	}
+
+	// Packets later than the latency move the clock for both media
+	late := now.Add(time.Second)
+	if due := clock.Due(host+40000, late); due != late.Add(latency) {
+		t.Errorf("late packet is due at %v, want %v", due, late.Add(latency))
+	}
+	if due := clock.Due(host+60000, late); due != late.Add(latency+20*time.Millisecond) {
+		t.Errorf("packet after the late one is due at %v", due)
+	}
+
+	// Packets too far ahead don't hold the other media
+	ahead := host + int64(time.Hour/time.Microsecond)
+	if due := clock.Due(ahead, late); due != late.Add(latency) {
+		t.Errorf("packet ahead is due at %v, want %v", due, late.Add(latency))
+	}
+
+	clock.Stop()
+	if due := clock.Due(host, late); due != late {
+		t.Errorf("stopped clock delays packets until %v", due)
+	}
+}
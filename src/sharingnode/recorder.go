@@ -0,0 +1,458 @@
+package sharingnode
+
+// #cgo pkg-config: libavcodec libavutil
+// #include <stdlib.h>
+// #include <string.h>
+// #include <libavcodec/avcodec.h>
+// #include <libavutil/mem.h>
+import "C"
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/imkira/go-libav/avcodec"
+	"github.com/imkira/go-libav/avformat"
+	"github.com/imkira/go-libav/avutil"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+var recordingExtensions = map[string]string{
+	"matroska": "mkv",
+	"mp4":      "mp4",
+}
+
+// RecordingPath creates a new empty file for the recording in the directory and returns its name.
+// Names of recordings started in the same moment get a counter, so none is overwritten
+func RecordingPath(dir, format string) (string, error) {
+	ext, ok := recordingExtensions[format]
+	if !ok {
+		return "", errors.Errorf("Unsupported recording format %s", format)
+	}
+
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return "", err
+	}
+
+	stamp := time.Now().Format("20060102-150405.000")
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("session-%s.%s", stamp, ext)
+		if i > 0 {
+			name = fmt.Sprintf("session-%s-%d.%s", stamp, i, ext)
+		}
+		path := filepath.Join(dir, name)
+
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return path, file.Close()
+	}
+}
+
+// isKeyFrame inspects the bitstream of the encoded packet
+func isKeyFrame(codec string, data []byte) bool {
+	switch codec {
+	case "h264", "h264-lossless":
+		for i := 0; i+3 < len(data); i++ {
+			if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 {
+				nalType := data[i+3] & 0x1f
+				if nalType == 5 || nalType == 7 {
+					return true
+				}
+			}
+		}
+		return false
+	case "vp8":
+		return len(data) > 0 && data[0]&0x1 == 0
+	case "vp9":
+		if len(data) == 0 {
+			return false
+		}
+		// frame_marker(2) profile_low(1) profile_high(1) [reserved(1)] show_existing_frame(1) frame_type(1)
+		bit := uint(2)
+		profile := (data[0]>>5)&0x1 | (data[0]>>3)&0x2
+		bit += 2
+		if profile == 3 {
+			bit++
+		}
+		if (data[0]>>(7-bit))&0x1 == 1 {
+			return false
+		}
+		bit++
+		return (data[0]>>(7-bit))&0x1 == 0
+	case "av1":
+		// Encoders start key frames with the sequence header OBU
+		for len(data) > 0 {
+			header := data[0]
+			if (header>>3)&0xf == 1 {
+				return true
+			}
+			// The last OBU may have no size
+			if header&0x2 == 0 {
+				return false
+			}
+			offset := 1
+			if header&0x4 != 0 {
+				offset++
+			}
+			if offset > len(data) {
+				return false
+			}
+			size, n := binary.Uvarint(data[offset:])
+			if n <= 0 || size > uint64(len(data)-offset-n) {
+				return false
+			}
+			data = data[offset+n+int(size):]
+		}
+		return false
+	case "ffv1":
+		return true
+	}
+
+	return false
+}
+
+// annexBUnits splits the Annex B stream into NAL units without start codes
+func annexBUnits(data []byte) [][]byte {
+	var units [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 && i > start {
+			units = append(units, bytes.TrimRight(data[start:i], "\x00"))
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(data) {
+		units = append(units, data[start:])
+	}
+
+	return units
+}
+
+// parameterSets returns SPS and PPS of the h264 key frame, containers keep them in the extradata
+func parameterSets(codec string, data []byte) []byte {
+	if codec != "h264" && codec != "h264-lossless" {
+		return nil
+	}
+
+	var sets []byte
+	for _, unit := range annexBUnits(data) {
+		if len(unit) == 0 {
+			continue
+		}
+		if nalType := unit[0] & 0x1f; nalType == 7 || nalType == 8 {
+			sets = append(sets, 0, 0, 0, 1)
+			sets = append(sets, unit...)
+		}
+	}
+
+	return sets
+}
+
+// Recorder muxes encoded video packets into a container file with timestamps of the packets.
+// The header is written with the first key frame, so the container gets its parameter sets
+type Recorder struct {
+	sync.Mutex
+	Path          string
+	codec         *VideoCodec
+	formatContext *avformat.Context
+	ioContext     *avformat.IOContext
+	stream        *avformat.Stream
+	packet        *avcodec.Packet
+	// first is the pts of the first key frame, the recording starts from it
+	first       int64
+	next        int64
+	keyReceived bool
+	size        DisplayInfo
+}
+
+func NewRecorder(path, format string, videoCodec *VideoCodec, width, height, frameRate int) (*Recorder, error) {
+	recorder := &Recorder{
+		Path:  path,
+		codec: videoCodec,
+		size:  DisplayInfo{width, height},
+	}
+
+	var err error
+	var codecContext *avcodec.Context
+	decoder := videoCodec.FindDecoder()
+	output := avformat.GuessOutputFromShortName(format)
+	if output == nil {
+		err = errors.Errorf("Recording format %s not found", format)
+		goto Error
+	}
+	if decoder == nil {
+		err = errors.Errorf("Codec %s is not supported", videoCodec.Name)
+		goto Error
+	}
+
+	recorder.formatContext, err = avformat.NewContextForOutput(output)
+	if err != nil {
+		goto Error
+	}
+	recorder.formatContext.SetFileName(path)
+
+	recorder.ioContext, err = avformat.OpenIOContext(path, avformat.IOFlagWrite, nil, nil)
+	if err != nil {
+		goto Error
+	}
+	recorder.formatContext.SetIOContext(recorder.ioContext)
+
+	recorder.stream, err = recorder.formatContext.NewStream()
+	if err != nil {
+		goto Error
+	}
+
+	codecContext = recorder.stream.CodecContext()
+	codecContext.SetCodecType(avutil.MediaTypeVideo)
+	codecContext.SetCodecID(decoder.ID())
+	codecContext.SetWidth(width)
+	codecContext.SetHeight(height)
+	codecContext.SetPixelFormat(avutil.PIX_FMT_YUV420P)
+	recorder.stream.SetTimeBase(avutil.NewRational(1, 1000))
+	if frameRate > 0 {
+		recorder.stream.SetAverageFrameRate(avutil.NewRational(frameRate, 1))
+	}
+
+	recorder.packet, err = avcodec.NewPacket()
+	if err != nil {
+		goto Error
+	}
+
+	return recorder, nil
+
+Error:
+	recorder.Close()
+	return nil, err
+}
+
+// Size is the size of the recorded video
+func (r *Recorder) Size() DisplayInfo {
+	return r.size
+}
+
+// writeHeader starts the file with the parameter sets of the key frame, MP4 can't play h264 without them
+func (r *Recorder) writeHeader(key []byte) error {
+	sets := parameterSets(r.codec.Name, key)
+	if len(sets) > 0 {
+		// The stream frees the extradata
+		extradata := C.av_mallocz(C.size_t(len(sets) + C.AV_INPUT_BUFFER_PADDING_SIZE))
+		C.memcpy(extradata, unsafe.Pointer(&sets[0]), C.size_t(len(sets)))
+		codecContext := r.stream.CodecContext()
+		codecContext.SetExtraData(extradata)
+		codecContext.SetExtraDataSize(len(sets))
+	}
+
+	return r.formatContext.WriteHeader(nil)
+}
+
+// WriteVideo stores the encoded packet at its pts. Packets before the first key frame are dropped
+func (r *Recorder) WriteVideo(packet *Packet) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.formatContext == nil || r.packet == nil {
+		return errors.New("Recorder already closed")
+	}
+
+	// Packets of the legacy format don't carry the time, they are recorded when they come
+	pts := packet.PTS
+	if pts == 0 {
+		pts = hostTime(time.Now())
+	}
+
+	key := packet.Key() || isKeyFrame(r.codec.Name, packet.Data)
+	if !r.keyReceived {
+		if !key {
+			return nil
+		}
+		err := r.writeHeader(packet.Data)
+		if err != nil {
+			return err
+		}
+		r.keyReceived = true
+		r.first = pts
+	}
+
+	r.packet.SetData(packet.Data)
+	defer C.free(r.packet.Data())
+	r.packet.SetSize(len(packet.Data))
+	r.packet.SetStreamIndex(r.stream.Index())
+	r.packet.SetPTS(pts - r.first)
+	r.packet.SetDTS(pts - r.first)
+	if key {
+		r.packet.SetFlags(avcodec.PacketFlagKey)
+	} else {
+		r.packet.SetFlags(0)
+	}
+	r.packet.RescaleTime(avutil.NewRational(1, int(time.Second/time.Microsecond)), r.stream.TimeBase())
+	// Muxers need increasing timestamps, packets closer than the time base are moved
+	if r.packet.DTS() < r.next {
+		r.packet.SetPTS(r.next)
+		r.packet.SetDTS(r.next)
+	}
+	r.next = r.packet.DTS() + 1
+
+	return r.formatContext.InterleavedWriteFrame(r.packet)
+}
+
+func (r *Recorder) Close() {
+	r.Lock()
+	defer r.Unlock()
+	if r.formatContext != nil {
+		if r.keyReceived {
+			err := r.formatContext.WriteTrailer()
+			if err != nil {
+				logger.Warning(err)
+			}
+		}
+		r.formatContext.Free()
+		r.formatContext = nil
+	}
+	if r.ioContext != nil {
+		err := r.ioContext.Close()
+		if err != nil {
+			logger.Warning(err)
+		}
+		r.ioContext = nil
+	}
+	if r.packet != nil {
+		r.packet.Free()
+		r.packet = nil
+	}
+}
+
+// SessionRecorder lets the viewer start and stop recording of the running stream
+type SessionRecorder struct {
+	sync.Mutex
+	options   map[string]string
+	codec     *VideoCodec
+	width     int
+	height    int
+	frameRate int
+	recorder  *Recorder
+	onChange  func(bool)
+}
+
+func NewSessionRecorder(options map[string]string, videoCodec *VideoCodec, width, height, frameRate int, onChange func(bool)) *SessionRecorder {
+	return &SessionRecorder{
+		options:   options,
+		codec:     videoCodec,
+		width:     width,
+		height:    height,
+		frameRate: frameRate,
+		onChange:  onChange,
+	}
+}
+
+func (s *SessionRecorder) Start() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.recorder != nil {
+		return nil
+	}
+
+	path, err := RecordingPath(s.options["path"], s.options["format"])
+	if err != nil {
+		return err
+	}
+
+	s.recorder, err = NewRecorder(path, s.options["format"], s.codec, s.width, s.height, s.frameRate)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	logger.Info("Recording to ", path)
+	if s.onChange != nil {
+		s.onChange(true)
+	}
+
+	return nil
+}
+
+func (s *SessionRecorder) Stop() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.recorder == nil {
+		return
+	}
+
+	s.recorder.Close()
+	s.recorder = nil
+	if s.onChange != nil {
+		s.onChange(false)
+	}
+}
+
+// Resize applies the change of the stream, the running recording continues in a new file
+func (s *SessionRecorder) Resize(update *StreamUpdate) error {
+	s.Lock()
+	defer s.Unlock()
+
+	resized := s.width != update.Output.Width || s.height != update.Output.Height
+	s.width, s.height = update.Output.Width, update.Output.Height
+	s.frameRate = update.FrameRate
+	if s.recorder == nil || !resized {
+		return nil
+	}
+
+	s.recorder.Close()
+	s.recorder = nil
+	path, err := RecordingPath(s.options["path"], s.options["format"])
+	if err == nil {
+		s.recorder, err = NewRecorder(path, s.options["format"], s.codec, s.width, s.height, s.frameRate)
+		if err != nil {
+			os.Remove(path)
+		}
+	}
+	if err != nil {
+		if s.onChange != nil {
+			s.onChange(false)
+		}
+		return err
+	}
+
+	logger.Info("Recording continues to ", path)
+	return nil
+}
+
+func (s *SessionRecorder) Recording() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.recorder != nil
+}
+
+func (s *SessionRecorder) WriteVideo(packet *Packet) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.recorder == nil {
+		return
+	}
+
+	err := s.recorder.WriteVideo(packet)
+	if err != nil {
+		logger.Error(err)
+		s.recorder.Close()
+		s.recorder = nil
+		if s.onChange != nil {
+			s.onChange(false)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package sharingnode
+
+import (
+	"github.com/imkira/go-libav/avcodec"
+	"github.com/imkira/go-libav/avformat"
+	"github.com/imkira/go-libav/avutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readRecording returns timestamps of packets of the recording in microseconds and the size of the extradata
+func readRecording(tb testing.TB, path string) ([]int64, int) {
+	formatContext, err := avformat.NewContextForInput()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer formatContext.Free()
+
+	err = formatContext.OpenInput(path, nil, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer formatContext.CloseInput()
+
+	err = formatContext.FindStreamInfo(nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	stream := formatContext.Streams()[0]
+
+	packet, err := avcodec.NewPacket()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer packet.Free()
+
+	var timestamps []int64
+	for {
+		done, err := formatContext.ReadFrame(packet)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if !done {
+			break
+		}
+		packet.RescaleTime(stream.TimeBase(), avutil.NewRational(1, int(time.Second/time.Microsecond)))
+		timestamps = append(timestamps, packet.PTS())
+		packet.Unref()
+	}
+
+	return timestamps, stream.CodecContext().ExtraDataSize()
+}
+
+func TestRecorder(t *testing.T) {
+	const width, height, packets = 96, 64, 10
+
+	codec, err := FindVideoCodec("h264")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := encodeTestPattern(t, codec, width, height, packets)
+	// The recording starts from a key frame
+	encoded = append([]*Packet{{Type: PacketVideo, PTS: encoded[0].PTS - 1000, Data: []byte{0, 0, 1, 1}}}, encoded...)
+
+	for format, ext := range recordingExtensions {
+		t.Run(format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "session."+ext)
+			recorder, err := NewRecorder(path, format, codec, width, height, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, packet := range encoded {
+				err = recorder.WriteVideo(packet)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			recorder.Close()
+
+			timestamps, extradata := readRecording(t, path)
+			if extradata == 0 {
+				t.Error("the recording doesn't have parameter sets in the extradata")
+			}
+			if len(timestamps) != packets {
+				t.Fatalf("got %d packets, want %d", len(timestamps), packets)
+			}
+			// Timestamps follow the capture within the millisecond of the container
+			for i, pts := range timestamps {
+				want := encoded[i+1].PTS - encoded[1].PTS
+				if pts < want-1000 || pts > want+1000 {
+					t.Errorf("packet %d is recorded at %d, captured at %d", i, pts, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParameterSets(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0xc0, 0x1e}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	idr := []byte{0x65, 0x88, 0x84, 0x00, 0x21}
+	var frame []byte
+	for _, unit := range [][]byte{sps, pps, idr} {
+		frame = append(append(frame, 0, 0, 0, 1), unit...)
+	}
+
+	sets := parameterSets("h264", frame)
+	want := append(append([]byte{0, 0, 0, 1}, sps...), append([]byte{0, 0, 0, 1}, pps...)...)
+	if string(sets) != string(want) {
+		t.Errorf("got % x, want % x", sets, want)
+	}
+	if sets := parameterSets("vp8", frame); sets != nil {
+		t.Errorf("vp8 has parameter sets % x", sets)
+	}
+}
+
+func TestRecordingPath(t *testing.T) {
+	dir := t.TempDir()
+	names := make(map[string]bool)
+	// Recordings started in the same moment get their own files
+	for i := 0; i < 3; i++ {
+		path, err := RecordingPath(dir, "matroska")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names[path] {
+			t.Fatalf("%s is returned twice", path)
+		}
+		names[path] = true
+	}
+
+	_, err := RecordingPath(dir, "avi")
+	if err == nil {
+		t.Error("unsupported format has a path")
+	}
+}
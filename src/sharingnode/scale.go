@@ -0,0 +1,72 @@
+package sharingnode
+
+// #cgo pkg-config: libswscale
+// #include <libswscale/swscale.h>
+import "C"
+import (
+	"github.com/imkira/go-libav/swscale"
+	"github.com/pkg/errors"
+	"unsafe"
+)
+
+const DefaultScaleAlgorithm = "bicubic"
+
+var scaleAlgorithms = map[string]C.int{
+	"point":         C.SWS_POINT,
+	"fast_bilinear": C.SWS_FAST_BILINEAR,
+	"bilinear":      C.SWS_BILINEAR,
+	"bicubic":       C.SWS_BICUBIC,
+	"area":          C.SWS_AREA,
+	"lanczos":       C.SWS_LANCZOS,
+}
+
+// newScaleContext is swscale.NewContext with the selectable algorithm
+func newScaleContext(input, output *swscale.DataDescription, algorithm string) (*swscale.Context, error) {
+	if algorithm == "" {
+		algorithm = DefaultScaleAlgorithm
+	}
+	flags, ok := scaleAlgorithms[algorithm]
+	if !ok {
+		return nil, errors.Errorf("Unknown scaling algorithm %s", algorithm)
+	}
+
+	ctx := C.sws_getContext(
+		C.int(input.Width), C.int(input.Height), (C.enum_AVPixelFormat)(input.PixFmt),
+		C.int(output.Width), C.int(output.Height), (C.enum_AVPixelFormat)(output.PixFmt),
+		flags, nil, nil, nil,
+	)
+	if ctx == nil {
+		return nil, swscale.ErrAllocationError
+	}
+
+	return swscale.NewContextFromC(unsafe.Pointer(ctx)), nil
+}
+
+// OutputSize returns the size of the encoded video for the display. The video is never upscaled
+// and the scaled size is even, because YUV420P encoders require it
+func OutputSize(options *ScreenOptions, display DisplayInfo) DisplayInfo {
+	output := display
+	switch {
+	case options.Width > 0 && options.Height > 0:
+		output = DisplayInfo{options.Width, options.Height}
+	case options.Width > 0 && display.Width > 0:
+		output = DisplayInfo{options.Width, display.Height * options.Width / display.Width}
+	case options.Height > 0 && display.Height > 0:
+		output = DisplayInfo{display.Width * options.Height / display.Height, options.Height}
+	case options.Scale > 0 && options.Scale < 1:
+		output = DisplayInfo{int(float64(display.Width) * options.Scale), int(float64(display.Height) * options.Scale)}
+	}
+
+	if output.Width > display.Width || output.Height > display.Height {
+		return display
+	}
+	if output != display {
+		output.Width &^= 1
+		output.Height &^= 1
+		if output.Width < 2 || output.Height < 2 {
+			return display
+		}
+	}
+
+	return output
+}
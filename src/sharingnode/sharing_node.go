@@ -6,12 +6,12 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"fyne.io/fyne"
 	"fyne.io/fyne/app"
 	"fyne.io/fyne/canvas"
 	"github.com/go-gl/glfw/v3.2/glfw"
 	"github.com/ipfs/go-log"
-	"github.com/kbinani/screenshot"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/libp2p/go-libp2p-core/protocol"
@@ -21,27 +21,70 @@ import (
 	"io"
 	"os"
 	"runtime/pprof"
+	"strconv"
+	"sync"
+	"sync/atomic"
 )
 
 var logger = log.Logger("sharingnode")
 
+// ShareOptions describes how the viewer session is started
+type ShareOptions struct {
+	// Record starts recording as soon as the stream is received
+	Record bool
+	// ViewOnly doesn't ask for the event stream, so the remote screen can't be controlled
+	ViewOnly bool
+	// Audio asks for the audio stream, the host decides on it like on control
+	Audio bool
+	// Macros receives the event sender of the session, so client commands reach it
+	Macros *MacroSender
+}
+
 type SharingNode struct {
 	*node.Node
 	*config.SharingOptions
 	StreamService *StreamService
+	Control       *ControlArbiter
+	// Input injects events of the viewer which controls the screen
+	Input InputBackend
+	// Macros are sent to the screen of the running viewer session
+	Macros *MacroSender
+	// Local pauses remote input while the host user moves the mouse
+	Local   *LocalActivity
+	allower *GUIAllower
 }
 
 func NewSharingNode(ctx context.Context, config *config.SharingConfig) *SharingNode {
 	n := node.NewNode(ctx, config.BootstrapConfig)
+	control := NewControlArbiter()
+	control.OnRequest = func(id peer.ID) {
+		fmt.Printf("The remote node %s requests control of your screen, use \"grant %s\" to pass it\n", id, id)
+	}
+	control.OnChange = func(holder peer.ID) {
+		if holder == "" {
+			fmt.Println("Nobody controls your screen")
+		} else {
+			fmt.Printf("The remote node %s controls your screen\n", holder)
+		}
+	}
+
 	return &SharingNode{
 		n,
 		config.SharingOptions,
 		nil,
+		control,
+		nil,
+		NewMacroSender(config.SharingOptions.Macros),
+		nil,
+		nil,
 	}
 }
 
-func (n *SharingNode) BootStrap() {
-	n.Node.BootStrap()
+func (n *SharingNode) BootStrap() error {
+	err := n.Node.BootStrap()
+	if err != nil {
+		return err
+	}
 
 	for _, p := range n.Config.Protocols {
 		switch p {
@@ -49,13 +92,52 @@ func (n *SharingNode) BootStrap() {
 			n.Node.Host.SetStreamHandler(protocol.ID(p), n.handleScreenStream)
 		case config.EventID:
 			n.Node.Host.SetStreamHandler(protocol.ID(p), n.handleScreenEvent)
+		case config.AudioID:
+			n.Node.Host.SetStreamHandler(protocol.ID(p), n.handleAudioStream)
 		}
 	}
-	n.AccessVerifier = node.NewAccessVerifier(n.AccessStore, NewGUIAllower(n.Config), n.Host, n.Context, n.DataDht)
-	n.StreamService = NewStreamService()
+	n.allower = NewGUIAllower(n.Config)
+	n.AccessVerifier = node.NewAccessVerifier(n.AccessStore, n.allower, n.Host, n.Context, n.DataDht)
+	// Viewers which were allowed only the stream don't ask for control or audio on every connection
+	n.AccessVerifier.QuietDenial = map[protocol.ID]bool{config.EventID: true, config.AudioID: true}
+	n.StreamService = NewStreamService(n.SharingOptions)
+	// The stream is shared by all viewers, so only the viewer in control changes it
+	n.StreamService.Allowed = n.Control.Allowed
+	n.StreamService.OnChange = func(remote peer.ID, change *StreamChange) {
+		fmt.Printf("The remote node %s changed the stream: %s\n", remote, change)
+	}
+	n.StreamService.OnRecording = n.notifyRecording
+	n.Input, err = NewInputBackend(n.InputOptions, n.CaptureOptions)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-n.Context.Done()
+		n.Input.Close()
+	}()
+
+	grace := LocalGrace(n.InputOptions)
+	source, ok := n.Input.(PointerSource)
+	if grace > 0 && !ok {
+		logger.Warning("Pointer can't be read with the ", n.InputOptions["backend"], " input backend, remote input isn't paused while you use the mouse")
+	}
+	if grace > 0 && ok {
+		n.Local = NewLocalActivity(grace)
+		n.Local.OnPause = func(paused bool) {
+			if paused {
+				fmt.Println("Remote input is paused while you use the mouse")
+			} else {
+				fmt.Println("Remote input is resumed")
+			}
+			n.Control.SetPaused(paused)
+		}
+		go n.Local.Run(n.Context, source)
+	}
+
+	return nil
 }
 
-func (n *SharingNode) ShareScreen(id peer.ID) error {
+func (n *SharingNode) ShareScreen(id peer.ID, share ShareOptions) error {
 	if id == n.Host.ID() {
 		return errors.New("can't share screen to self")
 	}
@@ -66,20 +148,44 @@ func (n *SharingNode) ShareScreen(id peer.ID) error {
 		logger.Error(err)
 		return err
 	}
-	event, err := n.AccessVerifier.Access(id, protocol.ID(config.EventID))
-	if err != nil {
-		logger.Error(err)
-		return err
+
+	// Without control the session continues as view only
+	var event network.Stream
+	if !share.ViewOnly {
+		event, err = n.AccessVerifier.Access(id, protocol.ID(config.EventID))
+		if err != nil {
+			logger.Warning("Control is not available, the session is view only: ", err)
+			event = nil
+		}
+	}
+
+	// Audio is optional, so the session works without it
+	var audio network.Stream
+	if share.Audio {
+		audio, err = n.AccessVerifier.Access(id, protocol.ID(config.AudioID))
+		if err != nil {
+			logger.Warning("Audio is not available: ", err)
+			audio = nil
+		}
 	}
 
-	StartRemoteDesktop(stream, event, *n.SharingOptions)
+	share.Macros = n.Macros
+	shareErr := StartRemoteDesktop(stream, event, audio, *n.SharingOptions, share)
 	err = stream.Close()
 	if err != nil {
 		logger.Error(err)
 	}
-	err = event.Close()
-	if err != nil {
-		logger.Error(err)
+	if event != nil {
+		err = event.Close()
+		if err != nil {
+			logger.Error(err)
+		}
+	}
+	if audio != nil {
+		err = audio.Close()
+		if err != nil {
+			logger.Error(err)
+		}
 	}
 
 	defer func() {
@@ -87,7 +193,7 @@ func (n *SharingNode) ShareScreen(id peer.ID) error {
 		err = pprof.WriteHeapProfile(f)
 	}()
 
-	return nil
+	return shareErr
 }
 
 func (n *SharingNode) handleScreenStream(stream network.Stream) {
@@ -100,15 +206,18 @@ func (n *SharingNode) handleScreenStream(stream network.Stream) {
 		return
 	}
 
-	num := screenshot.NumActiveDisplays()
 	screenInfo := &ScreenInfo{
-		Displays: make([]DisplayInfo, num),
-	}
-	for i := 0; i < num; i++ {
-		screenInfo.Displays[i] = DisplayInfo{
-			Width:  screenshot.GetDisplayBounds(i).Dx(),
-			Height: screenshot.GetDisplayBounds(i).Dy(),
-		}
+		Displays:        hostDisplays(),
+		Codecs:          n.StreamService.Codecs(),
+		Formats:         SupportedFormats,
+		Scaling:         true,
+		Reconfigure:     true,
+		EventAck:        true,
+		EventFormats:    SupportedEventFormats,
+		TextInput:       true,
+		SharedClock:     true,
+		Accept:          true,
+		RecordingNotice: true,
 	}
 
 	err = write(stream, screenInfo)
@@ -127,6 +236,16 @@ func (n *SharingNode) handleScreenStream(stream network.Stream) {
 	err = n.StreamService.AddClient(stream, streamInfo)
 	if err != nil {
 		logger.Error(err)
+		if streamInfo.Accept {
+			err = write(stream, &StreamAccept{Error: err.Error()})
+			if err != nil {
+				logger.Error(err)
+			}
+		}
+		err = stream.Reset()
+		if err != nil {
+			logger.Error(err)
+		}
 		return
 	}
 }
@@ -149,21 +268,95 @@ func (n *SharingNode) handleScreenEvent(stream network.Stream) {
 	if err != nil {
 		logger.Warning(err)
 	}
+	err = write(stream, &ControlGrant{Allowed: result})
+	if err != nil {
+		logger.Error(err)
+		return
+	}
 	if !result {
 		return
 	}
 
-	targetDisplay := 0
+	receiver := NewEventReceiver(bufio.NewReader(stream), displayBounds(), NewReaderLimits(n.LimitsOptions), n.Input)
+	receiver.HoldTimeout = HoldTimeout(n.InputOptions)
+	receiver.ScrollScale = ScrollScale(n.InputOptions)
+	receiver.Local = n.Local
+	remote := stream.Conn().RemotePeer()
+	rights := n.AccessStore.PeerRights(remote)
+	receiver.Filter, err = NewInputFilter(&rights, n.InputOptions)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+
+	var writeLock sync.Mutex
+	session := n.Control.Join(remote, func(state *ControlState) {
+		receiver.ControlChanged(state)
 
-	num := screenshot.NumActiveDisplays()
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		err := write(stream, state)
+		if err != nil {
+			logger.Warning(err)
+		}
+	})
+	defer n.Control.Leave(session)
+	// The viewer is told about the dropped chord with its state, old viewers ignore it
+	receiver.Filter.OnBlocked = func(chord KeyChord) {
+		logger.Info("Chord ", chord, " of ", remote, " is blocked")
+		n.Control.Dropped(session, chord.String())
+	}
+	receiver.Allowed = func() bool {
+		return n.Control.Allowed(remote)
+	}
+	receiver.OnControl = func(request bool) {
+		if request {
+			n.Control.Request(remote)
+		} else {
+			n.Control.Release(remote)
+		}
+	}
+	receiver.OnRecording = func(recording bool) {
+		n.notifyRecording(remote, recording)
+	}
+	receiver.OnKeyFrame = n.StreamService.RequestKeyFrame
+	receiver.Run()
+}
 
-	offsetX := 0
-	for i := targetDisplay + 1; i < num; i++ {
-		offsetX = offsetX + screenshot.GetDisplayBounds(i).Dx()
+// notifyRecording tells the host user that the viewer started or stopped recording
+func (n *SharingNode) notifyRecording(remote peer.ID, recording bool) {
+	message := fmt.Sprintf("The remote node %s stopped recording of your screen", remote)
+	if recording {
+		message = fmt.Sprintf("The remote node %s started recording of your screen", remote)
 	}
+	fmt.Println(message)
+	// The notice doesn't hold events of the viewer
+	go n.allower.Notify("Recording", message)
+}
 
-	receiver := NewEventReceiver(bufio.NewReader(stream), offsetX)
-	receiver.Run()
+func (n *SharingNode) handleAudioStream(stream network.Stream) {
+	logger.Info("Got a new audio connection!")
+	result, err := n.AccessVerifier.Verify(stream)
+	if err != nil {
+		logger.Warning(err)
+	}
+	if !result {
+		err = stream.Reset()
+		if err != nil {
+			logger.Error(err)
+		}
+		return
+	}
+
+	err = ServeAudio(stream, n.AudioOptions)
+	if err != nil {
+		logger.Error(err)
+	}
+
+	err = stream.Reset()
+	if err != nil {
+		logger.Error(err)
+	}
 }
 
 func write(writer io.Writer, val interface{}) error {
@@ -177,53 +370,257 @@ func write(writer io.Writer, val interface{}) error {
 	return err
 }
 
+// maxMessageSize bounds one line of the handshake and of the control messages
+const maxMessageSize = 64 << 10
+
+// read reads one line byte by byte, so the data which follows the line stays in the reader
 func read(reader io.Reader, val interface{}) error {
-	r := bufio.NewReader(reader)
-	b, err := r.ReadBytes('\n')
-	if err != nil {
-		return err
+	b := make([]byte, 0, 256)
+	c := make([]byte, 1)
+	for {
+		_, err := io.ReadFull(reader, c)
+		if err != nil {
+			return err
+		}
+		if c[0] == '\n' {
+			break
+		}
+		if len(b) == maxMessageSize {
+			return &LimitError{
+				Limit: "Message size",
+				Value: len(b) + 1,
+				Max:   maxMessageSize,
+			}
+		}
+		b = append(b, c[0])
 	}
 
 	return json.Unmarshal(b, val)
 }
 
-func StartRemoteDesktop(stream network.Stream, event network.Stream, options config.SharingOptions) {
-	streamCtx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// RemoteStream is the stream negotiated with the host
+type RemoteStream struct {
+	// Display is the native size of the remote display, events use it
+	Display DisplayInfo
+	// Output is the size of the encoded video
+	Output DisplayInfo
+	Codec  *VideoCodec
+	Params *EncoderParams
+	Reader *DataReader
+	// Reconfigurable tells that the host accepts stream changes
+	Reconfigurable bool
+	// EventAck tells that the host answers the event stream with ControlGrant
+	EventAck bool
+	// EventFormat is the format of the event stream, old hosts read only JSON
+	EventFormat int
+	// TextInput tells that the host types text events
+	TextInput bool
+	// SharedClock tells that video packets carry the host time of audio packets
+	SharedClock bool
+	// RecordingNotice tells that recording notices are sent in stream changes rather than events
+	RecordingNotice bool
+	control         io.Writer
+}
+
+// Reconfigure asks the host to change the running stream
+func (r *RemoteStream) Reconfigure(change *StreamChange) error {
+	if !r.Reconfigurable {
+		return errors.New("remote node can't change the running stream")
+	}
+
+	return write(r.control, change)
+}
+
+// screenOptions builds the capture request from the viewer's config
+func screenOptions(options config.SharingOptions, targetDisplay int) ScreenOptions {
+	screen := ScreenOptions{
+		GrabbingOptions: options.ScreenGrabbingOptions,
+		TargetDisplay:   targetDisplay,
+		Backend:         options.CaptureOptions["backend"],
+		Algorithm:       options.CaptureOptions["algorithm"],
+	}
+	screen.Width, _ = strconv.Atoi(options.CaptureOptions["width"])
+	screen.Height, _ = strconv.Atoi(options.CaptureOptions["height"])
+	screen.Scale, _ = strconv.ParseFloat(options.CaptureOptions["scale"], 64)
+
+	return screen
+}
 
-	var err error
+// requestStream negotiates the stream with the host
+func requestStream(stream io.ReadWriter, options config.SharingOptions, targetDisplay int) (*RemoteStream, error) {
 	screenInfo := &ScreenInfo{}
-	err = read(stream, screenInfo)
+	err := read(stream, screenInfo)
 	if err != nil {
-		logger.Error(err)
-		return
+		return nil, err
 	}
 
-	targetDisplay := 0
+	if targetDisplay >= len(screenInfo.Displays) {
+		return nil, errors.New("remote node doesn't have the target display")
+	}
 	remoteDisplay := screenInfo.Displays[targetDisplay]
 
+	videoCodec, err := SelectCodec(screenInfo.Codecs, options.Codecs)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Selected codec: ", videoCodec.Name)
+
 	streamInfo := &StreamInfo{}
 	streamInfo.StreamOptions.Options = options.StreamOptions
-	streamInfo.ScreenOptions.GrabbingOptions = options.ScreenGrabbingOptions
-	streamInfo.ScreenOptions.TargetDisplay = targetDisplay
+	streamInfo.StreamOptions.Codec = videoCodec.Name
+	streamInfo.ScreenOptions = screenOptions(options, targetDisplay)
+	// Wrong encoder options are reported here rather than by the host
+	params, err := ParseEncoderParams(videoCodec, streamInfo.StreamOptions.Options, streamInfo.ScreenOptions.GrabbingOptions)
+	if err != nil {
+		return nil, err
+	}
+	streamInfo.Format = SelectFormat(screenInfo.Formats, options.StreamOptions["crc"] == "true")
+	streamInfo.ScreenOptions.Cursor = streamInfo.Format.Version != LegacyFormat && options.CaptureOptions["cursor"] == "true"
+	streamInfo.Accept = screenInfo.Accept
 	err = write(stream, streamInfo)
 	if err != nil {
-		logger.Error(err)
-		return
+		return nil, err
 	}
 
-	myapp := app.New()
-	win := myapp.NewWindow("Desktop Sharing")
-	win.Resize(fyne.Size{remoteDisplay.Width, remoteDisplay.Height})
+	// Old hosts always encode the native size
+	output := remoteDisplay
+	if screenInfo.Scaling {
+		output = OutputSize(&streamInfo.ScreenOptions, remoteDisplay)
+	}
+	// The session may run already with the output of another viewer
+	if streamInfo.Accept {
+		accept := &StreamAccept{}
+		err = read(stream, accept)
+		if err != nil {
+			return nil, err
+		}
+		if accept.Error != "" {
+			return nil, errors.New(accept.Error)
+		}
+		output = accept.Output
+		if accept.FrameRate > 0 {
+			params.FrameRate = accept.FrameRate
+		}
+	}
+
+	return &RemoteStream{
+		Display: remoteDisplay,
+		Output:  output,
+		Codec:   videoCodec,
+		Params:  params,
+		Reader:  NewDataReaderFormat(stream, streamInfo.Format, NewReaderLimits(options.LimitsOptions)),
+		// Updates of the stream are delivered in control packets of the framed format
+		Reconfigurable:  screenInfo.Reconfigure && streamInfo.Format.Version != LegacyFormat,
+		control:         stream,
+		EventAck:        screenInfo.EventAck,
+		EventFormat:     SelectEventFormat(screenInfo.EventFormats),
+		TextInput:       screenInfo.TextInput,
+		SharedClock:     screenInfo.SharedClock && streamInfo.Format.Version != LegacyFormat,
+		RecordingNotice: screenInfo.RecordingNotice && screenInfo.Reconfigure && streamInfo.Format.Version != LegacyFormat,
+	}, nil
+}
 
-	imgWidget := canvas.NewImageFromImage(image.NewYCbCr(image.Rect(0, 0, remoteDisplay.Width, remoteDisplay.Height), image.YCbCrSubsampleRatio420))
-	win.SetContent(imgWidget)
+// CaptureScreen receives the screen of the remote node without any window and writes it to the sink
+func (n *SharingNode) CaptureScreen(id peer.ID, headless *HeadlessOptions) error {
+	if id == n.Host.ID() {
+		return errors.New("can't capture screen of self")
+	}
 
-	eventSender := NewEventSender(bufio.NewWriter(event), remoteDisplay.Width, remoteDisplay.Height)
-	eventSender.Subscribe(win)
+	sink, err := NewHeadlessSink(headless)
+	if err != nil {
+		return err
+	}
+	if closer, ok := sink.(io.Closer); ok {
+		defer func() {
+			err := closer.Close()
+			if err != nil {
+				logger.Error(err)
+			}
+		}()
+	}
 
+	stream, err := n.AccessVerifier.Access(id, protocol.ID(config.StreamID))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := stream.Reset()
+		if err != nil {
+			logger.Error(err)
+		}
+	}()
+
+	options := *n.SharingOptions
+	// Raw dump is playable only as h264 elementary stream
+	if headless.Mode == HeadlessRaw {
+		options.Codecs = []string{DefaultCodec}
+	}
+
+	remote, err := requestStream(stream, options, 0)
+	if err != nil {
+		return err
+	}
+
+	return StreamReceive(n.Context, remote.Codec, options.DecoderOptions, remote.Reader, sink)
+}
+
+// StartRemoteDesktop shows the remote screen until the window is closed and returns the error which stopped the stream
+func StartRemoteDesktop(stream network.Stream, event network.Stream, audio network.Stream, options config.SharingOptions, share ShareOptions) error {
+	streamCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	targetDisplay := 0
+	remote, err := requestStream(stream, options, targetDisplay)
+	if err != nil {
+		return err
+	}
+	remoteDisplay, videoCodec := &remote.Display, remote.Codec
+
+	viewOnly := event == nil
+	title := "Desktop Sharing"
+	if viewOnly {
+		title = "Desktop Sharing (view only)"
+	}
+
+	myapp := app.New()
+	win := myapp.NewWindow(title)
+	win.Resize(fyne.Size{remote.Output.Width, remote.Output.Height})
+
+	imgWidget := canvas.NewImageFromImage(image.NewYCbCr(image.Rect(0, 0, remote.Output.Width, remote.Output.Height), image.YCbCrSubsampleRatio420))
+	overlay := NewCursorOverlay(imgWidget, *remoteDisplay)
+	win.SetContent(overlay.Content())
+
+	var eventSender *EventSender
+	// granted tells that the host reads the event stream, so key frames are requested there
+	var granted int32
+	if !viewOnly {
+		eventSender = NewEventSender(bufio.NewWriter(event), remoteDisplay.Width, remoteDisplay.Height, remote.EventFormat)
+		defer eventSender.Close()
+		// Events wait for the grant of hosts which send it
+		eventSender.SetEnabled(!remote.EventAck)
+		eventSender.SetTextInput(remote.TextInput)
+		eventSender.SelectDisplay(targetDisplay)
+		eventSender.Subscribe(win)
+		if !remote.EventAck {
+			granted = 1
+		}
+	}
+	// The host is told about recording by every viewer, view only ones too
+	onRecording := func(recording bool) {
+		if remote.RecordingNotice {
+			err := remote.Reconfigure(&StreamChange{Recording: &recording})
+			if err != nil {
+				logger.Error(err)
+			}
+		} else if eventSender != nil {
+			eventSender.SendRecording(recording)
+		}
+	}
+
+	windowClosed := make(chan struct{})
 	var closeCallback glfw.CloseCallback
 	closeCallback = win.Viewport().SetCloseCallback(func(w *glfw.Window) {
+		close(windowClosed)
 		err = stream.Reset()
 		if err != nil {
 			logger.Error(err)
@@ -231,19 +628,176 @@ func StartRemoteDesktop(stream network.Stream, event network.Stream, options con
 		closeCallback(w)
 	})
 
-	onImage := func(img *image.YCbCr) error {
-		imgWidget.Image = img
-		c := win.Canvas()
-		if c != nil {
-			c.Refresh(imgWidget)
-		}
+	controls := NewViewerControls(myapp)
+	status := fmt.Sprintf("Codec: %s", videoCodec.Name)
+	controls.SetStatus(status)
+	controls.SetViewOnly(viewOnly)
+	controls.Show()
+
+	if !viewOnly && remote.EventAck {
+		go func() {
+			grant := &ControlGrant{}
+			err := read(event, grant)
+			if err != nil {
+				logger.Warning("Control is not granted: ", err)
+				grant.Allowed = false
+			}
+			if !grant.Allowed {
+				logger.Info("The remote node denied control, the session is view only")
+			}
+			eventSender.SetEnabled(grant.Allowed)
+			controls.SetViewOnly(!grant.Allowed)
+			if !grant.Allowed {
+				return
+			}
+			atomic.StoreInt32(&granted, 1)
+			defer atomic.StoreInt32(&granted, 0)
+
+			// Several viewers share the input token of the host
+			controls.AddControl(eventSender.RequestControl, eventSender.ReleaseControl)
+			for {
+				state := &ControlState{}
+				err := read(event, state)
+				if err != nil {
+					return
+				}
+				eventSender.SetEnabled(state.You && !state.Paused)
+				controls.SetControl(state)
+				if state.Dropped != "" {
+					notice := fmt.Sprintf("The remote node dropped %s, the chord is blocked on the host", state.Dropped)
+					logger.Warning(notice)
+					controls.SetStatus(notice)
+				}
+			}
+		}()
+	}
 
-		return nil
+	// Video waits for the audio latency, so both play in sync
+	var clock *MediaClock
+	if audio != nil && remote.SharedClock {
+		clock = NewMediaClock(AudioLatency(options.AudioOptions))
+	}
+	if audio != nil {
+		go func() {
+			if clock != nil {
+				defer clock.Stop()
+			}
+			player, err := NewRemoteAudio(audio, options, clock)
+			if err != nil {
+				logger.Warning("Audio is not available: ", err)
+				return
+			}
+			defer player.Close()
+
+			controls.AddAudio(player)
+			err = player.Play(streamCtx, NewDataReaderFormat(audio, player.Format, NewReaderLimits(options.LimitsOptions)))
+			if err != nil {
+				logger.Warning(err)
+			}
+		}()
 	}
 
-	reader := NewDataReader(stream)
+	recorder := NewSessionRecorder(options.RecordingOptions, videoCodec, remote.Output.Width, remote.Output.Height, remote.Params.FrameRate, onRecording)
+	defer recorder.Stop()
+	if share.Record {
+		err = recorder.Start()
+		if err != nil {
+			logger.Error(err)
+		}
+	}
+	controls.AddRecorder(recorder)
+	if remote.Reconfigurable {
+		controls.AddQuality(remote.Reconfigure)
+	}
+	if !viewOnly && remote.TextInput {
+		controls.AddTyping(eventSender.TypeText)
+	}
+	if !viewOnly {
+		if share.Macros == nil {
+			share.Macros = NewMacroSender(options.Macros)
+		}
+		share.Macros.SetSender(eventSender)
+		defer share.Macros.SetSender(nil)
+		controls.AddMacros(share.Macros)
+	}
 
-	go StreamReceive(streamCtx, remoteDisplay.Width, remoteDisplay.Height, reader, onImage)
+	broken := false
+	sink := &FuncSink{
+		OnPacket: func(packet *Packet) error {
+			recorder.WriteVideo(packet)
+			return nil
+		},
+		OnImage: func(img *image.YCbCr) error {
+			if broken {
+				broken = false
+				controls.SetStatus(status)
+			}
+			imgWidget.Image = img
+			c := win.Canvas()
+			if c != nil {
+				c.Refresh(imgWidget)
+			}
+
+			return nil
+		},
+		OnCursor: func(update *CursorUpdate) error {
+			overlay.Update(update)
+			c := win.Canvas()
+			if c != nil {
+				overlay.Refresh(c)
+			}
+
+			return nil
+		},
+		OnUpdate: func(update *StreamUpdate) error {
+			status = fmt.Sprintf("Codec: %s, %dx%d at %d fps", videoCodec.Name, update.Output.Width, update.Output.Height, update.FrameRate)
+			controls.SetStatus(status)
+			err := recorder.Resize(update)
+			if err != nil {
+				logger.Error(err)
+			}
+
+			return nil
+		},
+		OnError: func(decodeErr *DecodeError) error {
+			broken = true
+			controls.SetStatus(fmt.Sprintf("%s\n%v, waiting for a key frame", status, decodeErr))
+			if atomic.LoadInt32(&granted) == 1 {
+				eventSender.RequestKeyFrame()
+			} else if remote.Reconfigurable {
+				err := remote.Reconfigure(&StreamChange{KeyFrame: true})
+				if err != nil {
+					logger.Warning(err)
+				}
+			}
+
+			return nil
+		},
+		Clock: clock,
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		err := StreamReceive(streamCtx, videoCodec, options.DecoderOptions, remote.Reader, sink)
+		select {
+		case <-windowClosed:
+			// The stream is reset by closing of the window
+			err = nil
+		default:
+		}
+		if err != nil {
+			logger.Warning(err)
+			controls.SetStatus(fmt.Sprintf("%s\nStream stopped: %v", status, err))
+		}
+		stopped <- err
+	}()
 
 	win.ShowAndRun()
+
+	select {
+	case err = <-stopped:
+		return err
+	default:
+		return nil
+	}
 }
@@ -0,0 +1,105 @@
+package sharingnode
+
+import (
+	"github.com/xgreenx/desktop-sharing/src/config"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	grant := &ControlGrant{}
+	reader := strings.NewReader("{\"allowed\":true}\nrest")
+	err := read(reader, grant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !grant.Allowed {
+		t.Error("the line isn't decoded")
+	}
+	if reader.Len() != len("rest") {
+		t.Errorf("read consumed the data after the line")
+	}
+
+	err = read(strings.NewReader(strings.Repeat(" ", maxMessageSize+1)+"\n"), grant)
+	if _, ok := err.(*LimitError); !ok {
+		t.Errorf("got %v for the long line, want the limit error", err)
+	}
+}
+
+// fakeHost answers the stream handshake of the viewer with the screen info and the accept
+func fakeHost(t *testing.T, conn net.Conn, screen *ScreenInfo, accept *StreamAccept) {
+	defer conn.Close()
+	err := write(conn, screen)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	info := &StreamInfo{}
+	err = read(conn, info)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if info.Accept != screen.Accept {
+		t.Errorf("viewer asks for accept %v, host offers %v", info.Accept, screen.Accept)
+	}
+	if info.Accept {
+		err = write(conn, accept)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestRequestStream(t *testing.T) {
+	codec := availableCodec(t)
+	options := config.SharingOptions{
+		StreamOptions:         map[string]string{},
+		ScreenGrabbingOptions: map[string]string{},
+		CaptureOptions:        map[string]string{"width": "960", "height": "540"},
+		Codecs:                []string{codec.Name},
+	}
+	display := DisplayInfo{1920, 1080}
+
+	tests := []struct {
+		name   string
+		screen ScreenInfo
+		accept StreamAccept
+		want   DisplayInfo
+		err    bool
+	}{
+		{"old host", ScreenInfo{}, StreamAccept{}, display, false},
+		{"scaling host", ScreenInfo{Scaling: true}, StreamAccept{}, DisplayInfo{960, 540}, false},
+		{"late viewer", ScreenInfo{Scaling: true, Accept: true}, StreamAccept{StreamUpdate: StreamUpdate{Output: DisplayInfo{640, 360}, FrameRate: 15}}, DisplayInfo{640, 360}, false},
+		{"rejected viewer", ScreenInfo{Scaling: true, Accept: true}, StreamAccept{Error: "no session"}, DisplayInfo{}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			host, viewer := net.Pipe()
+			defer viewer.Close()
+			screen := test.screen
+			screen.Displays = []DisplayInfo{display}
+			screen.Codecs = []string{codec.Name}
+			go fakeHost(t, host, &screen, &test.accept)
+
+			remote, err := requestStream(viewer, options, 0)
+			if test.err {
+				if err == nil {
+					t.Error("the rejected stream is accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if remote.Output != test.want {
+				t.Errorf("got output %v, want %v", remote.Output, test.want)
+			}
+			if test.accept.FrameRate > 0 && remote.Params.FrameRate != test.accept.FrameRate {
+				t.Errorf("got frame rate %d, want %d", remote.Params.FrameRate, test.accept.FrameRate)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package sharingnode
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrSinkDone is returned by a sink which doesn't need more data
+var ErrSinkDone = errors.New("Sink is done")
+
+// FrameSink receives the stream on the viewer side
+type FrameSink interface {
+	// WritePacket receives every encoded video packet before decoding
+	WritePacket(packet *Packet) error
+	// WriteImage receives every decoded frame. The decoder reuses the image for one of the next
+	// frames, sinks which keep it longer than a few frames copy it
+	WriteImage(img *image.YCbCr) error
+}
+
+// DecodeErrorSink is implemented by sinks which report broken packets. The stream
+// continues from the next key frame unless the sink returns an error
+type DecodeErrorSink interface {
+	DecodeFailed(err *DecodeError) error
+}
+
+// ClockSink is implemented by sinks which play video in sync with audio. The stream waits
+// until the packet is due before it is decoded
+type ClockSink interface {
+	WaitPacket(pts int64)
+}
+
+type HeadlessMode string
+
+const (
+	HeadlessPNG        HeadlessMode = "png"
+	HeadlessRaw        HeadlessMode = "raw"
+	HeadlessScreenshot HeadlessMode = "screenshot"
+)
+
+type HeadlessOptions struct {
+	Mode HeadlessMode
+	// Path is a directory for png mode and a file for other modes
+	Path string
+	// Interval between saved frames in png mode
+	Interval time.Duration
+}
+
+func NewHeadlessSink(options *HeadlessOptions) (FrameSink, error) {
+	switch options.Mode {
+	case HeadlessPNG:
+		return NewPNGSink(options.Path, options.Interval)
+	case HeadlessRaw:
+		return NewRawSink(options.Path)
+	case HeadlessScreenshot:
+		return NewScreenshotSink(options.Path), nil
+	}
+
+	return nil, errors.Errorf("Unknown headless mode %s", options.Mode)
+}
+
+func savePNG(path string, img image.Image) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	err = png.Encode(f, img)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// PNGSink saves decoded frames into the directory not more often than the interval
+type PNGSink struct {
+	dir      string
+	interval time.Duration
+	last     time.Time
+	index    int
+}
+
+func NewPNGSink(dir string, interval time.Duration) (*PNGSink, error) {
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PNGSink{
+		dir:      dir,
+		interval: interval,
+	}, nil
+}
+
+func (s *PNGSink) WritePacket(packet *Packet) error {
+	return nil
+}
+
+func (s *PNGSink) WriteImage(img *image.YCbCr) error {
+	if !s.last.IsZero() && time.Since(s.last) < s.interval {
+		return nil
+	}
+	s.last = time.Now()
+
+	path := filepath.Join(s.dir, fmt.Sprintf("frame-%06d.png", s.index))
+	s.index++
+
+	return savePNG(path, img)
+}
+
+// RawSink dumps encoded packets as is, for h264 it is a playable Annex B stream
+type RawSink struct {
+	file *os.File
+}
+
+func NewRawSink(path string) (*RawSink, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RawSink{
+		file: f,
+	}, nil
+}
+
+func (s *RawSink) WritePacket(packet *Packet) error {
+	_, err := s.file.Write(packet.Data)
+	return err
+}
+
+func (s *RawSink) WriteImage(img *image.YCbCr) error {
+	return nil
+}
+
+func (s *RawSink) Close() error {
+	return s.file.Close()
+}
+
+// ScreenshotSink saves the first decoded frame and finishes
+type ScreenshotSink struct {
+	path string
+}
+
+func NewScreenshotSink(path string) *ScreenshotSink {
+	return &ScreenshotSink{
+		path: path,
+	}
+}
+
+func (s *ScreenshotSink) WritePacket(packet *Packet) error {
+	return nil
+}
+
+func (s *ScreenshotSink) WriteImage(img *image.YCbCr) error {
+	err := savePNG(s.path, img)
+	if err != nil {
+		return err
+	}
+
+	return ErrSinkDone
+}
+
+// FuncSink adapts callbacks to the FrameSink and CursorSink interfaces
+type FuncSink struct {
+	OnPacket func(*Packet) error
+	OnImage  func(*image.YCbCr) error
+	OnCursor func(*CursorUpdate) error
+	OnError  func(*DecodeError) error
+	OnUpdate func(*StreamUpdate) error
+	// Clock delays video to the time of its packets
+	Clock *MediaClock
+}
+
+func (s *FuncSink) WritePacket(packet *Packet) error {
+	if s.OnPacket == nil {
+		return nil
+	}
+	return s.OnPacket(packet)
+}
+
+func (s *FuncSink) WriteImage(img *image.YCbCr) error {
+	if s.OnImage == nil {
+		return nil
+	}
+	return s.OnImage(img)
+}
+
+func (s *FuncSink) WriteCursor(update *CursorUpdate) error {
+	if s.OnCursor == nil {
+		return nil
+	}
+	return s.OnCursor(update)
+}
+
+func (s *FuncSink) WriteUpdate(update *StreamUpdate) error {
+	if s.OnUpdate == nil {
+		return nil
+	}
+	return s.OnUpdate(update)
+}
+
+func (s *FuncSink) WaitPacket(pts int64) {
+	if s.Clock != nil {
+		s.Clock.Wait(pts)
+	}
+}
+
+func (s *FuncSink) DecodeFailed(err *DecodeError) error {
+	if s.OnError == nil {
+		return nil
+	}
+	return s.OnError(err)
+}
@@ -1,16 +1,18 @@
 package sharingnode
 
-// #include <stdlib.h>
-// #include <stdint.h>
-import "C"
 import (
+	"bufio"
 	"context"
-	"github.com/imkira/go-libav/avcodec"
-	"github.com/imkira/go-libav/avutil"
+	"encoding/json"
 	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/pkg/errors"
+	"github.com/xgreenx/desktop-sharing/src/config"
 	"image"
+	"os"
+	"strconv"
 	"sync"
+	"time"
 )
 
 type DisplayInfo struct {
@@ -20,55 +22,162 @@ type DisplayInfo struct {
 
 type ScreenInfo struct {
 	Displays []DisplayInfo `json:"displays"`
+	Codecs   []string      `json:"codecs"`
+	// Formats are versions of the data format supported by the host
+	Formats []int `json:"formats,omitempty"`
+	// Scaling tells that the host encodes the video in the requested size
+	Scaling bool `json:"scaling,omitempty"`
+	// Reconfigure tells that the host accepts stream changes from the viewer
+	Reconfigure bool `json:"reconfigure,omitempty"`
+	// EventAck tells that the host answers the event stream with ControlGrant
+	EventAck bool `json:"event_ack,omitempty"`
+	// EventFormats are formats of the event stream accepted by the host
+	EventFormats []int `json:"event_formats,omitempty"`
+	// TextInput tells that the host types text events, old hosts need key events of characters
+	TextInput bool `json:"text_input,omitempty"`
+	// SharedClock tells that video and audio packets carry the host time, so they can play in sync
+	SharedClock bool `json:"shared_clock,omitempty"`
+	// Accept tells that the host answers StreamInfo with StreamAccept
+	Accept bool `json:"accept,omitempty"`
+	// RecordingNotice tells that the host reads recording notices in stream changes, so view only viewers send them
+	RecordingNotice bool `json:"recording_notice,omitempty"`
 }
 
 type StreamOptions struct {
 	Options map[string]string `json:"options"`
+	Codec   string            `json:"codec"`
 }
 
 type ScreenOptions struct {
 	GrabbingOptions map[string]string `json:"grabbing_options"`
 	TargetDisplay   int               `json:"target_display"`
+	// Backend is the capture backend, x11grab is used when it is empty
+	Backend string `json:"backend,omitempty"`
+	// Cursor asks for cursor packets, it requires the framed data format
+	Cursor bool `json:"cursor,omitempty"`
+	// Width and Height or Scale request downscaling of the video on the host
+	Width     int     `json:"width,omitempty"`
+	Height    int     `json:"height,omitempty"`
+	Scale     float64 `json:"scale,omitempty"`
+	Algorithm string  `json:"algorithm,omitempty"`
 }
 
 type StreamInfo struct {
 	StreamOptions StreamOptions `json:"stream_options"`
 	ScreenOptions ScreenOptions `json:"screen_options"`
+	Format        DataFormat    `json:"format"`
+	// Accept asks the host for StreamAccept before the data
+	Accept bool `json:"accept,omitempty"`
 }
 
+// StreamAccept is the answer to StreamInfo. Viewers which join a running session get its output
+// rather than the one they requested
+type StreamAccept struct {
+	StreamUpdate
+	Error string `json:"error,omitempty"`
+}
+
+// minChangeInterval is the shortest time between stream changes of a viewer, every change restarts the encoder
+const minChangeInterval = time.Second
+
 type Client struct {
 	sync.Mutex
 	stream  network.Stream
 	service *StreamService
 	queue   *DataWriter
-	Data    chan []byte
+	Data    chan *Packet
+	// changed and keyFrame are the times of the last accepted change and key frame request
+	changed  time.Time
+	keyFrame time.Time
 }
 
-func NewClient(stream network.Stream, service *StreamService) *Client {
+func NewClient(stream network.Stream, service *StreamService, format DataFormat) *Client {
 	return &Client{
 		stream:  stream,
 		service: service,
-		queue:   NewDataWriter(stream),
-		Data:    make(chan []byte, 128),
+		queue:   NewDataWriterFormat(stream, format),
+		Data:    make(chan *Packet, 128),
 	}
 }
 
 func (c *Client) Start() {
+	go c.receiveChanges()
 	for {
 		select {
 		case err := <-c.queue.Error:
 			logger.Error(err)
 			c.Close()
 			return
-		case data, ok := <-c.Data:
+		case packet, ok := <-c.Data:
 			if !ok {
 				return
 			}
-			c.queue.AddData(data)
+			// The legacy format can't tell video from other packets
+			if c.queue.Format().Version == LegacyFormat && packet.Type != PacketVideo {
+				continue
+			}
+			c.queue.AddPacket(packet)
 		}
 	}
 }
 
+// receiveChanges applies stream changes which the viewer writes after the stream info
+func (c *Client) receiveChanges() {
+	limits := NewReaderLimits(c.service.options.LimitsOptions)
+	reader := bufio.NewReader(c.stream)
+	for {
+		line, err := readLine(reader, limits.MaxEventLine)
+		if err != nil {
+			return
+		}
+
+		change := &StreamChange{}
+		err = json.Unmarshal(line, change)
+		if err != nil {
+			logger.Warning("Wrong stream change: ", err)
+			return
+		}
+
+		remote := c.stream.Conn().RemotePeer()
+		if change.Recording != nil && c.service.OnRecording != nil {
+			c.service.OnRecording(remote, *change.Recording)
+		}
+		now := time.Now()
+		// Every viewer recovers with key frames, so they aren't gated on control
+		if change.KeyFrame && now.Sub(c.keyFrame) >= minChangeInterval {
+			c.keyFrame = now
+			c.service.RequestKeyFrame()
+		}
+		if change.Empty() || !c.allowChange(remote, now) {
+			continue
+		}
+
+		err = c.service.Reconfigure(change)
+		if err != nil {
+			logger.Warning("Stream is not reconfigured: ", err)
+			continue
+		}
+		if c.service.OnChange != nil {
+			c.service.OnChange(remote, change)
+		}
+	}
+}
+
+// allowChange tells whether the viewer may change the shared session now. Only the viewer
+// which controls the screen changes it and not more often than minChangeInterval
+func (c *Client) allowChange(remote peer.ID, now time.Time) bool {
+	if c.service.Allowed != nil && !c.service.Allowed(remote) {
+		logger.Warning("Stream change of ", remote, " is denied, it doesn't control the screen")
+		return false
+	}
+	if now.Sub(c.changed) < minChangeInterval {
+		logger.Warning("Stream change of ", remote, " is dropped, changes are too frequent")
+		return false
+	}
+	c.changed = now
+	return true
+}
+
 func (c *Client) Close() {
 	c.service.RemoveClient(c)
 	close(c.Data)
@@ -78,73 +187,296 @@ func (c *Client) Close() {
 	}
 }
 
+type encoderOutput struct {
+	data   chan *Packet
+	update *StreamUpdate
+}
+
 type StreamSession struct {
 	sync.Mutex
 	clients      map[*Client]struct{}
 	videoEncoder *VideoEncoder
-	header       []byte
+	recorder     *Recorder
+	recording    map[string]string
+	capture      map[string]string
+	header       *Packet
+	codec        string
+	frameRate    int
+	info         StreamInfo
+	rect         image.Rectangle
+	// update describes the output which is streamed now
+	update *StreamUpdate
+	// outputs of the current encoder and of the replaced ones which aren't drained yet
+	outputs     []*encoderOutput
+	cursor      *CursorTracker
+	cursorShape *Packet
+	cursorPos   *Packet
 }
 
-func NewStreamSession() *StreamSession {
+func NewStreamSession(options *config.SharingOptions) *StreamSession {
 	session := &StreamSession{
-		clients: make(map[*Client]struct{}),
-		header:  make([]byte, 0),
+		clients:   make(map[*Client]struct{}),
+		header:    &Packet{Type: PacketVideo},
+		recording: options.RecordingOptions,
+		capture:   options.CaptureOptions,
 	}
 
 	return session
 }
 
 func (s *StreamSession) Start(options *StreamInfo) error {
-	provider, err := NewImageProvider(&options.ScreenOptions)
+	s.rect = captureRect(&options.ScreenOptions)
+	encoder, output, err := s.startEncoder(options)
+	if err != nil {
+		return err
+	}
+	s.videoEncoder, s.outputs = encoder, []*encoderOutput{output}
+	s.update = output.update
+	s.codec = encoder.Codec
+
+	if s.recording["host"] == "true" {
+		err = s.startRecording(s.update.Output.Width, s.update.Output.Height)
+		if err != nil {
+			logger.Error("Host recording is not started: ", err)
+		}
+	}
+
+	if options.ScreenOptions.Cursor && displayBackend(options.ScreenOptions.Backend) {
+		s.cursor, err = NewCursorTracker(captureDisplay(s.capture), s.rect)
+		if err != nil {
+			logger.Warning("Cursor is not tracked: ", err)
+		} else {
+			go s.cursor.Run(s.cursorData)
+		}
+	}
+
+	go s.processData()
+
+	return nil
+}
+
+// startEncoder starts capturing and encoding with the options, the session must be locked
+func (s *StreamSession) startEncoder(options *StreamInfo) (*VideoEncoder, *encoderOutput, error) {
+	videoCodec, err := FindVideoCodec(options.StreamOptions.Codec)
+	if err != nil {
+		return nil, nil, err
+	}
+	params, err := ParseEncoderParams(videoCodec, options.StreamOptions.Options, options.ScreenOptions.GrabbingOptions)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Capture paces frames with the frame rate of the encoder
+	info := *options
+	info.ScreenOptions.GrabbingOptions = copyOptions(options.ScreenOptions.GrabbingOptions)
+	info.ScreenOptions.GrabbingOptions["r"] = strconv.Itoa(params.FrameRate)
+
+	provider, err := NewImageProvider(&info.ScreenOptions, s.capture, s.rect)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encoder := NewVideoEncoder(&info.StreamOptions, params)
+	detector := NewChangeDetector(&info.ScreenOptions, s.capture, s.rect)
+	ch, err := encoder.Encode(provider, detector, keepalive(&info.ScreenOptions))
 	if err != nil {
 		provider.Close()
+		if detector != nil {
+			detector.Close()
+		}
+		encoder.Close()
+		return nil, nil, err
+	}
+
+	s.info = info
+	s.frameRate = params.FrameRate
+
+	return encoder, &encoderOutput{
+		data: ch,
+		update: &StreamUpdate{
+			Output:    provider.Size(),
+			FrameRate: params.FrameRate,
+		},
+	}, nil
+}
+
+// Reconfigure applies the change of a viewer to all viewers of the session. The new encoder
+// replaces the old one when the old one is drained, so the stream continues from a key frame
+func (s *StreamSession) Reconfigure(change *StreamChange) error {
+	s.Lock()
+	if s.videoEncoder == nil {
+		s.Unlock()
+		return errors.New("Session is not started")
+	}
+
+	info, err := change.Apply(s.info)
+	if err != nil {
+		s.Unlock()
 		return err
 	}
 
-	s.videoEncoder = NewVideoEncoder(&options.StreamOptions)
-	ch, err := s.videoEncoder.Encode(provider)
+	old := s.videoEncoder
+	encoder, output, err := s.startEncoder(info)
 	if err != nil {
-		s.videoEncoder.Close()
-		s.videoEncoder = nil
+		s.Unlock()
 		return err
 	}
+	s.videoEncoder = encoder
+	s.outputs = append(s.outputs, output)
+	update := output.update
+	s.Unlock()
 
-	go s.processData(ch)
+	// The old encoder may wait for the session to take its packets
+	old.Close()
+	logger.Info("Stream is reconfigured: ", update.Output.Width, "x", update.Output.Height, " at ", update.FrameRate, " fps")
 
 	return nil
 }
 
-func (s *StreamSession) processData(dataCh chan []byte) {
+func (s *StreamSession) cursorData(data []byte) {
 	s.Lock()
-	s.header = <-dataCh
+	defer s.Unlock()
+
+	packet := &Packet{
+		Type: PacketCursor,
+		PTS:  hostTime(time.Now()),
+		Data: data,
+	}
+	// New clients receive the last shape and position
+	if data[0] == cursorShape {
+		s.cursorShape = packet
+	} else {
+		s.cursorPos = packet
+	}
+	s.broadcast(packet)
+}
 
+// broadcast sends the packet to all clients without blocking, the session must be locked
+func (s *StreamSession) broadcast(packet *Packet) {
 	for client, _ := range s.clients {
-		// Non blocking sent
 		select {
-		case client.Data <- s.header:
+		case client.Data <- packet:
 		default:
 		}
 	}
+}
+
+func (s *StreamSession) startRecording(width, height int) error {
+	videoCodec, err := FindVideoCodec(s.codec)
+	if err != nil {
+		return err
+	}
+
+	path, err := RecordingPath(s.recording["path"], s.recording["format"])
+	if err != nil {
+		return err
+	}
+
+	s.recorder, err = NewRecorder(path, s.recording["format"], videoCodec, width, height, s.frameRate)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	logger.Info("Recording session to ", path)
+	return nil
+}
+
+func (s *StreamSession) record(packet *Packet) {
+	if s.recorder == nil {
+		return
+	}
+
+	err := s.recorder.WriteVideo(packet)
+	if err != nil {
+		logger.Error(err)
+		s.recorder.Close()
+		s.recorder = nil
+	}
+}
+
+// updatePacket announces the current output of the session, the session must be locked
+func (s *StreamSession) updatePacket() *Packet {
+	data, err := json.Marshal(s.update)
+	if err != nil {
+		logger.Error(err)
+		return nil
+	}
+
+	return &Packet{
+		Type: PacketControl,
+		PTS:  hostTime(time.Now()),
+		Data: data,
+	}
+}
+
+func (s *StreamSession) processData() {
+	s.Lock()
+	output := s.outputs[0]
 	s.Unlock()
-	for data := range dataCh {
+	// The first packet of every encoder is the header for new clients
+	fresh := true
+	for {
+		packet, ok := <-output.data
 		s.Lock()
-		tmp := data
-		for client, _ := range s.clients {
-			// Non blocking sent
-			select {
-			case client.Data <- tmp:
-			default:
+		if !ok {
+			s.outputs = s.outputs[1:]
+			if len(s.outputs) == 0 {
+				s.Unlock()
+				break
 			}
+			output = s.outputs[0]
+			fresh = true
+			s.Unlock()
+			continue
 		}
+
+		if fresh {
+			fresh = false
+			s.header = packet
+			s.update = output.update
+			if s.recorder != nil && s.recorder.Size() != s.update.Output {
+				s.recorder.Close()
+				s.recorder = nil
+				err := s.startRecording(s.update.Output.Width, s.update.Output.Height)
+				if err != nil {
+					logger.Error("Host recording is not restarted: ", err)
+				}
+			}
+			update := s.updatePacket()
+			if update != nil {
+				s.broadcast(update)
+			}
+		}
+		s.record(packet)
+		s.broadcast(packet)
 		s.Unlock()
 	}
+
 	s.Lock()
+	if s.cursor != nil {
+		s.cursor.Close()
+		s.cursor = nil
+	}
+	if s.recorder != nil {
+		s.recorder.Close()
+		s.recorder = nil
+	}
 	for client, _ := range s.clients {
 		client.Close()
 	}
 	s.Unlock()
 }
 
+func (s *StreamSession) RequestKeyFrame() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.videoEncoder != nil {
+		s.videoEncoder.RequestKeyFrame()
+	}
+}
+
 func (s *StreamSession) Active() bool {
 	s.Lock()
 	defer s.Unlock()
@@ -155,10 +487,40 @@ func (s *StreamSession) AddClient(client *Client) {
 	s.Lock()
 	defer s.Unlock()
 	s.clients[client] = struct{}{}
+	// The update describes the header which follows it
+	if s.update != nil {
+		if update := s.updatePacket(); update != nil {
+			client.Data <- update
+		}
+	}
 	client.Data <- s.header
+	for _, packet := range []*Packet{s.cursorShape, s.cursorPos} {
+		if packet != nil {
+			client.Data <- packet
+		}
+	}
 	go client.Start()
 }
 
+// Accept returns the output of the session for the new viewer. Viewers which don't read StreamAccept
+// assume the output of their request, so they are rejected when the session has another one
+func (s *StreamSession) Accept(info *StreamInfo) (*StreamUpdate, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	update := *s.update
+	if info.Accept {
+		return &update, nil
+	}
+
+	expected := OutputSize(&info.ScreenOptions, DisplayInfo{s.rect.Dx(), s.rect.Dy()})
+	if expected != update.Output {
+		return nil, errors.Errorf("Session streams %dx%d, the viewer expects %dx%d",
+			update.Output.Width, update.Output.Height, expected.Width, expected.Height)
+	}
+	return &update, nil
+}
+
 func (s *StreamSession) RemoveClient(client *Client) {
 	s.Lock()
 	delete(s.clients, client)
@@ -173,15 +535,28 @@ func (s *StreamSession) RemoveClient(client *Client) {
 type StreamService struct {
 	sync.Mutex
 	ActiveSession *StreamSession
+	options       *config.SharingOptions
+	// Allowed tells whether the viewer may change the session, nil allows every viewer
+	Allowed func(peer.ID) bool
+	// OnChange is called after the change of the viewer is applied
+	OnChange func(peer.ID, *StreamChange)
+	// OnRecording is called when the viewer starts or stops recording
+	OnRecording func(peer.ID, bool)
 }
 
-func NewStreamService() *StreamService {
-	return &StreamService{}
+func NewStreamService(options *config.SharingOptions) *StreamService {
+	return &StreamService{
+		options: options,
+	}
 }
 
 func (s *StreamService) AddClient(stream network.Stream, info *StreamInfo) error {
 	s.Lock()
 	defer s.Unlock()
+
+	if !formatSupported(info.Format.Version) {
+		return errors.Errorf("Unsupported data format %d", info.Format.Version)
+	}
 	//defer func() {
 	//	err := stream.Close()
 	//	if err != nil {
@@ -196,7 +571,7 @@ func (s *StreamService) AddClient(stream network.Stream, info *StreamInfo) error
 
 	var err error = nil
 	if s.ActiveSession == nil {
-		s.ActiveSession = NewStreamSession()
+		s.ActiveSession = NewStreamSession(s.options)
 
 		err = s.ActiveSession.Start(info)
 		if err != nil {
@@ -205,113 +580,166 @@ func (s *StreamService) AddClient(stream network.Stream, info *StreamInfo) error
 		}
 	}
 
-	client := NewClient(stream, s)
+	update, err := s.ActiveSession.Accept(info)
+	if err != nil {
+		return err
+	}
+	if info.Accept {
+		err = write(stream, &StreamAccept{StreamUpdate: *update})
+		if err != nil {
+			return err
+		}
+	}
+
+	client := NewClient(stream, s, info.Format)
 	s.ActiveSession.AddClient(client)
 
 	return nil
 }
 
-func (s *StreamService) RemoveClient(client *Client) {
+// Reconfigure changes the active session
+func (s *StreamService) Reconfigure(change *StreamChange) error {
 	s.Lock()
 	defer s.Unlock()
 
-	s.ActiveSession.RemoveClient(client)
-	if !s.ActiveSession.Active() {
-		s.ActiveSession = nil
+	if s.ActiveSession == nil {
+		return errors.New("No active session")
 	}
+	return s.ActiveSession.Reconfigure(change)
 }
 
-func StreamReceive(streamCtx context.Context, width, height int, reader *DataReader, onImage func(img *image.YCbCr) error) {
-	//avutil.SetLogLevel(avutil.LogLevelDebug)
+// RequestKeyFrame forces a key frame in the active session, so viewers recover from broken packets
+func (s *StreamService) RequestKeyFrame() {
+	s.Lock()
+	defer s.Unlock()
 
-	codec := avcodec.FindDecoderByName("h264")
-	if codec == nil {
-		panic(errors.New("Codec not found"))
-	}
-	codecContext, err := avcodec.NewContextWithCodec(codec)
-	if err != nil {
-		panic(err)
+	if s.ActiveSession != nil {
+		s.ActiveSession.RequestKeyFrame()
 	}
+}
 
-	packet, err := avcodec.NewPacket()
-	if err != nil {
-		panic(err)
+// Codecs returns codecs which can be offered to a new client
+func (s *StreamService) Codecs() []string {
+	s.Lock()
+	defer s.Unlock()
+
+	// All clients share the active session, so they must use its codec
+	if s.ActiveSession != nil {
+		return []string{s.ActiveSession.codec}
 	}
 
-	err = codecContext.OpenWithCodec(codec, nil)
-	if err != nil {
-		panic(err)
+	return AvailableEncoders()
+}
+
+func (s *StreamService) RemoveClient(client *Client) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.ActiveSession.RemoveClient(client)
+	if !s.ActiveSession.Active() {
+		s.ActiveSession = nil
 	}
+}
 
-	parserContext, err := avcodec.NewParserContext(codecContext)
+func writeCursor(sink CursorSink, data []byte) error {
+	update, err := DecodeCursor(data)
 	if err != nil {
-		panic(err)
+		// Broken cursor doesn't break the video
+		logger.Warning(err)
+		return nil
 	}
 
-	defer packet.Free()
-	defer codecContext.Free()
+	return sink.WriteCursor(update)
+}
 
-	ySize := width * height
-	cdSize := width * height / 4
-	crSize := width * height / 4
+// StreamReceive decodes the stream into the sink until the reader fails or the sink is done
+func StreamReceive(streamCtx context.Context, videoCodec *VideoCodec, decoderOptions map[string]string, reader *DataReader, sink FrameSink) error {
+	//avutil.SetLogLevel(avutil.LogLevelDebug)
 
-	needParse := true
+	decoder, err := NewVideoDecoder(videoCodec, decoderOptions)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	// After a broken packet the decoder waits for the next key frame
+	broken := false
 	for {
-		receipt, err := reader.GetData()
+		received, err := reader.GetPacket()
 		if err != nil {
-			return
+			return err
 		}
-
-		data := receipt
-		dataSize := len(data)
-
-		for dataSize > 0 {
-			if needParse {
-				ret, err := parserContext.Parse(data, dataSize, packet)
-				if err != nil {
-					panic(err)
+		if received.Type == PacketCursor {
+			if cursorSink, ok := sink.(CursorSink); ok {
+				err = writeCursor(cursorSink, received.Data)
+				if err == ErrSinkDone {
+					return nil
+				} else if err != nil {
+					return err
 				}
-
-				data = data[ret:]
-				dataSize = dataSize - ret
-
-				if packet.Size() == 0 {
+			}
+			continue
+		}
+		if received.Type == PacketControl {
+			if controlSink, ok := sink.(ControlSink); ok {
+				update, err := DecodeStreamUpdate(received.Data)
+				if err != nil {
+					logger.Warning(err)
 					continue
 				}
-			} else {
-				packet.SetData(data)
-				packet.SetSize(dataSize)
-				dataSize = 0
+				err = controlSink.WriteUpdate(update)
+				if err == ErrSinkDone {
+					return nil
+				} else if err != nil {
+					return err
+				}
 			}
+			continue
+		}
+		if received.Type != PacketVideo {
+			continue
+		}
 
-			onFrame := func(f *avutil.Frame) error {
-				yData := C.GoBytes(f.Data(0), C.int(ySize))
-				cbData := C.GoBytes(f.Data(1), C.int(cdSize))
-				crData := C.GoBytes(f.Data(2), C.int(crSize))
-				img := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
-				for i := 0; i < ySize; i++ {
-					img.Y[i] = yData[i]
-					if i < cdSize {
-						img.Cb[i] = cbData[i]
-					}
-					if i < crSize {
-						img.Cr[i] = crData[i]
-					}
-				}
+		err = sink.WritePacket(received)
+		if err == ErrSinkDone {
+			return nil
+		} else if err != nil {
+			return err
+		}
 
-				return onImage(img)
+		if broken {
+			if received.Flags&PacketFlagKey == 0 && !isKeyFrame(videoCodec.Name, received.Data) {
+				continue
 			}
+			broken = false
+		}
+
+		if clockSink, ok := sink.(ClockSink); ok {
+			clockSink.WaitPacket(received.PTS)
+		}
 
-			_, err = codecContext.DecodeVideo(packet, onFrame)
+		var sinkErr error
+		err = decoder.Decode(received.Data, func(img *image.YCbCr) error {
+			sinkErr = sink.WriteImage(img)
+			return sinkErr
+		})
+		if sinkErr == ErrSinkDone {
+			return nil
+		} else if sinkErr != nil {
+			return sinkErr
+		} else if err == nil {
+			continue
+		}
 
-			if err != nil {
-				panic(err)
-			}
-			if needParse {
-				parserContext.Free()
-				needParse = false
-			} else {
-				C.free(packet.Data())
+		decodeErr := &DecodeError{PTS: received.PTS, Err: err}
+		logger.Warning(decodeErr)
+		broken = true
+		if errorSink, ok := sink.(DecodeErrorSink); ok {
+			err = errorSink.DecodeFailed(decodeErr)
+			if err == ErrSinkDone {
+				return nil
+			} else if err != nil {
+				return err
 			}
 		}
 	}
@@ -0,0 +1,133 @@
+package sharingnode
+
+import (
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/xgreenx/desktop-sharing/src/config"
+	"testing"
+	"time"
+)
+
+// nextPackets reads packets of the client until the count of video packets is read
+func nextPackets(tb testing.TB, client *Client, count int) (*StreamUpdate, []*Packet) {
+	var update *StreamUpdate
+	var video []*Packet
+	timeout := time.After(30 * time.Second)
+	for len(video) < count {
+		select {
+		case packet := <-client.Data:
+			switch packet.Type {
+			case PacketControl:
+				var err error
+				update, err = DecodeStreamUpdate(packet.Data)
+				if err != nil {
+					tb.Fatal(err)
+				}
+			case PacketVideo:
+				// Packets of the replaced encoder may come before the update
+				if update != nil {
+					video = append(video, packet)
+				}
+			}
+		case <-timeout:
+			tb.Fatalf("got %d video packets, want %d", len(video), count)
+		}
+	}
+	return update, video
+}
+
+// TestStreamSession streams the test pattern without a display to a client of the session
+func TestStreamSession(t *testing.T) {
+	const width, height, packets = 96, 64, 5
+
+	codec := availableCodec(t)
+	session := NewStreamSession(&config.SharingOptions{
+		RecordingOptions: map[string]string{},
+		CaptureOptions:   map[string]string{},
+	})
+	info := &StreamInfo{
+		StreamOptions: testStreamOptions(codec.Name),
+		ScreenOptions: ScreenOptions{
+			GrabbingOptions: map[string]string{"r": testFrameRate, "change_detection": ChangeDetectionOff},
+			Backend:         BackendTestPattern,
+			Width:           width,
+			Height:          height,
+		},
+		Format: DataFormat{Version: FramedFormat},
+	}
+	err := session.Start(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client isn't started, so the test reads its packets instead of the stream
+	client := &Client{Data: make(chan *Packet, 128)}
+	session.Lock()
+	session.clients[client] = struct{}{}
+	session.Unlock()
+	defer session.RemoveClient(client)
+
+	update, video := nextPackets(t, client, packets)
+	if update.Output != (DisplayInfo{width, height}) {
+		t.Errorf("got output %v, want %dx%d", update.Output, width, height)
+	}
+	images := decodePackets(t, codec, video)
+	if len(images) == 0 {
+		t.Fatal("no frames decoded")
+	}
+	if images[0].Rect.Dx() != width || images[0].Rect.Dy() != height {
+		t.Errorf("got frame %v, want %dx%d", images[0].Rect, width, height)
+	}
+
+	// Late viewers get the output of the session or are rejected if they can't read it
+	late := &StreamInfo{ScreenOptions: ScreenOptions{Width: width * 2, Height: height * 2}}
+	_, err = session.Accept(late)
+	if err == nil {
+		t.Error("the viewer which expects another size is accepted")
+	}
+	late.Accept = true
+	accepted, err := session.Accept(late)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted.Output != (DisplayInfo{width, height}) {
+		t.Errorf("the late viewer got output %v", accepted.Output)
+	}
+
+	// Reconfiguring continues the stream from a key frame of the new size
+	err = session.Reconfigure(&StreamChange{Width: width / 2, Height: height / 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for update.Output.Width != width/2 {
+		update, video = nextPackets(t, client, 1)
+	}
+	if update.Output != (DisplayInfo{width / 2, height / 2}) {
+		t.Errorf("got output %v after the change", update.Output)
+	}
+	if !video[0].Key() {
+		t.Error("the stream of the new size doesn't start from a key frame")
+	}
+}
+
+func TestAllowChange(t *testing.T) {
+	const holder, viewer = peer.ID("holder"), peer.ID("viewer")
+	service := NewStreamService(&config.SharingOptions{})
+	service.Allowed = func(id peer.ID) bool {
+		return id == holder
+	}
+	client := &Client{service: service}
+
+	now := time.Now()
+	if client.allowChange(viewer, now) {
+		t.Error("the viewer without control changes the stream")
+	}
+	if !client.allowChange(holder, now) {
+		t.Fatal("the viewer in control can't change the stream")
+	}
+	if client.allowChange(holder, now.Add(minChangeInterval/2)) {
+		t.Error("changes aren't rate limited")
+	}
+	if !client.allowChange(holder, now.Add(minChangeInterval)) {
+		t.Error("the change after the interval is dropped")
+	}
+}
@@ -6,15 +6,20 @@ import (
 	"github.com/imkira/go-libav/avformat"
 	"github.com/imkira/go-libav/avutil"
 	"github.com/imkira/go-libav/swscale"
-	"github.com/kbinani/screenshot"
 	"github.com/pkg/errors"
+	"image"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-type ImageProvider struct {
+// X11GrabProvider captures the X11 display through the x11grab input device
+type X11GrabProvider struct {
 	sync.Mutex
-	ScreenOptions
 	DisplayInfo
+	native          image.Rectangle
+	clock           *frameClock
 	swsContext      *swscale.Context
 	avFormatContext *avformat.Context
 	avInputFormat   *avformat.Input
@@ -24,21 +29,20 @@ type ImageProvider struct {
 	optionsScreen   *avutil.Dictionary
 }
 
-func NewImageProvider(options *ScreenOptions) (*ImageProvider, error) {
-	rect := screenshot.GetDisplayBounds(options.TargetDisplay)
-	provider := &ImageProvider{
-		ScreenOptions: *options,
-		DisplayInfo: DisplayInfo{
-			Width:  rect.Dx(),
-			Height: rect.Dy(),
-		},
+// NewX11GrabProvider captures the rectangle of the display and scales it to the output size
+func NewX11GrabProvider(options *ScreenOptions, display string, rect image.Rectangle, output DisplayInfo) (*X11GrabProvider, error) {
+	provider := &X11GrabProvider{
+		DisplayInfo: output,
+		native:      rect,
+		clock:       newFrameClock(frameRate(options)),
 	}
 	provider.optionsScreen = avutil.NewDictionary()
 
 	var err error
-	provider.swsContext, err = swscale.NewContext(
-		&swscale.DataDescription{provider.Width, provider.Height, avutil.PIX_FMT_RGBA},
+	provider.swsContext, err = newScaleContext(
+		&swscale.DataDescription{rect.Dx(), rect.Dy(), avutil.PIX_FMT_RGBA},
 		&swscale.DataDescription{provider.Width, provider.Height, avutil.PIX_FMT_YUV420P},
+		options.Algorithm,
 	)
 	if err != nil {
 		goto Error
@@ -56,15 +60,22 @@ func NewImageProvider(options *ScreenOptions) (*ImageProvider, error) {
 		goto Error
 	}
 
-	provider.ScreenOptions.GrabbingOptions["video_size"] = fmt.Sprintf("%dx%d", provider.Width, provider.Height)
-	for key, value := range provider.ScreenOptions.GrabbingOptions {
+	for key, value := range options.GrabbingOptions {
 		err = provider.optionsScreen.Set(key, value)
 		if err != nil {
 			goto Error
 		}
 	}
+	err = provider.optionsScreen.Set("video_size", fmt.Sprintf("%dx%d", rect.Dx(), rect.Dy()))
+	if err != nil {
+		goto Error
+	}
+	err = provider.optionsScreen.Set("framerate", strconv.Itoa(frameRate(options)))
+	if err != nil {
+		goto Error
+	}
 
-	err = provider.avFormatContext.OpenInput(":0.0+0,0", provider.avInputFormat, provider.optionsScreen)
+	err = provider.avFormatContext.OpenInput(fmt.Sprintf("%s+%d,%d", display, rect.Min.X, rect.Min.Y), provider.avInputFormat, provider.optionsScreen)
 	if err != nil {
 		goto Error
 	}
@@ -112,13 +123,18 @@ Error:
 	return nil, err
 }
 
-func (i *ImageProvider) Image(onImage func(*avutil.Frame) error) error {
+func (i *X11GrabProvider) Size() DisplayInfo {
+	return i.DisplayInfo
+}
+
+func (i *X11GrabProvider) Image(onImage func(*avutil.Frame) error) error {
 	i.Lock()
 	defer i.Unlock()
 
 	if i.avFormatContext == nil {
 		return errors.New("Image provider already closed")
 	}
+	i.clock.Wait()
 
 	frameDone, err := i.avFormatContext.ReadFrame(i.decPacket)
 	if err != nil {
@@ -135,7 +151,7 @@ func (i *ImageProvider) Image(onImage func(*avutil.Frame) error) error {
 			return err
 		}
 
-		i.swsContext.Scale(decFrame, 0, i.Height, i.encFrame)
+		i.swsContext.Scale(decFrame, 0, i.native.Dy(), i.encFrame)
 		err = onImage(i.encFrame)
 		decFrame.FreeData(0)
 		return err
@@ -144,7 +160,7 @@ func (i *ImageProvider) Image(onImage func(*avutil.Frame) error) error {
 	return err
 }
 
-func (i *ImageProvider) Close() {
+func (i *X11GrabProvider) Close() {
 	i.Lock()
 	defer i.Unlock()
 	if i.optionsScreen != nil {
@@ -172,27 +188,43 @@ type VideoEncoder struct {
 	codecContext *avcodec.Context
 	encPacket    *avcodec.Packet
 	codecOption  *avutil.Dictionary
+	Stats        FrameStats
+	keyFrame     int32
+	params       *EncoderParams
 }
 
-func NewVideoEncoder(streamOptions *StreamOptions) *VideoEncoder {
+func NewVideoEncoder(streamOptions *StreamOptions, params *EncoderParams) *VideoEncoder {
 	//avutil.SetLogLevel(avutil.LogLevelTrace)
 	encoder := &VideoEncoder{
 		StreamOptions: *streamOptions,
+		params:        params,
+	}
+	if encoder.Codec == "" {
+		encoder.Codec = DefaultCodec
 	}
 
 	return encoder
 }
 
-func (e *VideoEncoder) Encode(provider *ImageProvider) (chan []byte, error) {
+// Encode starts encoding of frames from the provider. Frames without changes are skipped,
+// but one frame is encoded at least every keepalive interval. Packets carry the host time of the capture
+func (e *VideoEncoder) Encode(provider ImageProvider, detector ChangeDetector, keepalive time.Duration) (chan *Packet, error) {
 	e.Lock()
 	defer e.Unlock()
 	var err error
 
-	ch := make(chan []byte, 4)
+	size := provider.Size()
+	ch := make(chan *Packet, 4)
 	e.codecOption = avutil.NewDictionary()
-	codec := avcodec.FindEncoderByName("libx264")
+	var codec *avcodec.Codec
+	videoCodec, err := FindVideoCodec(e.Codec)
+	if err != nil {
+		goto Error
+	}
+
+	codec = videoCodec.FindEncoder()
 	if codec == nil {
-		err = errors.New("Codec not found")
+		err = &CodecError{Codec: videoCodec.Name, Encoder: true}
 		goto Error
 	}
 
@@ -206,15 +238,31 @@ func (e *VideoEncoder) Encode(provider *ImageProvider) (chan []byte, error) {
 		goto Error
 	}
 
-	e.codecContext.SetBitRate(90000)
-	e.codecContext.SetWidth(provider.Width)
-	e.codecContext.SetHeight(provider.Height)
-	e.codecContext.SetTimeBase(avutil.NewRational(1, 10))
-	e.codecContext.SetFrameRate(avutil.NewRational(10, 1))
+	e.codecContext.SetWidth(size.Width)
+	e.codecContext.SetHeight(size.Height)
+	e.codecContext.SetTimeBase(avutil.NewRational(1, e.params.FrameRate))
+	e.codecContext.SetFrameRate(avutil.NewRational(e.params.FrameRate, 1))
 	e.codecContext.SetMaxBFrames(0)
 	e.codecContext.SetPixelFormat(avutil.PIX_FMT_YUV420P)
+	e.codecContext.SetThreadCount(e.params.Threads)
+	if e.params.GOP > 0 {
+		e.codecContext.SetGOPSize(e.params.GOP)
+	}
+
+	switch e.params.RateControl {
+	case RateVBV:
+		// Quality based encoders take the bitrate as the cap
+		e.codecContext.SetBitRate(e.params.MaxRate)
+		e.codecContext.SetRCMaxRate(e.params.MaxRate)
+		e.codecContext.SetRCBufferSize(int(e.params.BufSize))
+	case RateCBR:
+		e.codecContext.SetBitRate(e.params.BitRate)
+		e.codecContext.SetRCMinRate(e.params.BitRate)
+		e.codecContext.SetRCMaxRate(e.params.MaxRate)
+		e.codecContext.SetRCBufferSize(int(e.params.BufSize))
+	}
 
-	for key, value := range e.Options {
+	for key, value := range e.params.CodecOptions(videoCodec, e.Options) {
 		err = e.codecOption.Set(key, value)
 		if err != nil {
 			goto Error
@@ -231,8 +279,15 @@ func (e *VideoEncoder) Encode(provider *ImageProvider) (chan []byte, error) {
 			close(ch)
 			e.Close()
 			provider.Close()
+			if detector != nil {
+				detector.Close()
+			}
+			logger.Info("Encoding finished: ", e.Stats.String())
 		}()
 		index := 0
+		// captured keeps the host time of frames which the encoder hasn't returned yet
+		captured := make(map[int64]int64)
+		var lastEncoded time.Time
 		for {
 			e.Lock()
 			if e.codecContext == nil {
@@ -240,17 +295,46 @@ func (e *VideoEncoder) Encode(provider *ImageProvider) (chan []byte, error) {
 				return
 			}
 			//now := time.Now()
+			if detector != nil {
+				detector.BeforeCapture()
+			}
 			err = provider.Image(func(encFrame *avutil.Frame) error {
 				encFrame.SetPTS(int64(index))
 				index++
 
+				encFrame.SetPictureType(avutil.PictureTypeNone)
+				if atomic.CompareAndSwapInt32(&e.keyFrame, 1, 0) {
+					encFrame.SetPictureType(avutil.PictureTypeI)
+				}
+
+				changed := detector == nil || detector.Changed(encFrame) || encFrame.PictureType() == avutil.PictureTypeI
+				alive := !changed && time.Since(lastEncoded) >= keepalive
+				e.Stats.add(changed || alive, alive)
+				if !changed && !alive {
+					return nil
+				}
+				lastEncoded = time.Now()
+				captured[encFrame.PTS()] = hostTime(lastEncoded)
+
 				e.encPacket.SetData(nil)
 				e.encPacket.SetSize(0)
 
 				_, err = e.codecContext.EncodeVideo(e.encPacket, encFrame, func(data []byte) error {
-					cData := make([]byte, len(data))
-					copy(cData, data)
-					ch <- cData
+					pts := e.encPacket.PTS()
+					packet := &Packet{
+						Type: PacketVideo,
+						PTS:  captured[pts],
+						Data: data,
+					}
+					if e.encPacket.Flags()&avcodec.PacketFlagKey != 0 {
+						packet.Flags |= PacketFlagKey
+					}
+					for index := range captured {
+						if index <= pts {
+							delete(captured, index)
+						}
+					}
+					ch <- packet
 					return nil
 				})
 
@@ -280,6 +364,11 @@ Error:
 	return nil, err
 }
 
+// RequestKeyFrame makes the encoder encode the next frame as a key frame
+func (e *VideoEncoder) RequestKeyFrame() {
+	atomic.StoreInt32(&e.keyFrame, 1)
+}
+
 func (e *VideoEncoder) Close() {
 	e.Lock()
 	defer e.Unlock()